@@ -2,8 +2,218 @@
 -- This file is licensed under the MIT License.
 -- See the LICENSE file for details.
 
+CREATE TABLE IF NOT EXISTS users (
+    id BIGSERIAL PRIMARY KEY,
+    subject TEXT NOT NULL UNIQUE, -- Stable identity from the identity provider
+    email TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 CREATE TABLE IF NOT EXISTS todos (
     id SERIAL PRIMARY KEY,
     task TEXT NOT NULL,
     completed BOOLEAN DEFAULT FALSE
 );
+
+-- Every todo belongs to a user. Todos created before accounts existed have no
+-- owner and are not visible to anyone.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS owner_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS todos_owner_id_idx ON todos (owner_id, id);
+
+-- Browser sessions from the OpenID Connect login. Only a hash of the session id is stored.
+CREATE TABLE IF NOT EXISTS sessions (
+    id_hash BYTEA PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+-- Personal API tokens. Only a hash of the token is stored.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    scope TEXT NOT NULL CHECK (scope IN ('read', 'write')),
+    prefix TEXT NOT NULL,
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
+
+-- Todos belong to lists; users access them through list membership. Every user
+-- has one personal list, which existing todos are moved to.
+CREATE TABLE IF NOT EXISTS lists (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    personal BOOLEAN NOT NULL DEFAULT FALSE,
+    created_by BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS lists_personal_idx ON lists (created_by) WHERE personal;
+CREATE TABLE IF NOT EXISTS list_members (
+    list_id BIGINT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    PRIMARY KEY (list_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS list_members_user_id_idx ON list_members (user_id);
+CREATE TABLE IF NOT EXISTS list_invitations (
+    list_id BIGINT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+    email TEXT NOT NULL, -- Lower case
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    invited_by BIGINT REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (list_id, email)
+);
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS list_id BIGINT REFERENCES lists (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS todos_list_id_idx ON todos (list_id, id);
+INSERT INTO lists (name, personal, created_by)
+    SELECT DISTINCT 'My todos', TRUE, owner_id FROM todos WHERE list_id IS NULL AND owner_id IS NOT NULL
+    ON CONFLICT (created_by) WHERE personal DO NOTHING;
+INSERT INTO list_members (list_id, user_id, role)
+    SELECT id, created_by, 'owner' FROM lists WHERE personal
+    ON CONFLICT (list_id, user_id) DO NOTHING;
+UPDATE todos SET list_id = lists.id FROM lists
+    WHERE todos.list_id IS NULL AND lists.personal AND lists.created_by = todos.owner_id;
+
+-- Multi-tenancy. Every row belongs to a tenant; existing rows go to the default tenant.
+CREATE TABLE IF NOT EXISTS tenants (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+INSERT INTO tenants (name) VALUES ('default') ON CONFLICT (name) DO NOTHING;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id);
+UPDATE users SET tenant_id = (SELECT id FROM tenants WHERE name = 'default') WHERE tenant_id IS NULL;
+ALTER TABLE users ALTER COLUMN tenant_id SET NOT NULL;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id);
+UPDATE sessions SET tenant_id = users.tenant_id FROM users WHERE sessions.tenant_id IS NULL AND users.id = sessions.user_id;
+ALTER TABLE sessions ALTER COLUMN tenant_id SET NOT NULL;
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id);
+UPDATE api_tokens SET tenant_id = users.tenant_id FROM users WHERE api_tokens.tenant_id IS NULL AND users.id = api_tokens.user_id;
+ALTER TABLE api_tokens ALTER COLUMN tenant_id SET NOT NULL;
+-- Tenant data defaults to the tenant of the transaction (app.tenant_id, set by the app)
+ALTER TABLE lists ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id)
+    DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint;
+UPDATE lists SET tenant_id = users.tenant_id FROM users WHERE lists.tenant_id IS NULL AND users.id = lists.created_by;
+ALTER TABLE list_members ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id)
+    DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint;
+UPDATE list_members SET tenant_id = lists.tenant_id FROM lists WHERE list_members.tenant_id IS NULL AND lists.id = list_members.list_id;
+ALTER TABLE list_invitations ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id)
+    DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint;
+UPDATE list_invitations SET tenant_id = lists.tenant_id FROM lists WHERE list_invitations.tenant_id IS NULL AND lists.id = list_invitations.list_id;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants (id)
+    DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint;
+UPDATE todos SET tenant_id = COALESCE(
+    (SELECT tenant_id FROM lists WHERE lists.id = todos.list_id),
+    (SELECT id FROM tenants WHERE name = 'default')) WHERE tenant_id IS NULL;
+-- Row-level security: the app only sees rows of its transaction's tenant, and none
+-- without one. FORCE applies the policies to the table owner too; only superusers
+-- and BYPASSRLS roles (migrations, backups) see every tenant.
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['lists', 'list_members', 'list_invitations', 'todos'] LOOP
+        EXECUTE format('ALTER TABLE %I ALTER COLUMN tenant_id SET NOT NULL', t);
+        EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I (tenant_id)', t || '_tenant_id_idx', t);
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+        EXECUTE format('CREATE POLICY tenant_isolation ON %I
+            USING (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)
+            WITH CHECK (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)', t);
+    END LOOP;
+END
+$$;
+
+-- Audit log of todo changes, written in the same transaction as the change.
+-- Append-only: updates and deletes are rejected, and the policies only allow
+-- reading and appending events of the transaction's tenant.
+CREATE TABLE IF NOT EXISTS todo_events (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL REFERENCES tenants (id)
+        DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+    todo_id INTEGER NOT NULL, -- No foreign keys: events outlive todos, lists and users
+    list_id BIGINT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('create', 'update', 'delete')),
+    actor_id BIGINT NOT NULL,
+    actor_method TEXT NOT NULL, -- session, token or dev
+    before JSONB,
+    after JSONB,
+    request_id TEXT,
+    trace_id TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS todo_events_todo_id_idx ON todo_events (todo_id, id);
+CREATE OR REPLACE FUNCTION todo_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'todo_events is append-only';
+END
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS todo_events_append_only ON todo_events;
+CREATE TRIGGER todo_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON todo_events
+    FOR EACH STATEMENT EXECUTE FUNCTION todo_events_append_only();
+ALTER TABLE todo_events ENABLE ROW LEVEL SECURITY;
+ALTER TABLE todo_events FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_read ON todo_events;
+CREATE POLICY tenant_read ON todo_events FOR SELECT
+    USING (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::bigint);
+DROP POLICY IF EXISTS tenant_append ON todo_events;
+CREATE POLICY tenant_append ON todo_events FOR INSERT
+    WITH CHECK (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::bigint);
+
+-- Trash: deleted todos keep their row, with deleted_at set, until they are
+-- purged after the retention period (TRASH_RETENTION). Restores and purges are audited.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS todos_deleted_at_idx ON todos (deleted_at) WHERE deleted_at IS NOT NULL;
+ALTER TABLE todo_events DROP CONSTRAINT IF EXISTS todo_events_action_check;
+ALTER TABLE todo_events ADD CONSTRAINT todo_events_action_check
+    CHECK (action IN ('create', 'update', 'delete', 'restore', 'purge'));
+
+-- Planning fields. Existing todos get the migration time as created_at and
+-- updated_at, and no completed_at.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal'
+    CHECK (priority IN ('low', 'normal', 'high', 'urgent'));
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT '';
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS todos_list_id_due_at_idx ON todos (list_id, due_at) WHERE deleted_at IS NULL;
+
+-- Tags shared by the todos of a tenant; todo_tags attaches them to todos.
+-- GET /todos?tag= filters with semi-joins on the todo_tags primary key.
+CREATE TABLE IF NOT EXISTS tags (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL REFERENCES tenants (id)
+        DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+    name TEXT NOT NULL, -- Lowercase
+    UNIQUE (tenant_id, name)
+);
+CREATE TABLE IF NOT EXISTS todo_tags (
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    tag_id BIGINT NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    tenant_id BIGINT NOT NULL REFERENCES tenants (id)
+        DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+    PRIMARY KEY (todo_id, tag_id)
+);
+CREATE INDEX IF NOT EXISTS todo_tags_tag_id_idx ON todo_tags (tag_id, todo_id);
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['tags', 'todo_tags'] LOOP
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+        EXECUTE format('CREATE POLICY tenant_isolation ON %I
+            USING (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)
+            WITH CHECK (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)', t);
+    END LOOP;
+END
+$$;
@@ -9,12 +9,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,7 +26,30 @@ import (
 	_ "github.com/lib/pq"
 )
 
-var testDB *sql.DB
+// testDB connects as the test database user, which bypasses row-level security
+// (as a superuser); appDB connects as appRole, which doesn't, and is what the app uses.
+var testDB, appDB *sql.DB
+
+// appRole is the role the app runs as in the tests; like the production app user
+// it is subject to the tenant policies.
+const appRole = "todo_app_rls_test"
+
+// Users the tests act as; their ids are assigned in TestMain
+var (
+	testPrincipal  = &app.Principal{Subject: "test:integration", Method: "test"}
+	otherPrincipal = &app.Principal{Subject: "test:other", Method: "test"}
+	testListID     int64 // Personal list of testPrincipal
+)
+
+// authenticated returns r with testPrincipal as its user.
+func authenticated(r *http.Request) *http.Request {
+	return asUser(r, testPrincipal)
+}
+
+// asUser returns r with p as its user.
+func asUser(r *http.Request, p *app.Principal) *http.Request {
+	return r.WithContext(app.WithPrincipal(r.Context(), p))
+}
 
 // TestMain sets up and tears down the test database
 func TestMain(m *testing.M) {
@@ -75,28 +102,212 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	// Create test table
+	// Create test tables
 	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS tenants (
+			id BIGSERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS users (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id),
+			subject TEXT NOT NULL UNIQUE,
+			email TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
 		CREATE TABLE IF NOT EXISTS todos (
 			id SERIAL PRIMARY KEY,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id) DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
 			task TEXT NOT NULL,
-			completed BOOLEAN DEFAULT FALSE
-		)
+			completed BOOLEAN DEFAULT FALSE,
+			owner_id BIGINT REFERENCES users (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS lists (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id) DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+			name TEXT NOT NULL,
+			personal BOOLEAN NOT NULL DEFAULT FALSE,
+			created_by BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS lists_personal_idx ON lists (created_by) WHERE personal;
+		CREATE TABLE IF NOT EXISTS list_members (
+			list_id BIGINT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id) DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+			PRIMARY KEY (list_id, user_id)
+		);
+		CREATE TABLE IF NOT EXISTS list_invitations (
+			list_id BIGINT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id) DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+			email TEXT NOT NULL,
+			role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+			invited_by BIGINT REFERENCES users (id) ON DELETE SET NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (list_id, email)
+		);
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS list_id BIGINT REFERENCES lists (id) ON DELETE CASCADE;
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal'
+			CHECK (priority IN ('low', 'normal', 'high', 'urgent'));
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT '';
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		ALTER TABLE todos ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+		CREATE TABLE IF NOT EXISTS sessions (
+			id_hash BYTEA PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id BIGSERIAL PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id),
+			name TEXT NOT NULL,
+			scope TEXT NOT NULL CHECK (scope IN ('read', 'write')),
+			prefix TEXT NOT NULL,
+			token_hash BYTEA NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			last_used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ
+		);
+		DO $$
+		DECLARE
+			t TEXT;
+		BEGIN
+			FOREACH t IN ARRAY ARRAY['lists', 'list_members', 'list_invitations', 'todos'] LOOP
+				EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+				EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+				EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+				EXECUTE format('CREATE POLICY tenant_isolation ON %I
+					USING (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)
+					WITH CHECK (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)', t);
+			END LOOP;
+		END
+		$$;
+		CREATE TABLE IF NOT EXISTS tags (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id)
+				DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+			name TEXT NOT NULL,
+			UNIQUE (tenant_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS todo_tags (
+			todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+			tag_id BIGINT NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id)
+				DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+			PRIMARY KEY (todo_id, tag_id)
+		);
+		CREATE INDEX IF NOT EXISTS todo_tags_tag_id_idx ON todo_tags (tag_id, todo_id);
+		DO $$
+		DECLARE
+			t TEXT;
+		BEGIN
+			FOREACH t IN ARRAY ARRAY['tags', 'todo_tags'] LOOP
+				EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+				EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+				EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+				EXECUTE format('CREATE POLICY tenant_isolation ON %I
+					USING (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)
+					WITH CHECK (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::bigint)', t);
+			END LOOP;
+		END
+		$$;
+		CREATE TABLE IF NOT EXISTS todo_events (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id BIGINT NOT NULL REFERENCES tenants (id) DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint,
+			todo_id INTEGER NOT NULL,
+			list_id BIGINT NOT NULL,
+			action TEXT NOT NULL CHECK (action IN ('create', 'update', 'delete', 'restore', 'purge')),
+			actor_id BIGINT NOT NULL,
+			actor_method TEXT NOT NULL,
+			before JSONB,
+			after JSONB,
+			request_id TEXT,
+			trace_id TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE OR REPLACE FUNCTION todo_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'todo_events is append-only';
+		END
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS todo_events_append_only ON todo_events;
+		CREATE TRIGGER todo_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON todo_events
+			FOR EACH STATEMENT EXECUTE FUNCTION todo_events_append_only();
+		ALTER TABLE todo_events ENABLE ROW LEVEL SECURITY;
+		ALTER TABLE todo_events FORCE ROW LEVEL SECURITY;
+		DROP POLICY IF EXISTS tenant_read ON todo_events;
+		CREATE POLICY tenant_read ON todo_events FOR SELECT
+			USING (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::bigint);
+		DROP POLICY IF EXISTS tenant_append ON todo_events;
+		CREATE POLICY tenant_append ON todo_events FOR INSERT
+			WITH CHECK (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::bigint);
+		DO $$
+		BEGIN
+			CREATE ROLE ` + appRole + ` NOLOGIN;
+		EXCEPTION WHEN duplicate_object THEN NULL;
+		END
+		$$;
+		GRANT ` + appRole + ` TO CURRENT_USER;
+		GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO ` + appRole + `;
+		GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO ` + appRole + `
 	`)
 	if err != nil {
 		fmt.Printf("Failed to create test table: %v\n", err)
 		os.Exit(1)
 	}
 
+	// The app connects as the test user but switches to appRole for the session
+	appDB, err = sql.Open("postgres", connStr+"&options="+url.QueryEscape("-c role="+appRole))
+	if err != nil {
+		fmt.Printf("Failed to connect to test database: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Set global db variables for handlers
-	app.DB = testDB
-	app.DBRead = testDB
+	app.DB = appDB
+	app.DBRead = appDB
+
+	// Create the users the tests act as
+	for _, p := range []*app.Principal{testPrincipal, otherPrincipal} {
+		user, err := app.Users.Ensure(context.Background(), p.Subject, "")
+		if err != nil {
+			fmt.Printf("Failed to create test user: %v\n", err)
+			os.Exit(1)
+		}
+		p.UserID, p.TenantID = user.ID, user.TenantID
+	}
+	if testListID, err = app.PersonalListID(app.WithTenant(context.Background(), testPrincipal.TenantID), testPrincipal.UserID); err != nil {
+		fmt.Printf("Failed to create test list: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Run tests
 	code := m.Run()
 
 	// Cleanup
+	testDB.Exec("DROP TABLE IF EXISTS todo_events")
+	testDB.Exec("DROP FUNCTION IF EXISTS todo_events_append_only")
+	testDB.Exec("DROP TABLE IF EXISTS todo_tags")
+	testDB.Exec("DROP TABLE IF EXISTS tags")
 	testDB.Exec("DROP TABLE IF EXISTS todos")
+	testDB.Exec("DROP TABLE IF EXISTS list_invitations")
+	testDB.Exec("DROP TABLE IF EXISTS list_members")
+	testDB.Exec("DROP TABLE IF EXISTS lists")
+	testDB.Exec("DROP TABLE IF EXISTS sessions")
+	testDB.Exec("DROP TABLE IF EXISTS api_tokens")
+	testDB.Exec("DROP TABLE IF EXISTS users")
+	testDB.Exec("DROP TABLE IF EXISTS tenants")
+	testDB.Exec("DROP ROLE IF EXISTS " + appRole)
+	appDB.Close()
 	testDB.Close()
 
 	os.Exit(code)
@@ -114,7 +325,7 @@ func cleanupTodos(t *testing.T) {
 func TestIntegrationGetTodosEmpty(t *testing.T) {
 	cleanupTodos(t)
 
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w := httptest.NewRecorder()
 
 	app.GetTodos(w, req)
@@ -142,7 +353,7 @@ func TestIntegrationAddTodo(t *testing.T) {
 	}
 
 	body, _ := json.Marshal(newTodo)
-	req := httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body))
+	req := authenticated(httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body)))
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
@@ -175,16 +386,16 @@ func TestIntegrationGetTodosWithData(t *testing.T) {
 	cleanupTodos(t)
 
 	// Insert test data
-	_, err := testDB.Exec("INSERT INTO todos (task, completed) VALUES ($1, $2)", "Test task 1", false)
+	_, err := testDB.Exec("INSERT INTO todos (task, completed, owner_id, list_id, tenant_id) VALUES ($1, $2, $3, $4, $5)", "Test task 1", false, testPrincipal.UserID, testListID, testPrincipal.TenantID)
 	if err != nil {
 		t.Fatalf("failed to insert test data: %v", err)
 	}
-	_, err = testDB.Exec("INSERT INTO todos (task, completed) VALUES ($1, $2)", "Test task 2", true)
+	_, err = testDB.Exec("INSERT INTO todos (task, completed, owner_id, list_id, tenant_id) VALUES ($1, $2, $3, $4, $5)", "Test task 2", true, testPrincipal.UserID, testListID, testPrincipal.TenantID)
 	if err != nil {
 		t.Fatalf("failed to insert test data: %v", err)
 	}
 
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w := httptest.NewRecorder()
 
 	app.GetTodos(w, req)
@@ -217,8 +428,8 @@ func TestIntegrationUpdateTodo(t *testing.T) {
 
 	// Insert test data
 	var id int
-	err := testDB.QueryRow("INSERT INTO todos (task, completed) VALUES ($1, $2) RETURNING id",
-		"Test task", false).Scan(&id)
+	err := testDB.QueryRow("INSERT INTO todos (task, completed, owner_id, list_id, tenant_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		"Test task", false, testPrincipal.UserID, testListID, testPrincipal.TenantID).Scan(&id)
 	if err != nil {
 		t.Fatalf("failed to insert test data: %v", err)
 	}
@@ -226,7 +437,7 @@ func TestIntegrationUpdateTodo(t *testing.T) {
 	// Update the todo
 	update := app.Todo{Completed: true}
 	body, _ := json.Marshal(update)
-	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", id), bytes.NewBuffer(body))
+	req := authenticated(httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", id), bytes.NewBuffer(body)))
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
@@ -254,14 +465,14 @@ func TestIntegrationDeleteTodo(t *testing.T) {
 
 	// Insert test data
 	var id int
-	err := testDB.QueryRow("INSERT INTO todos (task, completed) VALUES ($1, $2) RETURNING id",
-		"Test task", false).Scan(&id)
+	err := testDB.QueryRow("INSERT INTO todos (task, completed, owner_id, list_id, tenant_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		"Test task", false, testPrincipal.UserID, testListID, testPrincipal.TenantID).Scan(&id)
 	if err != nil {
 		t.Fatalf("failed to insert test data: %v", err)
 	}
 
 	// Delete the todo
-	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", id), nil)
+	req := authenticated(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", id), nil))
 	w := httptest.NewRecorder()
 
 	app.DeleteTodo(w, req, id)
@@ -270,15 +481,15 @@ func TestIntegrationDeleteTodo(t *testing.T) {
 		t.Errorf("expected status %d, got %d", http.StatusNoContent, w.Code)
 	}
 
-	// Verify the deletion
+	// Verify the todo was moved to the trash
 	var count int
-	err = testDB.QueryRow("SELECT COUNT(*) FROM todos WHERE id = $1", id).Scan(&count)
+	err = testDB.QueryRow("SELECT COUNT(*) FROM todos WHERE id = $1 AND deleted_at IS NOT NULL", id).Scan(&count)
 	if err != nil {
 		t.Fatalf("failed to query deleted todo: %v", err)
 	}
 
-	if count != 0 {
-		t.Error("expected todo to be deleted")
+	if count != 1 {
+		t.Error("expected todo to be in the trash")
 	}
 }
 
@@ -287,7 +498,7 @@ func TestIntegrationFullWorkflow(t *testing.T) {
 	cleanupTodos(t)
 
 	// 1. Start with empty list
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w := httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -300,7 +511,7 @@ func TestIntegrationFullWorkflow(t *testing.T) {
 	// 2. Add a todo
 	newTodo := app.Todo{Task: "Buy groceries"}
 	body, _ := json.Marshal(newTodo)
-	req = httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body))
+	req = authenticated(httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBuffer(body)))
 	req.Header.Set("Content-Type", "application/json")
 	w = httptest.NewRecorder()
 	app.AddTodo(w, req)
@@ -310,7 +521,7 @@ func TestIntegrationFullWorkflow(t *testing.T) {
 	todoID := created.ID
 
 	// 3. Verify it appears in the list
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req = authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w = httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -322,13 +533,13 @@ func TestIntegrationFullWorkflow(t *testing.T) {
 	// 4. Mark it as completed
 	update := app.Todo{Completed: true}
 	body, _ = json.Marshal(update)
-	req = httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", todoID), bytes.NewBuffer(body))
+	req = authenticated(httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", todoID), bytes.NewBuffer(body)))
 	req.Header.Set("Content-Type", "application/json")
 	w = httptest.NewRecorder()
 	app.UpdateTodo(w, req, todoID)
 
 	// 5. Verify it's completed
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req = authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w = httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -338,12 +549,12 @@ func TestIntegrationFullWorkflow(t *testing.T) {
 	}
 
 	// 6. Delete it
-	req = httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", todoID), nil)
+	req = authenticated(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", todoID), nil))
 	w = httptest.NewRecorder()
 	app.DeleteTodo(w, req, todoID)
 
 	// 7. Verify it's gone
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req = authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w = httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -368,3 +579,623 @@ func TestIntegrationHealthCheck(t *testing.T) {
 		t.Errorf("expected body 'OK', got %q", w.Body.String())
 	}
 }
+
+// TestIntegrationOtherUsersTodos tests that users can't see or change each other's todos
+func TestIntegrationOtherUsersTodos(t *testing.T) {
+	cleanupTodos(t)
+
+	var id int
+	err := testDB.QueryRow("INSERT INTO todos (task, completed, owner_id, list_id, tenant_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		"Private task", false, testPrincipal.UserID, testListID, testPrincipal.TenantID).Scan(&id)
+	if err != nil {
+		t.Fatalf("failed to insert test data: %v", err)
+	}
+
+	req := asUser(httptest.NewRequest(http.MethodGet, "/todos", nil), otherPrincipal)
+	w := httptest.NewRecorder()
+	app.GetTodos(w, req)
+
+	var todos []app.Todo
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 0 {
+		t.Errorf("expected other user to see no todos, got %v", todos)
+	}
+
+	body, _ := json.Marshal(app.Todo{Completed: true})
+	req = asUser(httptest.NewRequest(http.MethodPut, fmt.Sprintf("/todos/%d", id), bytes.NewBuffer(body)), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.UpdateTodo(w, req, id)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d updating another user's todo, got %d", http.StatusNotFound, w.Code)
+	}
+
+	req = asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", id), nil), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, req, id)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d deleting another user's todo, got %d", http.StatusNotFound, w.Code)
+	}
+
+	var completed bool
+	if err := testDB.QueryRow("SELECT completed FROM todos WHERE id = $1", id).Scan(&completed); err != nil || completed {
+		t.Errorf("expected the todo to be unchanged, got completed=%v, err=%v", completed, err)
+	}
+}
+
+// TestIntegrationDBSessionStore tests storing, reading and deleting sessions
+func TestIntegrationDBSessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := app.DBSessionStore{}
+	now := time.Now()
+
+	session := &app.Session{ID: "integration-session", UserID: testPrincipal.UserID, TenantID: testPrincipal.TenantID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := store.Create(ctx, session); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	expired := &app.Session{ID: "expired-session", UserID: testPrincipal.UserID, TenantID: testPrincipal.TenantID, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	if err := store.Create(ctx, expired); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	got, err := store.Get(ctx, session.ID)
+	if err != nil || got == nil {
+		t.Fatalf("expected the session, got %v, err=%v", got, err)
+	}
+	if got.UserID != testPrincipal.UserID || got.TenantID != testPrincipal.TenantID || got.Subject != testPrincipal.Subject {
+		t.Errorf("expected the session of %s, got user %d (%s)", testPrincipal.Subject, got.UserID, got.Subject)
+	}
+	if got, err := store.Get(ctx, expired.ID); err != nil || got != nil {
+		t.Errorf("expected no expired session, got %v, err=%v", got, err)
+	}
+
+	if err := store.Delete(ctx, session.ID); err != nil {
+		t.Fatalf("failed to delete session: %v", err)
+	}
+	if got, err := store.Get(ctx, session.ID); err != nil || got != nil {
+		t.Errorf("expected no session after delete, got %v, err=%v", got, err)
+	}
+}
+
+// TestIntegrationAPITokens tests creating, using and revoking a personal API token
+func TestIntegrationAPITokens(t *testing.T) {
+	cleanupTodos(t)
+	authenticate := app.TokenAuthenticator()
+	bearer := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	req := authenticated(httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"name": "script", "scope": "read"}`)))
+	w := httptest.NewRecorder()
+	app.HandleTokens(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created app.APIToken
+	json.NewDecoder(w.Body).Decode(&created)
+
+	p, err := authenticate(bearer(created.Token))
+	if err != nil || p == nil || p.UserID != testPrincipal.UserID || p.CanWrite() {
+		t.Fatalf("expected a read-only principal for %s, got %+v, err=%v", testPrincipal.Subject, p, err)
+	}
+	if err := app.FlushTokenUses(context.Background()); err != nil {
+		t.Fatalf("failed to flush token uses: %v", err)
+	}
+	var lastUsed sql.NullTime
+	testDB.QueryRow("SELECT last_used_at FROM api_tokens WHERE id = $1", created.ID).Scan(&lastUsed)
+	if !lastUsed.Valid {
+		t.Error("expected last_used_at to be recorded")
+	}
+
+	// Another user can't revoke the token
+	req = asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/tokens/%d", created.ID), nil), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.HandleToken(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d revoking another user's token, got %d", http.StatusNotFound, w.Code)
+	}
+
+	req = authenticated(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/tokens/%d", created.ID), nil))
+	w = httptest.NewRecorder()
+	app.HandleToken(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if _, err := authenticate(bearer(created.Token)); !errors.Is(err, app.ErrUnauthenticated) {
+		t.Errorf("expected a revoked token to be rejected, got %v", err)
+	}
+}
+
+// TestIntegrationSharedList tests that list roles control what members can do
+func TestIntegrationSharedList(t *testing.T) {
+	cleanupTodos(t)
+	ctx := app.WithTenant(context.Background(), testPrincipal.TenantID)
+
+	list, err := app.CreateList(ctx, testPrincipal.UserID, "Release")
+	if err != nil {
+		t.Fatalf("failed to create list: %v", err)
+	}
+	defer testDB.Exec("DELETE FROM lists WHERE id = $1", list.ID)
+
+	req := authenticated(httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(fmt.Sprintf(`{"task": "Cut release", "list_id": %d}`, list.ID))))
+	w := httptest.NewRecorder()
+	app.AddTodo(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var todo app.Todo
+	json.NewDecoder(w.Body).Decode(&todo)
+
+	// Not a member yet
+	req = asUser(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos?list=%d", list.ID), nil), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.GetTodos(w, req)
+	var todos []app.Todo
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 0 {
+		t.Errorf("expected no todos before joining, got %d", len(todos))
+	}
+
+	// Viewers can read but not change
+	if err := app.SetMember(ctx, testPrincipal.UserID, list.ID, otherPrincipal.UserID, app.RoleViewer); err != nil {
+		t.Fatalf("failed to add member: %v", err)
+	}
+	req = asUser(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos?list=%d", list.ID), nil), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.GetTodos(w, req)
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 1 || todos[0].ID != todo.ID {
+		t.Errorf("expected the shared todo, got %v", todos)
+	}
+	req = asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), nil), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, req, todo.ID)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d deleting as a viewer, got %d", http.StatusForbidden, w.Code)
+	}
+	if err := app.SetMember(ctx, otherPrincipal.UserID, list.ID, otherPrincipal.UserID, app.RoleOwner); !errors.Is(err, app.ErrForbidden) {
+		t.Errorf("expected a viewer to be unable to promote themselves, got %v", err)
+	}
+
+	// Editors can change todos
+	if err := app.SetMember(ctx, testPrincipal.UserID, list.ID, otherPrincipal.UserID, app.RoleEditor); err != nil {
+		t.Fatalf("failed to change role: %v", err)
+	}
+	req = asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), nil), otherPrincipal)
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, req, todo.ID)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d deleting as an editor, got %d", http.StatusNoContent, w.Code)
+	}
+
+	// The only owner can't leave
+	if err := app.RemoveMember(ctx, testPrincipal.UserID, list.ID, testPrincipal.UserID); err == nil {
+		t.Error("expected the last owner to be unable to leave")
+	}
+}
+
+// countAsTenant counts the rows of table the app role sees with app.tenant_id
+// set to tenant, or with no tenant if it is 0.
+func countAsTenant(t *testing.T, table string, tenant int64) int {
+	t.Helper()
+	tx, err := appDB.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	if tenant != 0 {
+		if _, err := tx.Exec("SELECT set_config('app.tenant_id', $1, true)", fmt.Sprint(tenant)); err != nil {
+			t.Fatalf("failed to set the tenant: %v", err)
+		}
+	}
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("failed to count %s: %v", table, err)
+	}
+	return n
+}
+
+// TestIntegrationTenantIsolation tests that row-level security keeps tenants apart
+func TestIntegrationTenantIsolation(t *testing.T) {
+	cleanupTodos(t)
+	originalDomains := app.TenantDomains
+	app.TenantDomains = map[string]string{"tenant-b.test": "integration-b"}
+	defer func() { app.TenantDomains = originalDomains }()
+
+	user, err := app.Users.Ensure(context.Background(), "test:tenant-b", "bob@tenant-b.test")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if user.TenantID == testPrincipal.TenantID {
+		t.Fatalf("expected the user to be in another tenant, got %d", user.TenantID)
+	}
+	bob := &app.Principal{UserID: user.ID, TenantID: user.TenantID, Subject: "test:tenant-b", Method: "test"}
+
+	req := authenticated(httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "Tenant A task"}`)))
+	w := httptest.NewRecorder()
+	app.AddTodo(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var todo app.Todo
+	json.NewDecoder(w.Body).Decode(&todo)
+
+	// The policies hide other tenants' rows even from queries without filters
+	// (tenant B has no rows of its own yet)
+	for _, table := range []string{"todos", "lists", "list_members"} {
+		if n := countAsTenant(t, table, testPrincipal.TenantID); n == 0 {
+			t.Errorf("expected tenant A to see its %s", table)
+		}
+		if n := countAsTenant(t, table, bob.TenantID); n != 0 {
+			t.Errorf("expected tenant B to see no %s of tenant A, got %d", table, n)
+		}
+		if n := countAsTenant(t, table, 0); n != 0 {
+			t.Errorf("expected no %s without a tenant, got %d", table, n)
+		}
+	}
+
+	// Rows can't be written into another tenant
+	tx, err := appDB.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
+	}
+	tx.Exec("SELECT set_config('app.tenant_id', $1, true)", fmt.Sprint(bob.TenantID))
+	if _, err := tx.Exec("INSERT INTO todos (task, list_id, tenant_id) VALUES ('Planted', $1, $2)", testListID, testPrincipal.TenantID); err == nil {
+		t.Error("expected inserting a row for another tenant to fail")
+	}
+	tx.Rollback()
+
+	// Through the app, tenant B can neither read nor change tenant A's todos
+	req = asUser(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/todos?list=%d", testListID), nil), bob)
+	w = httptest.NewRecorder()
+	app.GetTodos(w, req)
+	var todos []app.Todo
+	json.NewDecoder(w.Body).Decode(&todos)
+	if w.Code != http.StatusOK || len(todos) != 0 {
+		t.Errorf("expected no todos of another tenant, got %d: %v", w.Code, todos)
+	}
+	req = asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/todos/%d", todo.ID), nil), bob)
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, req, todo.ID)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d deleting another tenant's todo, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Users of another tenant can't be added to a list, and invitations don't cross tenants
+	ctxA := app.WithTenant(context.Background(), testPrincipal.TenantID)
+	list, err := app.CreateList(ctxA, testPrincipal.UserID, "Tenant A only")
+	if err != nil {
+		t.Fatalf("failed to create list: %v", err)
+	}
+	defer testDB.Exec("DELETE FROM lists WHERE id = $1", list.ID)
+	if err := app.SetMember(ctxA, testPrincipal.UserID, list.ID, bob.UserID, app.RoleViewer); err == nil {
+		t.Error("expected adding a user of another tenant to fail")
+	}
+	if added, err := app.InviteMember(ctxA, testPrincipal.UserID, list.ID, "bob@tenant-b.test", app.RoleViewer); err != nil || added {
+		t.Errorf("expected an invitation rather than a membership, got added=%v, err=%v", added, err)
+	}
+	if err := app.ClaimInvitations(app.WithTenant(context.Background(), bob.TenantID), bob.UserID, "bob@tenant-b.test"); err != nil {
+		t.Fatalf("failed to claim invitations: %v", err)
+	}
+	if lists, err := app.UserLists(app.WithTenant(context.Background(), bob.TenantID), bob.UserID); err != nil || len(lists) != 0 {
+		t.Errorf("expected no lists of another tenant, got %v, err=%v", lists, err)
+	}
+
+	// The store refuses to run without a tenant
+	if _, err := app.UserLists(context.Background(), testPrincipal.UserID); !errors.Is(err, app.ErrNoTenant) {
+		t.Errorf("expected ErrNoTenant, got %v", err)
+	}
+}
+
+// TestIntegrationTodoHistory tests that every change of a todo is in its history
+func TestIntegrationTodoHistory(t *testing.T) {
+	cleanupTodos(t)
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		r.Header.Set(app.RequestIDHeader, "history-test-request")
+		w := httptest.NewRecorder()
+		app.RequestIDMiddleware(http.HandlerFunc(app.HandleTodo)).ServeHTTP(w, r)
+		return w
+	}
+
+	req := authenticated(httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "Audited task"}`)))
+	w := httptest.NewRecorder()
+	app.AddTodo(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var todo app.Todo
+	json.NewDecoder(w.Body).Decode(&todo)
+	path := fmt.Sprintf("/todos/%d", todo.ID)
+	if w := serve(authenticated(httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{"completed": true}`)))); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d updating, got %d", http.StatusOK, w.Code)
+	}
+	if w := serve(authenticated(httptest.NewRequest(http.MethodDelete, path, nil))); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d deleting, got %d", http.StatusNoContent, w.Code)
+	}
+
+	// The history outlives the todo
+	w = serve(authenticated(httptest.NewRequest(http.MethodGet, path+"/history", nil)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var events []app.TodoEvent
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	actions := []string{app.TodoEventCreate, app.TodoEventUpdate, app.TodoEventDelete}
+	if len(events) != len(actions) {
+		t.Fatalf("expected %d events, got %+v", len(actions), events)
+	}
+	for i, e := range events {
+		if e.Action != actions[i] || e.ActorID != testPrincipal.UserID || e.TodoID != todo.ID {
+			t.Errorf("event %d: expected %s by user %d, got %+v", i, actions[i], testPrincipal.UserID, e)
+		}
+	}
+	var before, after app.Todo
+	json.Unmarshal(events[1].Before, &before)
+	json.Unmarshal(events[1].After, &after)
+	if before.Completed || !after.Completed || before.Task != "Audited task" {
+		t.Errorf("expected the update to record completed false -> true, got %s -> %s", events[1].Before, events[1].After)
+	}
+	var trashed app.Todo
+	json.Unmarshal(events[2].After, &trashed)
+	if events[0].Before != nil || trashed.DeletedAt == nil {
+		t.Errorf("expected no state before the create and a trashed todo after the delete, got %+v", events)
+	}
+	if events[1].RequestID != "history-test-request" {
+		t.Errorf("expected the request id to be recorded, got %q", events[1].RequestID)
+	}
+
+	// Only members of the todo's list can read its history
+	if w := serve(asUser(httptest.NewRequest(http.MethodGet, path+"/history", nil), otherPrincipal)); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for a non-member, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Events can't be changed, not even by a superuser
+	if _, err := testDB.Exec("UPDATE todo_events SET action = 'create' WHERE todo_id = $1", todo.ID); err == nil {
+		t.Error("expected updating an event to fail")
+	}
+	if _, err := testDB.Exec("DELETE FROM todo_events WHERE todo_id = $1", todo.ID); err == nil {
+		t.Error("expected deleting an event to fail")
+	}
+}
+
+// TestIntegrationTrash tests that deleted todos can be restored until they are purged
+func TestIntegrationTrash(t *testing.T) {
+	cleanupTodos(t)
+	serve := func(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, authenticated(r))
+		return w
+	}
+	list := func(h http.HandlerFunc, target string) []app.Todo {
+		t.Helper()
+		w := serve(h, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected status %d, got %d: %s", target, http.StatusOK, w.Code, w.Body.String())
+		}
+		var todos []app.Todo
+		json.NewDecoder(w.Body).Decode(&todos)
+		return todos
+	}
+
+	w := serve(app.AddTodo, httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "Trashed task"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var todo app.Todo
+	json.NewDecoder(w.Body).Decode(&todo)
+	path := fmt.Sprintf("/todos/%d", todo.ID)
+	if w := serve(app.HandleTodo, httptest.NewRequest(http.MethodDelete, path, nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d deleting, got %d", http.StatusNoContent, w.Code)
+	}
+
+	if todos := list(app.GetTodos, "/todos"); len(todos) != 0 {
+		t.Errorf("expected trashed todos to be hidden, got %+v", todos)
+	}
+	if todos := list(app.GetTodos, "/todos?trash=include"); len(todos) != 1 || todos[0].DeletedAt == nil {
+		t.Errorf("expected the trashed todo with trash=include, got %+v", todos)
+	}
+	if todos := list(app.GetTrash, "/trash"); len(todos) != 1 || todos[0].ID != todo.ID {
+		t.Errorf("expected the todo in the trash, got %+v", todos)
+	}
+	// Trashed todos can't be changed or deleted again
+	if w := serve(app.HandleTodo, httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{"completed": true}`))); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d updating a trashed todo, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := serve(app.HandleTodo, httptest.NewRequest(http.MethodPost, path+"/restore", nil)); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d restoring, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if todos := list(app.GetTodos, "/todos"); len(todos) != 1 || todos[0].DeletedAt != nil {
+		t.Errorf("expected the restored todo, got %+v", todos)
+	}
+	if w := serve(app.HandleTodo, httptest.NewRequest(http.MethodPost, path+"/restore", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d restoring a todo that isn't trashed, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Only todos trashed for longer than the retention are purged
+	serve(app.HandleTodo, httptest.NewRequest(http.MethodDelete, path, nil))
+	if n, err := app.PurgeTrash(context.Background(), time.Hour); err != nil || n != 0 {
+		t.Fatalf("expected nothing to purge, got %d, %v", n, err)
+	}
+	if n, err := app.PurgeTrash(context.Background(), 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 purged todo, got %d, %v", n, err)
+	}
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM todos WHERE id = $1", todo.ID).Scan(&count)
+	if count != 0 {
+		t.Error("expected the todo to be purged")
+	}
+
+	events, err := app.TodoHistory(app.WithPrincipal(context.Background(), testPrincipal), testPrincipal.UserID, todo.ID)
+	if err != nil {
+		t.Fatalf("failed to read history: %v", err)
+	}
+	actions := []string{app.TodoEventCreate, app.TodoEventDelete, app.TodoEventRestore, app.TodoEventDelete, app.TodoEventPurge}
+	if len(events) != len(actions) {
+		t.Fatalf("expected %d events, got %+v", len(actions), events)
+	}
+	for i, e := range events {
+		if e.Action != actions[i] {
+			t.Errorf("event %d: expected %s, got %s", i, actions[i], e.Action)
+		}
+	}
+	if purge := events[4]; purge.ActorID != 0 || purge.ActorMethod != "purge" {
+		t.Errorf("expected the purge to be recorded without an actor, got %+v", purge)
+	}
+}
+
+// TestIntegrationPlanningFields tests that due dates, priorities and notes round-trip and can be filtered and sorted on
+func TestIntegrationPlanningFields(t *testing.T) {
+	cleanupTodos(t)
+	serve := func(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, authenticated(httptest.NewRequest(method, target, strings.NewReader(body))))
+		return w
+	}
+	add := func(body string) app.Todo {
+		t.Helper()
+		w := serve(app.AddTodo, http.MethodPost, "/todos", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var todo app.Todo
+		json.NewDecoder(w.Body).Decode(&todo)
+		return todo
+	}
+
+	soon := add(`{"task": "Soon", "due_at": "2026-02-01T09:00:00Z", "priority": "urgent", "notes": "- [ ] check **dashboards**"}`)
+	later := add(`{"task": "Later", "due_at": "2026-03-01T09:00:00Z", "priority": "low"}`)
+	add(`{"task": "Whenever"}`)
+	if soon.Priority != app.TodoPriorityUrgent || soon.Notes != "- [ ] check **dashboards**" || soon.CreatedAt.IsZero() || soon.CompletedAt != nil {
+		t.Errorf("expected the planning fields to round-trip, got %+v", soon)
+	}
+
+	// Completing sets completed_at; other fields are kept unless sent
+	w := serve(app.HandleTodo, http.MethodPut, fmt.Sprintf("/todos/%d", later.ID), `{"completed": true, "due_at": null}`)
+	var updated app.Todo
+	json.NewDecoder(w.Body).Decode(&updated)
+	if w.Code != http.StatusOK || updated.CompletedAt == nil || updated.DueAt != nil || updated.Priority != app.TodoPriorityLow ||
+		updated.Task != "Later" || !updated.UpdatedAt.After(later.UpdatedAt) {
+		t.Errorf("expected the todo to be completed with no due date, got %d: %+v", w.Code, updated)
+	}
+	if w := serve(app.HandleTodo, http.MethodPut, fmt.Sprintf("/todos/%d", later.ID), `{"priority": "someday"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid priority, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	list := func(query string) string {
+		t.Helper()
+		w := serve(app.GetTodos, http.MethodGet, "/todos?"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d for %s, got %d: %s", http.StatusOK, query, w.Code, w.Body.String())
+		}
+		var todos []app.Todo
+		json.NewDecoder(w.Body).Decode(&todos)
+		var tasks []string
+		for _, todo := range todos {
+			tasks = append(tasks, todo.Task)
+		}
+		return strings.Join(tasks, ",")
+	}
+	for query, expected := range map[string]string{
+		"sort=-priority":                    "Soon,Whenever,Later",
+		"sort=due_at":                       "Soon,Later,Whenever", // No due date last, then by id
+		"completed=false&sort=created_at":   "Soon,Whenever",
+		"priority=low,urgent":               "Soon,Later",
+		"due_before=2026-02-15T00:00:00Z":   "Soon",
+		"due_after=2026-02-15T00:00:00Z":    "",
+		"completed=true&sort=-completed_at": "Later",
+	} {
+		if tasks := list(query); tasks != expected {
+			t.Errorf("%s: expected %q, got %q", query, expected, tasks)
+		}
+	}
+}
+
+// TestIntegrationTags tests tagging todos, filtering by tags and counting them against the real database
+func TestIntegrationTags(t *testing.T) {
+	cleanupTodos(t)
+	serve := func(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, authenticated(httptest.NewRequest(method, target, strings.NewReader(body))))
+		return w
+	}
+	add := func(body string) app.Todo {
+		t.Helper()
+		w := serve(app.AddTodo, http.MethodPost, "/todos", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var todo app.Todo
+		json.NewDecoder(w.Body).Decode(&todo)
+		return todo
+	}
+
+	page := add(`{"task": "Page", "tags": ["OnCall", "infra", "oncall"]}`)
+	deploy := add(`{"task": "Deploy", "tags": ["release"]}`)
+	add(`{"task": "Untagged"}`)
+	if strings.Join(page.Tags, ",") != "infra,oncall" {
+		t.Errorf("expected the tags to be normalized, got %v", page.Tags)
+	}
+
+	w := serve(app.HandleTodo, http.MethodPost, fmt.Sprintf("/todos/%d/tags", deploy.ID), `{"tag": "oncall"}`)
+	var tagged app.Todo
+	json.NewDecoder(w.Body).Decode(&tagged)
+	if w.Code != http.StatusOK || strings.Join(tagged.Tags, ",") != "oncall,release" || !tagged.UpdatedAt.After(deploy.UpdatedAt) {
+		t.Errorf("expected the todo to be tagged, got %d: %+v", w.Code, tagged)
+	}
+	w = serve(app.HandleTodo, http.MethodDelete, fmt.Sprintf("/todos/%d/tags/infra", page.ID), "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "infra") {
+		t.Errorf("expected the tag to be removed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Tag changes are recorded as updates; updating other fields keeps the tags
+	var updates int
+	err := testDB.QueryRow("SELECT count(*) FROM todo_events WHERE todo_id = $1 AND action = 'update'", deploy.ID).Scan(&updates)
+	if err != nil || updates != 1 {
+		t.Errorf("expected 1 update event, got %d, %v", updates, err)
+	}
+	w = serve(app.HandleTodo, http.MethodPut, fmt.Sprintf("/todos/%d", deploy.ID), `{"completed": true, "tags": []}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tags":["oncall","release"]`) {
+		t.Errorf("expected the update to keep the tags, got %d: %s", w.Code, w.Body.String())
+	}
+
+	list := func(query string) string {
+		t.Helper()
+		w := serve(app.GetTodos, http.MethodGet, "/todos?"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d for %s, got %d: %s", http.StatusOK, query, w.Code, w.Body.String())
+		}
+		var todos []app.Todo
+		json.NewDecoder(w.Body).Decode(&todos)
+		var tasks []string
+		for _, todo := range todos {
+			tasks = append(tasks, todo.Task)
+		}
+		return strings.Join(tasks, ",")
+	}
+	for query, expected := range map[string]string{
+		"tag=oncall":                 "Page,Deploy",
+		"tag=ONCALL&tag=release":     "Deploy",
+		"tag=infra,release":          "Deploy",
+		"tag=oncall&completed=false": "Page",
+		"tag=unknown":                "",
+	} {
+		if tasks := list(query); tasks != expected {
+			t.Errorf("%s: expected %q, got %q", query, expected, tasks)
+		}
+	}
+
+	// Trashed todos aren't counted
+	if w := serve(app.HandleTodo, http.MethodDelete, fmt.Sprintf("/todos/%d", page.ID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	w = serve(app.HandleTags, http.MethodGet, "/tags", "")
+	var counts []app.TagCount
+	json.NewDecoder(w.Body).Decode(&counts)
+	if w.Code != http.StatusOK || fmt.Sprint(counts) != "[{oncall 1} {release 1}]" {
+		t.Errorf("expected the tag counts, got %d: %v", w.Code, counts)
+	}
+}
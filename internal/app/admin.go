@@ -0,0 +1,249 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The admin server exposes operational endpoints on a separate listener so they
+// are never reachable through the public ingress. It has no authentication and
+// can change the service (faults, read-only mode, log level), so it listens on
+// localhost; operators reach it with kubectl port-forward. The metrics collector
+// scrapes the metrics server instead, which serves /metrics only.
+//
+//	/metrics              Prometheus metrics
+//	/debug/pprof/         Go runtime profiles
+//	/debug/buildinfo      App version plus Go version, module and VCS information
+//	/debug/config         Current configuration with secrets redacted
+//	/debug/breakers       Circuit breaker states and counts
+//	/debug/loglevel       GET current level, PUT/POST ?level=debug|info|warn|error to change it
+//	/debug/replicas       Read replica health, latency and ejection state
+//	/debug/readonly       GET read-only state, PUT/POST ?enabled=true|false&reason=... to toggle it
+//	/debug/faults         Fault injection rules (only when FAULT_INJECTION_ENABLED=true)
+//	/slo                  In-process SLI, burn rate and error budget summary
+
+// LogLevel is the level of the global slog handler. It is a LevelVar so that
+// the level can be changed at runtime through the admin server.
+var LogLevel = new(slog.LevelVar)
+
+var (
+	configMu   sync.RWMutex
+	configDump = map[string]any{}
+)
+
+// RegisterConfig makes a configuration value visible on /debug/config under name.
+// Values are redacted when rendered, see RedactConfig.
+func RegisterConfig(name string, v any) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	configDump[name] = v
+}
+
+// sensitiveKeys are substrings of JSON keys whose values must never be rendered.
+var sensitiveKeys = []string{"password", "secret", "token", "key", "credential"}
+
+const redacted = "[REDACTED]"
+
+// RedactConfig returns a JSON-compatible copy of v in which every field whose
+// JSON name looks sensitive (password, secret, token, key, credential) is
+// replaced by "[REDACTED]".
+func RedactConfig(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return redactValue(generic), nil
+}
+
+func redactValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, inner := range val {
+			if isSensitiveKey(k) {
+				if s, ok := inner.(string); ok && s == "" {
+					continue // Nothing to hide; keep empty values visible for debugging
+				}
+				val[k] = redacted
+				continue
+			}
+			val[k] = redactValue(inner)
+		}
+		return val
+	case []any:
+		for i := range val {
+			val[i] = redactValue(val[i])
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAdminHandler returns the handler for the admin/debug listener.
+func NewAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/buildinfo", BuildInfoHandler)
+	mux.HandleFunc("/debug/config", ConfigDumpHandler)
+	mux.HandleFunc("/debug/breakers", BreakersHandler)
+	mux.HandleFunc("/debug/loglevel", LogLevelHandler)
+	mux.HandleFunc("/debug/replicas", ReplicasHandler)
+	mux.HandleFunc("/debug/readonly", ReadOnlyHandler)
+	mux.HandleFunc("/debug/faults", FaultsHandler)
+	mux.HandleFunc("/slo", SLOHandler)
+	return mux
+}
+
+// NewMetricsHandler returns the handler for the metrics listener, which is
+// reachable from outside the pod and serves nothing but /metrics.
+func NewMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// BuildInfoHandler reports the Go runtime and module build information.
+func BuildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{
+		"go_version": runtime.Version(),
+		"goos":       runtime.GOOS,
+		"goarch":     runtime.GOARCH,
+		"app":        GetBuildInfo(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		resp["path"] = bi.Path
+		resp["main"] = bi.Main
+		settings := map[string]string{}
+		for _, s := range bi.Settings {
+			settings[s.Key] = s.Value
+		}
+		resp["settings"] = settings
+	}
+	writeAdminJSON(w, resp)
+}
+
+// ConfigDumpHandler renders all registered configuration with secrets redacted.
+func ConfigDumpHandler(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	resp := make(map[string]any, len(configDump))
+	for name, v := range configDump {
+		red, err := RedactConfig(v)
+		if err != nil {
+			http.Error(w, "Failed to render config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp[name] = red
+	}
+	writeAdminJSON(w, resp)
+}
+
+// BreakerStatus is the JSON view of a circuit breaker.
+type BreakerStatus struct {
+	Name                 string `json:"name"`
+	State                string `json:"state"`
+	Requests             uint32 `json:"requests"`
+	TotalSuccesses       uint32 `json:"total_successes"`
+	TotalFailures        uint32 `json:"total_failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutive_successes"`
+	ConsecutiveFailures  uint32 `json:"consecutive_failures"`
+}
+
+// BreakerStatuses returns the current state of the application's circuit breakers.
+func BreakerStatuses() []BreakerStatus {
+	var statuses []BreakerStatus
+	if CB != nil {
+		c := CB.Counts()
+		statuses = append(statuses, BreakerStatus{
+			Name:                 CB.Name(),
+			State:                CB.State().String(),
+			Requests:             c.Requests,
+			TotalSuccesses:       c.TotalSuccesses,
+			TotalFailures:        c.TotalFailures,
+			ConsecutiveSuccesses: c.ConsecutiveSuccesses,
+			ConsecutiveFailures:  c.ConsecutiveFailures,
+		})
+	}
+	return statuses
+}
+
+// BreakersHandler reports circuit breaker states.
+func BreakersHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, BreakerStatuses())
+}
+
+// LogLevelHandler reads or changes LogLevel.
+// The new level is taken from the "level" query parameter or a JSON body {"level": "..."}.
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level := r.URL.Query().Get("level")
+		if level == "" {
+			var body struct {
+				Level string `json:"level"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Missing level", http.StatusBadRequest)
+				return
+			}
+			level = body.Level
+		}
+
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			http.Error(w, "Invalid level: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		old := LogLevel.Level()
+		LogLevel.Set(l)
+		slog.Warn("Log level changed", "from", old, "to", l)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, map[string]string{"level": LogLevel.Level().String()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Error("Failed to encode admin response", "error", err)
+	}
+}
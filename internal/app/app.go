@@ -8,10 +8,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -19,7 +20,7 @@ import (
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/cenkalti/backoff/v4"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	// Removed unused import: "github.com/prometheus/client_golang/prometheus/promhttp"
@@ -28,6 +29,7 @@ import (
 	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
 	// Removed unused import: "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
@@ -49,6 +51,13 @@ var (
 		},
 		[]string{"path", "method"},
 	)
+	HTTPPanicsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_panics_total",
+			Help: "Total number of panics recovered in HTTP handlers",
+		},
+		[]string{"path", "method"},
+	)
 
 	// Business metrics for tracking todo operations
 	TodosAdded = promauto.NewCounter(
@@ -72,17 +81,27 @@ var (
 )
 
 // Todo represents a single todo item.
+// CreatedAt, UpdatedAt and CompletedAt are maintained by the store.
 type Todo struct {
-	ID        int    `json:"id"`
-	Task      string `json:"task"`
-	Completed bool   `json:"completed"`
+	ID          int        `json:"id"`
+	Task        string     `json:"task,omitempty"` // Kept by updates that leave it out
+	Completed   bool       `json:"completed"`
+	ListID      int64      `json:"list_id,omitempty"` // Defaults to the user's personal list when adding
+	DueAt       *time.Time `json:"due_at,omitempty"`
+	Priority    string     `json:"priority,omitempty"` // TodoPriorityLow...TodoPriorityUrgent; normal when adding
+	Notes       string     `json:"notes,omitempty"`    // Markdown, rendered by clients
+	CreatedAt   time.Time  `json:"created_at,omitzero"`
+	UpdatedAt   time.Time  `json:"updated_at,omitzero"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // Set while the todo is in the trash
+	Tags        []string   `json:"tags,omitempty"`       // Sorted; changed with /todos/{id}/tags
 }
 
 // DBConfig holds database connection parameters.
 // For robustness, we support separate read and write endpoints:
 // - DBHost/DBPort: Primary database (handles writes and reads)
-// - DBReadHost/DBReadPort: Read replica (handles reads only)
-// If read replica is unavailable, reads fall back to primary.
+// - DBReadHost/DBReadPort and DBReadReplicas: Read replicas (handle reads only)
+// If no read replica is available, reads fall back to primary.
 type DBConfig struct {
 	DBUser     string `json:"db_user"`      // Database username (IAM service account)
 	DBName     string `json:"db_name"`      // Database name
@@ -90,6 +109,44 @@ type DBConfig struct {
 	DBPort     string `json:"db_port"`      // Primary database port (5432)
 	DBReadHost string `json:"db_read_host"` // Read replica host (via Cloud SQL Proxy: 127.0.0.1)
 	DBReadPort string `json:"db_read_port"` // Read replica port (5433)
+
+	DBPassword      string            `json:"db_password,omitempty"`       // Password auth when not using the IAM proxy
+	DBReadReplicas  []ReplicaEndpoint `json:"db_read_replicas,omitempty"`  // Additional read replicas
+	DBReadBalancing string            `json:"db_read_balancing,omitempty"` // "round_robin" (default) or "least_latency"
+
+	// Connection options, see DSN
+	DBSSLMode         string `json:"db_sslmode,omitempty"`          // Default "disable" (the Cloud SQL Proxy encrypts)
+	DBSSLRootCert     string `json:"db_sslrootcert,omitempty"`      // CA certificate file
+	DBSSLCert         string `json:"db_sslcert,omitempty"`          // Client certificate file
+	DBSSLKey          string `json:"db_sslkey,omitempty"`           // Client key file
+	DBSSLRootCertPEM  string `json:"db_sslrootcert_pem,omitempty"`  // CA certificate contents (instead of a file)
+	DBSSLCertPEM      string `json:"db_sslcert_pem,omitempty"`      // Client certificate contents
+	DBSSLKeyPEM       string `json:"db_sslkey_pem,omitempty"`       // Client key contents
+	DBApplicationName string `json:"db_application_name,omitempty"` // Default "todo-app-go"
+	DBConnectTimeout  int    `json:"db_connect_timeout,omitempty"`  // Seconds, default 5
+	DBSearchPath      string `json:"db_search_path,omitempty"`      // Schema search path
+}
+
+// ReplicaEndpoint is the address of one read replica.
+type ReplicaEndpoint struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+// ReadReplicas returns all configured read replicas: DBReadHost/DBReadPort (if set)
+// followed by DBReadReplicas. Missing ports default to the primary's port.
+func (c DBConfig) ReadReplicas() []ReplicaEndpoint {
+	var endpoints []ReplicaEndpoint
+	if c.DBReadHost != "" {
+		endpoints = append(endpoints, ReplicaEndpoint{Host: c.DBReadHost, Port: c.DBReadPort})
+	}
+	endpoints = append(endpoints, c.DBReadReplicas...)
+	for i := range endpoints {
+		if endpoints[i].Port == "" {
+			endpoints[i].Port = c.DBPort
+		}
+	}
+	return endpoints
 }
 
 // Database connection pools:
@@ -126,6 +183,11 @@ func init() {
 		return counts.Requests >= 3 && failureRatio >= 0.6
 	}
 
+	// A request without a tenant is a bug in the caller, not a database failure
+	st.IsSuccessful = func(err error) bool {
+		return err == nil || errors.Is(err, ErrNoTenant)
+	}
+
 	// Log circuit breaker state changes for observability
 	st.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
 		slog.Warn("Circuit Breaker state changed", "name", name, "from", from, "to", to)
@@ -187,10 +249,13 @@ func InitTracer(projectID string) (func(), error) {
 		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 
+	info := GetBuildInfo()
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
 			semconv.ServiceNameKey.String("todo-app-go"),
-			semconv.ServiceVersionKey.String("1.0.0"),
+			semconv.ServiceVersionKey.String(info.Version),
+			attribute.String("service.commit", info.Commit),
+			attribute.String("service.build_time", info.BuildTime),
 		),
 	)
 	if err != nil {
@@ -213,146 +278,102 @@ func InitTracer(projectID string) (func(), error) {
 	}, nil
 }
 
-func SecurityHeadersMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// More permissive CSP that allows fonts and necessary resources
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; font-src 'self' data: https:; style-src 'self' 'unsafe-inline' https:; script-src 'self'; img-src 'self' data: https:")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-
-		start := time.Now()
-		rw := NewResponseWriter(w)
-		next.ServeHTTP(rw, r)
-		duration := time.Since(start).Seconds()
-
-		path := r.URL.Path
-		if strings.HasPrefix(path, "/todos/") && len(path) > 7 {
-			path = "/todos/:id"
-		}
-
-		HTTPRequestsTotal.WithLabelValues(path, r.Method, strconv.Itoa(rw.StatusCode)).Inc()
-		HTTPRequestDuration.WithLabelValues(path, r.Method).Observe(duration)
-	})
-}
-
-type responseWriter struct {
-	http.ResponseWriter
-	StatusCode int // Exported
-}
-
-func NewResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{w, http.StatusOK}
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.StatusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
 // InitDB establishes connections to both primary and read replica databases.
 // This dual-connection architecture provides:
 // - Write scaling: All writes go to primary
 // - Read scaling: Reads distributed to replica, reducing primary load
 // - Availability: Reads fall back to primary if replica fails
 //
+// InitDB returns immediately and connects in the background (see startup.go);
+// StoreReady reports when DB can be used.
+//
 // Connection uses Cloud SQL Proxy which handles:
 // - IAM authentication (no passwords needed)
 // - TLS encryption
 // - Connection pooling
 func InitDB(config DBConfig) {
-	var err error
+	ctx, done := startStore()
+	go func() {
+		defer close(done)
+		connectStore(ctx, config)
+	}()
+}
 
-	dbUser := config.DBUser
-	dbName := config.DBName
-	dbHost := config.DBHost
-	dbPort := config.DBPort
+// connectStore connects the primary (retrying until it answers) and then the read replicas.
+func connectStore(ctx context.Context, config DBConfig) {
+	config, err := resolveStoreTLS(ctx, config)
+	if err != nil {
+		slog.Error("Stopped resolving the database TLS configuration", "error", err)
+		return
+	}
 
 	// ===== PRIMARY DATABASE CONNECTION =====
 	// The primary database handles all writes and serves as fallback for reads
-	connStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbHost, dbPort, dbName)
-	slog.Info("Connecting to PRIMARY database", "url", connStr)
-
-	// Use longer retry timeout for initial connection (allows Cloud SQL Proxy to start)
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = 2 * time.Minute
-
-	op := func() error {
-		DB, err = sql.Open("postgres", connStr)
-		if err != nil {
-			return err
-		}
-		return DB.Ping()
-	}
-
-	err = backoff.RetryNotify(op, b, func(err error, d time.Duration) {
-		slog.Warn("Could not connect to PRIMARY database, retrying...", "error", err, "duration", d)
-	})
+	dsn := config.PrimaryDSN()
+	slog.Info("Connecting to PRIMARY database", "dsn", dsn)
 
+	primary, err := connectPrimary(ctx, dsn.ConnString())
 	if err != nil {
-		slog.Error("Could not connect to the PRIMARY database", "error", err)
-		os.Exit(1)
-	}
-	slog.Info("Successfully connected to PRIMARY database")
-
-	// ===== READ REPLICA CONNECTION (OPTIONAL) =====
-	// Read replica improves performance by offloading SELECT queries from primary.
-	// If connection fails, we gracefully fall back to primary for all operations.
-	if config.DBReadHost != "" {
-		dbReadHost := config.DBReadHost
-		dbReadPort := config.DBReadPort
-		if dbReadPort == "" {
-			dbReadPort = dbPort
-		}
+		slog.Error("Stopped connecting to the PRIMARY database", "error", err)
+		return
+	}
+	tls := checkTLS(ctx, primary, config)
+	setStoreTLS(tls)
+	slog.Info("Successfully connected to PRIMARY database", "sslmode", tls.Mode, "tls", tls.Enabled, "tls_version", tls.Version)
+
+	var pool *ReplicaPool
+	if len(config.ReadReplicas()) > 0 {
+		setStorePhase(StorePhaseConnectingReplicas)
+		pool = connectReplicas(ctx, config)
+	} else {
+		// No read replica configured in secrets
+		slog.Info("No Read Replica configured, using PRIMARY for reads")
+	}
+	setStores(primary, pool)
+	markStoreReady()
+}
 
-		readConnStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbReadHost, dbReadPort, dbName)
-		slog.Info("Connecting to READ REPLICA", "url", readConnStr)
+// connectReplicas builds and starts the read replica pool.
+// Read replicas improve performance by offloading SELECT queries from primary.
+// Replicas that can't be reached now are not fatal: they start ejected and the
+// pool's health checker admits them once they answer. Until then reads use the primary.
+func connectReplicas(ctx context.Context, config DBConfig) *ReplicaPool {
+	poolConfig := DefaultReplicaPoolConfig
+	if config.DBReadBalancing != "" {
+		poolConfig.Balancing = config.DBReadBalancing
+	}
+	pool := NewReplicaPool(poolConfig)
+	for _, ep := range config.ReadReplicas() {
+		name := ep.Host + ":" + ep.Port
+		readDSN := config.DSN(ep.Host, ep.Port)
+		slog.Info("Connecting to READ REPLICA", "replica", name, "dsn", readDSN)
 
-		opRead := func() error {
-			DBRead, err = sql.Open("postgres", readConnStr)
-			if err != nil {
-				return err
-			}
-			return DBRead.Ping()
+		replicaDB, err := sql.Open("postgres", readDSN.ConnString())
+		if err != nil {
+			slog.Error("Invalid READ REPLICA configuration, skipping", "replica", name, "error", err)
+			continue
 		}
 
-		// We can be more lenient with Read Replica connection failure
-		// since we can fall back to primary
-		err = backoff.RetryNotify(opRead, b, func(err error, d time.Duration) {
-			slog.Warn("Could not connect to READ REPLICA, retrying...", "error", err, "duration", d)
-		})
-
+		pingCtx, cancel := context.WithTimeout(ctx, poolConfig.CheckTimeout)
+		err = replicaDB.PingContext(pingCtx)
+		cancel()
 		if err != nil {
-			// Read replica unavailable - not fatal, fall back to primary
-			slog.Error("Could not connect to READ REPLICA, falling back to PRIMARY", "error", err)
-			DBRead = DB // Fallback to primary for reads
+			// Read replica unavailable - not fatal, the health checker keeps trying
+			slog.Error("Could not connect to READ REPLICA, will retry in background", "replica", name, "error", err)
 		} else {
-			slog.Info("Successfully connected to READ REPLICA")
+			slog.Info("Successfully connected to READ REPLICA", "replica", name)
 		}
-	} else {
-		// No read replica configured in secrets
-		slog.Info("No Read Replica configured, using PRIMARY for reads")
-		DBRead = DB
+		pool.Add(name, replicaDB, err == nil)
 	}
+	pool.Start()
+	return pool
 }
 
+// HealthzHandler is the liveness probe. It only reports that the process is
+// serving and never touches the database: restarting pods during a database
+// outage would clear the caches degraded mode serves from. Database state is
+// reported by ReadyzHandler.
 func HealthzHandler(w http.ResponseWriter, r *http.Request) {
-	if DB == nil {
-		http.Error(w, "Database connection not initialized", http.StatusInternalServerError)
-		return
-	}
-	if err := DB.Ping(); err != nil {
-		http.Error(w, "Database connection failed: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	// Check Read Replica too if distinct
-	if DBRead != DB && DBRead != nil {
-		if err := DBRead.Ping(); err != nil {
-			slog.Warn("Read Replica ping failed", "error", err)
-			// Don't fail health check if only read replica is down?
-			// Or maybe we should? For now, let's just log it.
-		}
-	}
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("OK")); err != nil {
 		slog.Error("Failed to write health check response", "error", err)
@@ -376,19 +397,30 @@ func HandleTodos(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleTodo(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.URL.Path[len("/todos/"):])
+	idPart, sub, _ := strings.Cut(r.URL.Path[len("/todos/"):], "/")
+	id, err := strconv.Atoi(idPart)
 	if err != nil {
 		http.Error(w, "Invalid todo ID", http.StatusBadRequest)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodPut:
+	switch {
+	case sub == "" && r.Method == http.MethodPut:
 		UpdateTodo(w, r, id)
-	case http.MethodDelete:
+	case sub == "" && r.Method == http.MethodDelete:
 		DeleteTodo(w, r, id)
-	default:
+	case sub == "history" && r.Method == http.MethodGet:
+		GetTodoHistory(w, r, id)
+	case sub == "restore" && r.Method == http.MethodPost:
+		RestoreTodo(w, r, id)
+	case sub == "tags" && r.Method == http.MethodPost:
+		AddTodoTag(w, r, id)
+	case strings.HasPrefix(sub, "tags/") && r.Method == http.MethodDelete:
+		RemoveTodoTag(w, r, id, strings.TrimPrefix(sub, "tags/"))
+	case sub == "" || sub == "history" || sub == "restore" || sub == "tags" || strings.HasPrefix(sub, "tags/"):
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
 	}
 }
 
@@ -400,53 +432,225 @@ func HandleTodo(w http.ResponseWriter, r *http.Request) {
 // - Automatic retries on transient errors (network blips, etc.)
 // - Circuit breaker prevents cascading failures
 // - Falls back to primary if read replica is unavailable
+// - Optionally hedges slow replica reads to the primary (see Hedger)
+// - Serves the last successful result from TodoCache (marked stale) if the database can't be read
 func GetTodos(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := parseTodoFilter(w, r)
+	if !ok {
+		return
+	}
 	var todos []Todo
 
 	err := ExecuteWithRobustness(func() error {
-		// Try read replica first
-		rows, err := DBRead.Query("SELECT id, task, completed FROM todos ORDER BY id")
-		if err != nil {
-			slog.Warn("Read replica failed, falling back to primary", "error", err)
-			// If read replica fails, fall back to primary
-			if DBRead != DB {
-				rows, err = DB.Query("SELECT id, task, completed FROM todos ORDER BY id")
+		var err error
+		todos, err = readTodos(r.Context(), principal.UserID, filter)
+		return err
+	})
+
+	if errors.Is(err, ErrNoTenant) {
+		writeNoTenant(w, r) // Never answered from the cache either
+		return
+	}
+	if err != nil {
+		if serveStaleTodos(w, r, listCacheKey(principal.UserID, filter), err) {
+			return
+		}
+		if err == gobreaker.ErrOpenState {
+			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	TodoCache.Put(listCacheKey(principal.UserID, filter), todos)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(todos); err != nil {
+		slog.Error("Failed to encode todos", "error", err)
+	}
+}
+
+// Trash filters of TodoFilter.
+const (
+	TrashExclude = ""        // Only todos that aren't trashed (the default)
+	TrashInclude = "include" // Todos and trashed todos
+	TrashOnly    = "only"    // Only trashed todos (GET /trash)
+)
+
+// TodoFilter selects and orders the todos of a list query.
+type TodoFilter struct {
+	ListID     int64      // One list, or all of the user's lists if 0
+	Trash      string     // TrashExclude, TrashInclude or TrashOnly
+	Priorities []string   // Any of these priorities, if set
+	Completed  *bool      // Only completed or open todos, if set
+	DueBefore  *time.Time // Only todos due before (exclusive), if set
+	DueAfter   *time.Time // Only todos due at or after, if set
+	Tags       [][]string // Only todos with a tag of every group, if set
+	Sort       string     // A TodoSorts key, "-" prefixed for descending; by id if empty
+}
+
+// parseTodoFilter reads the filter from the query string, writing a 400 if it is invalid:
+//
+//	?list=<id>&trash=include&priority=high,urgent&completed=false
+//	&due_after=<RFC 3339>&due_before=<RFC 3339>&sort=-due_at
+//	&tag=oncall,infra&tag=release (oncall or infra, and release)
+func parseTodoFilter(w http.ResponseWriter, r *http.Request) (TodoFilter, bool) {
+	var f TodoFilter
+	q := r.URL.Query()
+	if v := q.Get("list"); v != "" {
+		var err error
+		if f.ListID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Invalid list ID.")
+			return f, false
+		}
+	}
+	switch f.Trash = q.Get("trash"); f.Trash {
+	case TrashExclude, TrashInclude, TrashOnly:
+	default:
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", `trash must be "include" or "only".`)
+		return f, false
+	}
+	if err := parsePlanningFilter(&f, q); err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", err.Error())
+		return f, false
+	}
+	if err := parseTagFilter(&f, q); err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", err.Error())
+		return f, false
+	}
+	return f, true
+}
+
+// readTodos reads the todos userID can see that match the filter from the read
+// replica, falling back to the primary.
+// With hedging enabled, a slow replica is raced against the primary (see Hedger).
+func readTodos(ctx context.Context, userID int64, filter TodoFilter) ([]Todo, error) {
+	query := func(ctx context.Context, db *sql.DB) ([]Todo, error) {
+		return queryTodos(ctx, db, userID, filter)
+	}
+
+	primary, read, replicas := stores()
+	replica, member := readReplica(primary, read, replicas)
+	if replica != primary && Hedging.Enabled() {
+		return Hedging.Read(ctx, replica, primary, query, func(latency time.Duration, err error) {
+			if member != nil {
+				replicas.ReportQuery(member, latency, err)
 			}
+		})
+	}
+
+	// Try read replica first
+	start := time.Now()
+	todos, err := query(ctx, replica)
+	if errors.Is(err, ErrNoTenant) {
+		return nil, err // Not the replica's fault
+	}
+	if member != nil && ctx.Err() == nil {
+		replicas.ReportQuery(member, time.Since(start), err)
+	}
+	if err != nil {
+		slog.Warn("Read replica failed, falling back to primary", "error", err)
+		// If read replica fails, fall back to primary
+		if replica != primary {
+			todos, err = query(ctx, primary)
 		}
+	}
+	return todos, err
+}
+
+// readReplica picks the database to read from: a healthy member of the replica
+// pool, the primary if every replica is ejected, or read when there is no pool.
+func readReplica(primary, read *sql.DB, replicas *ReplicaPool) (*sql.DB, *Replica) {
+	if replicas == nil || replicas.Len() == 0 {
+		return read, nil
+	}
+	if r := replicas.Pick(); r != nil {
+		return r.DB(), r
+	}
+	return primary, nil
+}
 
+// queryTodos runs the list query for userID against db, in a read-only tenant
+// transaction. Only todos in lists the user is a member of are returned.
+func queryTodos(ctx context.Context, db *sql.DB, userID int64, filter TodoFilter) ([]Todo, error) {
+	op := "todos.list.primary"
+	if db != primaryDB() {
+		op = "todos.list.replica"
+	}
+	if err := Faults.Inject(ctx, op); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + todoColumns + ` FROM todos t
+		JOIN list_members m ON m.list_id = t.list_id AND m.user_id = $1`
+	args := []any{userID}
+	var where []string
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	switch filter.Trash {
+	case TrashExclude:
+		where = append(where, "t.deleted_at IS NULL")
+	case TrashOnly:
+		where = append(where, "t.deleted_at IS NOT NULL")
+	}
+	if filter.ListID != 0 {
+		where = append(where, "t.list_id = "+arg(filter.ListID))
+	}
+	if len(filter.Priorities) > 0 {
+		where = append(where, "t.priority = ANY("+arg(pq.Array(filter.Priorities))+")")
+	}
+	if filter.Completed != nil {
+		where = append(where, "t.completed = "+arg(*filter.Completed))
+	}
+	if filter.DueAfter != nil {
+		where = append(where, "t.due_at >= "+arg(*filter.DueAfter))
+	}
+	if filter.DueBefore != nil {
+		where = append(where, "t.due_at < "+arg(*filter.DueBefore))
+	}
+	// Each group is a semi-join on the (todo_id, tag_id) primary key
+	for _, group := range filter.Tags {
+		where = append(where, `EXISTS (SELECT 1 FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id
+			WHERE tt.todo_id = t.id AND g.name = ANY(`+arg(pq.Array(group))+`))`)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	var todos []Todo
+	err := tenantTx(ctx, db, readOnly, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query+" ORDER BY "+todoOrderBy(filter.Sort), args...)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
-		todos = []Todo{} // Reset slice on retry to avoid duplicates
+		todos = []Todo{}
 		for rows.Next() {
-			var t Todo
-			if err := rows.Scan(&t.ID, &t.Task, &t.Completed); err != nil {
+			t, err := scanTodo(rows)
+			if err != nil {
 				return err
 			}
-			todos = append(todos, t)
+			todos = append(todos, *t)
 		}
 		return rows.Err()
 	})
-
 	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(todos); err != nil {
-		slog.Error("Failed to encode todos", "error", err)
+		return nil, err
 	}
+	return todos, nil
 }
 
 func AddTodo(w http.ResponseWriter, r *http.Request) {
 	slog.Info("addTodo called", "method", r.Method, "path", r.URL.Path)
+	if rejectIfReadOnly(w, r) {
+		return
+	}
 
 	var t Todo
 	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
@@ -456,11 +660,77 @@ func AddTodo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	slog.Info("Decoded todo", "task", t.Task)
+	if t.Priority == "" {
+		t.Priority = TodoPriorityNormal
+	}
+	err := validateTodo(&t)
+	if err == nil {
+		t.Tags, err = normalizeTags(t.Tags)
+	}
+	if err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
 
-	err := ExecuteWithRobustness(func() error {
-		return DB.QueryRow("INSERT INTO todos (task) VALUES ($1) RETURNING id, completed", t.Task).Scan(&t.ID, &t.Completed)
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	if t.ListID == 0 {
+		listID, err := PersonalListID(r.Context(), principal.UserID)
+		if err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		t.ListID = listID
+	}
+
+	// The todo is only inserted if the user may edit the list
+	var inserted bool
+	err = ExecuteWithRobustness(func() error {
+		if err := Faults.Inject(r.Context(), "todos.add"); err != nil {
+			return err
+		}
+		return inTenant(r.Context(), func(tx *sql.Tx) error {
+			created, err := scanTodo(tx.QueryRowContext(r.Context(),
+				`INSERT INTO todos AS t (task, owner_id, list_id, due_at, priority, notes)
+				 SELECT $1, $2, list_id, $4, $5, $6 FROM list_members WHERE list_id = $3 AND user_id = $2 AND role IN ('owner', 'editor')
+				 RETURNING `+todoColumns,
+				t.Task, principal.UserID, t.ListID, t.DueAt, t.Priority, t.Notes))
+			if errors.Is(err, sql.ErrNoRows) {
+				inserted = false
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			inserted = true
+			if len(t.Tags) > 0 {
+				for _, tag := range t.Tags {
+					if _, err := tagTodo(r.Context(), tx, created.ID, tag); err != nil {
+						return err
+					}
+				}
+				if created, err = touchTodo(r.Context(), tx, created.ID); err != nil {
+					return err
+				}
+			}
+			t = *created
+			return recordTodoEvent(r.Context(), tx, TodoEventCreate, nil, &t)
+		})
 	})
+	if err == nil && !inserted {
+		if err = requireListRole(r.Context(), principal.UserID, t.ListID, RoleEditor); err == nil {
+			err = ErrNotFound // The membership changed in between
+		}
+		writeListError(w, r, err)
+		return
+	}
 
+	if errors.Is(err, ErrNoTenant) {
+		writeNoTenant(w, r)
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to insert todo", "error", err, "task", t.Task)
 		if err == gobreaker.ErrOpenState {
@@ -480,18 +750,66 @@ func AddTodo(w http.ResponseWriter, r *http.Request) {
 	TodosAdded.Inc()
 }
 
+// UpdateTodo changes the fields of a todo present in the request body, e.g.
+// {"completed": true} or {"due_at": null}; the others are kept.
 func UpdateTodo(w http.ResponseWriter, r *http.Request, id int) {
-	var t Todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+	if rejectIfReadOnly(w, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &Todo{})
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err := ExecuteWithRobustness(func() error {
-		_, err := DB.Exec("UPDATE todos SET completed = $1 WHERE id = $2", t.Completed, id)
-		return err
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var found bool
+	var updated *Todo
+	var invalid error
+	err = ExecuteWithRobustness(func() error {
+		if err := Faults.Inject(r.Context(), "todos.update"); err != nil {
+			return err
+		}
+		invalid = nil
+		return inTenant(r.Context(), func(tx *sql.Tx) error {
+			before, err := lockEditableTodo(r.Context(), tx, principal.UserID, id, false)
+			if before == nil || err != nil {
+				found = false
+				return err
+			}
+			found = true
+			t, err := mergeTodo(before, body)
+			if err != nil {
+				invalid = err
+				return nil
+			}
+			updated, err = scanTodo(tx.QueryRowContext(r.Context(),
+				`UPDATE todos t SET task = $1, completed = $2, due_at = $3, priority = $4, notes = $5, updated_at = now(),
+				        completed_at = CASE WHEN NOT $2 THEN NULL WHEN t.completed THEN t.completed_at ELSE now() END
+				 WHERE t.id = $6 RETURNING `+todoColumns,
+				t.Task, t.Completed, t.DueAt, t.Priority, t.Notes, id))
+			if err != nil {
+				return err
+			}
+			return recordTodoEvent(r.Context(), tx, TodoEventUpdate, before, updated)
+		})
 	})
+	if invalid != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", invalid.Error())
+		return
+	}
 
+	if errors.Is(err, ErrNoTenant) {
+		writeNoTenant(w, r)
+		return
+	}
 	if err != nil {
 		if err == gobreaker.ErrOpenState {
 			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
@@ -500,17 +818,50 @@ func UpdateTodo(w http.ResponseWriter, r *http.Request, id int) {
 		}
 		return
 	}
+	if !found {
+		writeTodoAccessError(w, r, todoAccessError(r.Context(), principal.UserID, id, false))
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, updated)
 	TodosUpdated.Inc()
 }
 
 func DeleteTodo(w http.ResponseWriter, r *http.Request, id int) {
+	if rejectIfReadOnly(w, r) {
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var found bool
 	err := ExecuteWithRobustness(func() error {
-		_, err := DB.Exec("DELETE FROM todos WHERE id = $1", id)
-		return err
+		if err := Faults.Inject(r.Context(), "todos.delete"); err != nil {
+			return err
+		}
+		return inTenant(r.Context(), func(tx *sql.Tx) error {
+			before, err := lockEditableTodo(r.Context(), tx, principal.UserID, id, false)
+			if before == nil || err != nil {
+				found = false
+				return err
+			}
+			found = true
+			// Moved to the trash; purged after TrashRetention (see PurgeTrash)
+			after, err := scanTodo(tx.QueryRowContext(r.Context(),
+				"UPDATE todos t SET deleted_at = now() WHERE t.id = $1 RETURNING "+todoColumns, id))
+			if err != nil {
+				return err
+			}
+			return recordTodoEvent(r.Context(), tx, TodoEventDelete, before, after)
+		})
 	})
 
+	if errors.Is(err, ErrNoTenant) {
+		writeNoTenant(w, r)
+		return
+	}
 	if err != nil {
 		if err == gobreaker.ErrOpenState {
 			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
@@ -519,11 +870,81 @@ func DeleteTodo(w http.ResponseWriter, r *http.Request, id int) {
 		}
 		return
 	}
+	if !found {
+		writeTodoAccessError(w, r, todoAccessError(r.Context(), principal.UserID, id, false))
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 	TodosDeleted.Inc()
 }
 
+// todoColumns are the columns of a todo (aliased t) read by scanTodo.
+const todoColumns = "t.id, t.task, t.completed, t.list_id, t.due_at, t.priority, t.notes, t.created_at, t.updated_at, t.completed_at, t.deleted_at, " +
+	"ARRAY(SELECT g.name FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id WHERE tt.todo_id = t.id ORDER BY g.name)"
+
+// scanTodo scans a row of todoColumns.
+func scanTodo(row interface{ Scan(...any) error }) (*Todo, error) {
+	var t Todo
+	var dueAt, completedAt, deletedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.Task, &t.Completed, &t.ListID, &dueAt, &t.Priority, &t.Notes,
+		&t.CreatedAt, &t.UpdatedAt, &completedAt, &deletedAt, (*pq.StringArray)(&t.Tags)); err != nil {
+		return nil, err
+	}
+	t.DueAt = nullTime(dueAt)
+	t.CompletedAt = nullTime(completedAt)
+	t.DeletedAt = nullTime(deletedAt)
+	return &t, nil
+}
+
+// nullTime returns the time of a nullable column, or nil.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// lockEditableTodo locks and returns the todo for a change, or nil if it doesn't
+// exist, isn't in a list the user may edit, or is (trashed) or isn't (!trashed) in the trash.
+func lockEditableTodo(ctx context.Context, tx *sql.Tx, userID int64, id int, trashed bool) (*Todo, error) {
+	t, err := scanTodo(tx.QueryRowContext(ctx,
+		`SELECT `+todoColumns+` FROM todos t JOIN list_members m ON m.list_id = t.list_id
+		 WHERE t.id = $1 AND m.user_id = $2 AND m.role IN ('owner', 'editor') AND (t.deleted_at IS NOT NULL) = $3
+		 FOR UPDATE OF t`, id, userID, trashed))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return t, err
+}
+
+// rowsAffected reports whether a statement changed any row.
+func rowsAffected(result sql.Result) (bool, error) {
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// writeTodoNotFound is returned both for todos that don't exist and for todos
+// in lists the user isn't a member of, so that ids of other users' todos can't be probed.
+func writeTodoNotFound(w http.ResponseWriter, r *http.Request) {
+	WriteProblem(w, r, http.StatusNotFound, "Not Found", "Todo not found.")
+}
+
+// writeTodoAccessError writes the response for a todo mutation that changed nothing (see todoAccessError).
+func writeTodoAccessError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeTodoNotFound(w, r)
+	case errors.Is(err, ErrForbidden):
+		WriteProblem(w, r, http.StatusForbidden, "Forbidden", "You can view this list but not change it.")
+	case errors.Is(err, ErrNoTenant):
+		writeNoTenant(w, r)
+	default:
+		slog.Error("Failed to check todo access", "error", err)
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not complete the request.")
+	}
+}
+
 func AccessSecretVersion(name string) (string, error) {
 	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
@@ -0,0 +1,137 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Audit log.
+//
+// Every todo mutation appends an event to todo_events in the same transaction,
+// so a change is never committed without its event and vice versa. Events hold
+// the todo before and after the change, who made it (and how: session, token...),
+// and the request and trace ids to find the matching logs and traces.
+//
+// The table is append-only: the database rejects updates and deletes of events
+// (see init.sql). Events don't reference the todo, so the history of a deleted
+// todo stays readable by the members of its list: GET /todos/{id}/history.
+
+const (
+	TodoEventCreate = "create"
+	TodoEventUpdate = "update"
+	TodoEventDelete = "delete"
+)
+
+// TodoEvent is an entry of a todo's history.
+type TodoEvent struct {
+	ID          int64           `json:"id"`
+	TodoID      int             `json:"todo_id"`
+	Action      string          `json:"action"`
+	ActorID     int64           `json:"actor_id"`
+	ActorEmail  string          `json:"actor_email,omitempty"`
+	ActorMethod string          `json:"actor_method"`
+	Before      json.RawMessage `json:"before,omitempty"`
+	After       json.RawMessage `json:"after,omitempty"`
+	RequestID   string          `json:"request_id,omitempty"`
+	TraceID     string          `json:"trace_id,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// todoJSON encodes a todo for the audit log; nil is stored as NULL.
+func todoJSON(t *Todo) (sql.NullString, error) {
+	if t == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(t)
+	return sql.NullString{String: string(b), Valid: true}, err
+}
+
+// recordTodoEvent appends an event for a change of a todo to the audit log, in
+// the mutation's transaction. before is nil for creates, after for hard deletes
+// (purges and the todos of deleted lists).
+func recordTodoEvent(ctx context.Context, tx *sql.Tx, action string, before, after *Todo) error {
+	todo := after
+	if todo == nil {
+		todo = before
+	}
+	beforeJSON, err := todoJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := todoJSON(after)
+	if err != nil {
+		return err
+	}
+	var actorID int64
+	var method string
+	if p, ok := PrincipalFromContext(ctx); ok {
+		actorID, method = p.UserID, p.Method
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO todo_events (todo_id, list_id, action, actor_id, actor_method, before, after, request_id, trace_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))`,
+		todo.ID, todo.ListID, action, actorID, method, beforeJSON, afterJSON,
+		RequestIDFromContext(ctx), TraceIDFromContext(ctx))
+	return err
+}
+
+// TodoHistory returns the events of a todo, oldest first, if the user is a
+// member of its list. Deleted todos keep their history.
+func TodoHistory(ctx context.Context, userID int64, todoID int) ([]TodoEvent, error) {
+	var events []TodoEvent
+	err := ExecuteWithRobustness(func() error {
+		events = nil
+		return tenantTx(ctx, primaryDB(), readOnly, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx,
+				`SELECT e.id, e.todo_id, e.action, e.actor_id, COALESCE(u.email, ''), e.actor_method,
+				        e.before, e.after, COALESCE(e.request_id, ''), COALESCE(e.trace_id, ''), e.created_at
+				 FROM todo_events e
+				 JOIN list_members m ON m.list_id = e.list_id AND m.user_id = $2
+				 LEFT JOIN users u ON u.id = e.actor_id
+				 WHERE e.todo_id = $1 ORDER BY e.id`, todoID, userID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var e TodoEvent
+				var before, after []byte
+				if err := rows.Scan(&e.ID, &e.TodoID, &e.Action, &e.ActorID, &e.ActorEmail, &e.ActorMethod,
+					&before, &after, &e.RequestID, &e.TraceID, &e.CreatedAt); err != nil {
+					return err
+				}
+				e.Before, e.After = before, after
+				events = append(events, e)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrNotFound // Missing, or not in the user's lists
+	}
+	return events, nil
+}
+
+// GetTodoHistory serves GET /todos/{id}/history.
+func GetTodoHistory(w http.ResponseWriter, r *http.Request, id int) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	events, err := TodoHistory(r.Context(), principal.UserID, id)
+	if err != nil {
+		writeTodoAccessError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
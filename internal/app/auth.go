@@ -0,0 +1,147 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Authentication.
+//
+// Every todo belongs to a user, and the store queries are scoped to the user
+// making the request (the principal). AuthMiddleware runs the configured
+// Authenticators in order; the first one that recognizes the request's
+// credentials sets the principal. RequireAuth rejects requests without one.
+//
+// Authenticators:
+// - TokenAuthenticator: personal API tokens (Authorization: Bearer), see tokens.go
+// - Sessions.Authenticator: the session cookie set by the OpenID Connect login (see oidc.go)
+// - DevAuthenticator: every request is the same local user (DEV_AUTH_USER), for local development only
+
+// Principal is the authenticated user of a request.
+type Principal struct {
+	UserID   int64  `json:"user_id"`
+	TenantID int64  `json:"tenant_id"`
+	Subject  string `json:"subject"` // Stable identity from the identity provider
+	Email    string `json:"email,omitempty"`
+	Method   string `json:"method"`          // Authenticator that identified the user
+	Scope    string `json:"scope,omitempty"` // Set for API tokens (TokenScopeRead, TokenScopeWrite)
+}
+
+// CanWrite reports whether the principal may modify data. Only read-scoped API tokens can't.
+func (p *Principal) CanWrite() bool {
+	return p.Scope != TokenScopeRead
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p, scoped to p's tenant.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	if p != nil && p.TenantID != 0 {
+		ctx = WithTenant(ctx, p.TenantID)
+	}
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the authenticated user, if any.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// ErrUnauthenticated is returned by an Authenticator for credentials that are present but invalid.
+var ErrUnauthenticated = errors.New("invalid credentials")
+
+// Authenticator identifies the user of a request. It returns nil, nil if the
+// request carries no credentials it understands, so the next one can be tried.
+type Authenticator func(r *http.Request) (*Principal, error)
+
+// AuthMiddleware sets the principal of requests that carry valid credentials.
+// Requests with invalid credentials are rejected with 401; requests without
+// any are passed on anonymously (see RequireAuth).
+func AuthMiddleware(authenticators ...Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticate := range authenticators {
+				p, err := authenticate(r)
+				if err != nil {
+					if errors.Is(err, ErrUnauthenticated) {
+						// Limited per client IP, as there is no user to key on (see RateLimiter)
+						if RateLimit.AllowAuthFailure(w, r) {
+							writeUnauthorized(w, r, "The provided credentials are invalid or expired.")
+						}
+					} else {
+						slog.Error("Authentication failed", "error", err, "request_id", RequestIDFromContext(r.Context()))
+						WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not verify credentials.")
+					}
+					return
+				}
+				if p != nil {
+					r = r.WithContext(WithPrincipal(r.Context(), p))
+					break
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireAuth rejects requests without a principal with 401.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := PrincipalFromContext(r.Context()); !ok {
+			writeUnauthorized(w, r, "Sign in to continue.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireWriteScope rejects requests that modify data with 403 if the principal may only read.
+func RequireWriteScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if p, ok := PrincipalFromContext(r.Context()); ok && !p.CanWrite() {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				WriteProblem(w, r, http.StatusForbidden, "Forbidden", "This token is read-only.")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="todo-app"`)
+	WriteProblem(w, r, http.StatusUnauthorized, "Unauthorized", detail)
+}
+
+// requirePrincipal returns the principal of r, or writes a 401 and returns false.
+// Handlers call it before touching the store, even behind RequireAuth.
+func requirePrincipal(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, r, "Sign in to continue.")
+	}
+	return p, ok
+}
+
+// DevAuthenticator treats every request as the local user name. It must only be
+// enabled for local development (DEV_AUTH_USER).
+func DevAuthenticator(name string) Authenticator {
+	subject := "dev:" + name
+	return func(r *http.Request) (*Principal, error) {
+		user, err := Users.Ensure(r.Context(), subject, "")
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{UserID: user.ID, TenantID: user.TenantID, Subject: subject, Method: "dev"}, nil
+	}
+}
@@ -0,0 +1,153 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Credential cache.
+//
+// Sessions and API tokens are checked against the primary database. So that a
+// database outage doesn't sign everyone out (and stale reads from TodoCache can
+// still be served), validated credentials are remembered in memory:
+// - For TTL, a credential is accepted from the cache without asking the database
+// - Up to MaxStale, a cached credential is accepted when the database can't be asked
+// A credential is never accepted past its own expiry. Logging out or revoking a
+// token evicts it on this pod; other pods notice within TTL.
+
+// AuthCacheConfig controls how long validated credentials are remembered.
+type AuthCacheConfig struct {
+	TTL        time.Duration // Served without checking the store
+	MaxStale   time.Duration // Served while the store is unavailable
+	MaxEntries int
+}
+
+// DefaultAuthCacheConfig is used by the session and token caches.
+var DefaultAuthCacheConfig = AuthCacheConfig{
+	TTL:        30 * time.Second,
+	MaxStale:   15 * time.Minute,
+	MaxEntries: 10000,
+}
+
+var AuthCacheFallbacksTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "auth_cache_fallbacks_total",
+		Help: "Requests authenticated from the credential cache because the store was unavailable, by kind (session, token)",
+	},
+	[]string{"kind"},
+)
+
+type credentialEntry[T any] struct {
+	value       T
+	validatedAt time.Time
+	expiresAt   time.Time // Of the credential itself
+}
+
+// credentialCache maps hashed credentials to what they were validated as.
+type credentialCache[T any] struct {
+	config  AuthCacheConfig
+	mu      sync.Mutex
+	entries map[string]credentialEntry[T]
+}
+
+func newCredentialCache[T any](config AuthCacheConfig) *credentialCache[T] {
+	if config.MaxEntries < 1 {
+		config.MaxEntries = 1
+	}
+	return &credentialCache[T]{config: config, entries: map[string]credentialEntry[T]{}}
+}
+
+// get returns the value cached for key if it hasn't expired and was validated
+// within TTL, or within MaxStale if stale is set.
+func (c *credentialCache[T]) get(key string, stale bool) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero T
+	entry, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	now := time.Now()
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return zero, false
+	}
+	maxAge := c.config.TTL
+	if stale {
+		maxAge = c.config.MaxStale
+	}
+	if now.Sub(entry.validatedAt) > maxAge {
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// fresh returns the value for key if it may be used without checking the store.
+func (c *credentialCache[T]) fresh(key string) (T, bool) {
+	return c.get(key, false)
+}
+
+// fallback returns the value for key if it may be used while the store is unavailable.
+func (c *credentialCache[T]) fallback(key string) (T, bool) {
+	return c.get(key, true)
+}
+
+// put remembers value for key as validated now. When the cache is full, entries
+// that can no longer be served are dropped, then any entry.
+func (c *credentialCache[T]) put(key string, value T, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) || now.Sub(entry.validatedAt) > c.config.MaxStale {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.config.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = credentialEntry[T]{value: value, validatedAt: now, expiresAt: expiresAt}
+}
+
+// remove forgets key.
+func (c *credentialCache[T]) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// removeFunc forgets every entry whose value matches.
+func (c *credentialCache[T]) removeFunc(match func(T) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if match(entry.value) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// reset forgets every entry and applies config.
+func (c *credentialCache[T]) reset(config AuthCacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if config.MaxEntries < 1 {
+		config.MaxEntries = 1
+	}
+	c.config = config
+	c.entries = map[string]credentialEntry[T]{}
+}
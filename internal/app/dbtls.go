@@ -0,0 +1,183 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Database TLS.
+//
+// Behind the Cloud SQL Proxy connections use sslmode=disable: the proxy encrypts
+// and authenticates them. Without the proxy, DBConfig can require TLS up to
+// verify-full, with a CA and an optional client certificate and key, either as
+// file paths (e.g. a mounted Kubernetes secret) or as PEM contents in the database
+// secret itself. PEM contents are written to private files because lib/pq only
+// reads certificates from files.
+//
+// The negotiated TLS state of the primary connection is reported by /readyz.
+
+// sslModes are the sslmode values accepted by lib/pq.
+var sslModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// Validate checks the connection options.
+func (c DBConfig) Validate() error {
+	mode := c.DBSSLMode
+	if mode == "" {
+		mode = defaultSSLMode
+	}
+	if !sslModes[mode] {
+		return fmt.Errorf("invalid db_sslmode %q", c.DBSSLMode)
+	}
+	if c.DBSSLRootCert != "" && c.DBSSLRootCertPEM != "" {
+		return fmt.Errorf("set only one of db_sslrootcert and db_sslrootcert_pem")
+	}
+	if (mode == "verify-ca" || mode == "verify-full") && c.DBSSLRootCert == "" && c.DBSSLRootCertPEM == "" {
+		return fmt.Errorf("db_sslmode %s needs a CA certificate (db_sslrootcert or db_sslrootcert_pem)", mode)
+	}
+	if c.DBSSLCert != "" && c.DBSSLCertPEM != "" || c.DBSSLKey != "" && c.DBSSLKeyPEM != "" {
+		return fmt.Errorf("set either the file or the PEM contents of the client certificate and key, not both")
+	}
+	hasCert := c.DBSSLCert != "" || c.DBSSLCertPEM != ""
+	hasKey := c.DBSSLKey != "" || c.DBSSLKeyPEM != ""
+	if hasCert != hasKey {
+		return fmt.Errorf("a client certificate needs both a certificate and a key")
+	}
+	for name, data := range map[string]string{
+		"db_sslrootcert_pem": c.DBSSLRootCertPEM,
+		"db_sslcert_pem":     c.DBSSLCertPEM,
+		"db_sslkey_pem":      c.DBSSLKeyPEM,
+	} {
+		if data != "" {
+			if block, _ := pem.Decode([]byte(data)); block == nil {
+				return fmt.Errorf("%s is not PEM encoded", name)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	tlsDirMu sync.Mutex
+	tlsDir   string
+)
+
+// writeTLSFile writes PEM contents to a private file named after their hash,
+// so that an unchanged certificate keeps its path across reloads.
+func writeTLSFile(kind, contents string) (string, error) {
+	tlsDirMu.Lock()
+	defer tlsDirMu.Unlock()
+
+	if tlsDir == "" {
+		dir, err := os.MkdirTemp("", "todo-app-db-tls-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create TLS directory: %w", err)
+		}
+		tlsDir = dir
+	}
+	sum := sha256.Sum256([]byte(contents))
+	path := filepath.Join(tlsDir, kind+"-"+hex.EncodeToString(sum[:8])+".pem")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	// lib/pq refuses keys that are readable by group or others
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", kind, err)
+	}
+	return path, nil
+}
+
+// resolveTLSFiles returns a copy of c in which PEM contents are replaced by file paths.
+func (c DBConfig) resolveTLSFiles() (DBConfig, error) {
+	for _, f := range []struct {
+		kind string
+		pem  *string
+		path *string
+	}{
+		{"root", &c.DBSSLRootCertPEM, &c.DBSSLRootCert},
+		{"cert", &c.DBSSLCertPEM, &c.DBSSLCert},
+		{"key", &c.DBSSLKeyPEM, &c.DBSSLKey},
+	} {
+		if *f.pem == "" {
+			continue
+		}
+		path, err := writeTLSFile(f.kind, *f.pem)
+		if err != nil {
+			return c, err
+		}
+		*f.path, *f.pem = path, ""
+	}
+	return c, nil
+}
+
+// TLSStatus is the TLS state of the primary connection, reported by /readyz.
+type TLSStatus struct {
+	Mode             string     `json:"mode"`
+	Enabled          bool       `json:"enabled"`
+	Version          string     `json:"version,omitempty"`
+	Cipher           string     `json:"cipher,omitempty"`
+	ClientCert       bool       `json:"client_cert"`
+	ClientCertExpiry *time.Time `json:"client_cert_expiry,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// checkTLS reports how the connection to db is secured. config must have its
+// TLS files resolved.
+func checkTLS(ctx context.Context, db *sql.DB, config DBConfig) TLSStatus {
+	status := TLSStatus{Mode: config.PrimaryDSN().SSLMode, ClientCert: config.DBSSLCert != ""}
+
+	if config.DBSSLCert != "" {
+		expiry, err := certExpiry(config.DBSSLCert)
+		if err != nil {
+			status.Error = err.Error()
+		} else {
+			status.ClientCertExpiry = &expiry
+		}
+	}
+
+	var version, cipher sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT ssl, version, cipher FROM pg_stat_ssl WHERE pid = pg_backend_pid()").
+		Scan(&status.Enabled, &version, &cipher)
+	if err != nil {
+		status.Error = "failed to query pg_stat_ssl: " + err.Error()
+		return status
+	}
+	status.Version, status.Cipher = version.String, cipher.String
+	return status
+}
+
+// certExpiry returns the expiry of the first certificate in a PEM file.
+func certExpiry(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read client certificate: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("client certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse client certificate: %w", err)
+	}
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,254 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"container/list"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+// Degraded mode.
+//
+// When the database can't be read (errors or circuit breaker open), GetTodos serves
+// the last successful list result from TodoCache, marked stale with a Warning and
+// X-Stale header, instead of an error page.
+//
+// Writes can't be served from a cache, so in read-only mode they fail fast with 503
+// and a clear reason. Read-only mode is entered:
+// - Manually, through the admin server (/debug/readonly), e.g. during a database maintenance
+// - Automatically, while the database circuit breaker is open
+
+var (
+	StaleResponsesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stale_responses_total",
+			Help: "List responses served from the local cache because the database was unavailable",
+		},
+	)
+	ReadOnlyRejectionsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "read_only_rejections_total",
+			Help: "Write requests rejected because the service was in read-only mode",
+		},
+	)
+)
+
+// ===== LIST CACHE =====
+
+type listCacheEntry struct {
+	key      string
+	todos    []Todo
+	storedAt time.Time
+}
+
+// ListCache is a bounded LRU cache of list results.
+type ListCache struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List // Front = most recently used
+	entries map[string]*list.Element
+}
+
+// NewListCache creates a cache holding at most max list results.
+func NewListCache(max int) *ListCache {
+	if max < 1 {
+		max = 1
+	}
+	return &ListCache{max: max, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// TodoCache holds the last successful GetTodos results.
+var TodoCache = NewListCache(256)
+
+// Put stores a copy of todos under key, evicting the least recently used entry if full.
+func (c *ListCache) Put(key string, todos []Todo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &listCacheEntry{key: key, todos: append([]Todo(nil), todos...), storedAt: time.Now()}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*listCacheEntry).key)
+	}
+}
+
+// Get returns the cached todos for key and when they were stored.
+func (c *ListCache) Get(key string) ([]Todo, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	c.order.MoveToFront(el)
+	entry := el.Value.(*listCacheEntry)
+	return append([]Todo(nil), entry.todos...), entry.storedAt, true
+}
+
+// Clear empties the cache.
+func (c *ListCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+// listCacheKey identifies the list result of userID for filter. It is built from
+// the parsed filter rather than the query string, so unknown parameters and the
+// order of parameters, priorities and tags don't create separate entries (and
+// one client can't evict everyone else's entries by varying its URL).
+func listCacheKey(userID int64, filter TodoFilter) string {
+	key := url.Values{}
+	if filter.ListID != 0 {
+		key.Set("list", strconv.FormatInt(filter.ListID, 10))
+	}
+	if filter.Trash != TrashExclude {
+		key.Set("trash", filter.Trash)
+	}
+	if len(filter.Priorities) > 0 {
+		key.Set("priority", strings.Join(sortedUnique(filter.Priorities), ","))
+	}
+	if filter.Completed != nil {
+		key.Set("completed", strconv.FormatBool(*filter.Completed))
+	}
+	if filter.DueAfter != nil {
+		key.Set("due_after", filter.DueAfter.UTC().Format(time.RFC3339))
+	}
+	if filter.DueBefore != nil {
+		key.Set("due_before", filter.DueBefore.UTC().Format(time.RFC3339))
+	}
+	groups := make([]string, 0, len(filter.Tags))
+	for _, group := range filter.Tags {
+		groups = append(groups, strings.Join(sortedUnique(group), ","))
+	}
+	for _, group := range sortedUnique(groups) {
+		key.Add("tag", group)
+	}
+	if filter.Sort != "" {
+		key.Set("sort", filter.Sort)
+	}
+	return strconv.FormatInt(userID, 10) + "?" + key.Encode()
+}
+
+// sortedUnique returns a sorted copy of values without duplicates.
+func sortedUnique(values []string) []string {
+	sorted := append([]string(nil), values...)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
+
+// serveStaleTodos writes the cached list for key if there is one.
+func serveStaleTodos(w http.ResponseWriter, r *http.Request, key string, cause error) bool {
+	todos, storedAt, ok := TodoCache.Get(key)
+	if !ok {
+		return false
+	}
+
+	age := time.Since(storedAt)
+	slog.Warn("Serving stale todos from cache", "error", cause, "age", age.String(),
+		"request_id", RequestIDFromContext(r.Context()))
+	StaleResponsesTotal.Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("X-Stale", "true")
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if err := json.NewEncoder(w).Encode(todos); err != nil {
+		slog.Error("Failed to encode stale todos", "error", err)
+	}
+	return true
+}
+
+// ===== READ-ONLY MODE =====
+
+var (
+	readOnlyMu     sync.RWMutex
+	readOnlyManual bool
+	readOnlyReason string
+)
+
+// SetReadOnly enables or disables manual read-only mode.
+func SetReadOnly(enabled bool, reason string) {
+	readOnlyMu.Lock()
+	defer readOnlyMu.Unlock()
+	readOnlyManual = enabled
+	readOnlyReason = reason
+	if enabled {
+		slog.Warn("Read-only mode enabled", "reason", reason)
+	} else {
+		slog.Info("Read-only mode disabled")
+	}
+}
+
+// ReadOnly reports whether writes are currently refused, and why.
+func ReadOnly() (bool, string) {
+	readOnlyMu.RLock()
+	manual, reason := readOnlyManual, readOnlyReason
+	readOnlyMu.RUnlock()
+
+	if manual {
+		if reason == "" {
+			reason = "maintenance"
+		}
+		return true, reason
+	}
+	if CB != nil && CB.State() == gobreaker.StateOpen {
+		return true, "database unavailable (circuit breaker open)"
+	}
+	return false, ""
+}
+
+// rejectIfReadOnly writes a 503 and returns true if writes are currently refused.
+func rejectIfReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	readOnly, reason := ReadOnly()
+	if !readOnly {
+		return false
+	}
+	ReadOnlyRejectionsTotal.Inc()
+	w.Header().Set("Retry-After", "30")
+	WriteProblem(w, r, http.StatusServiceUnavailable, "Service is read-only", "Writes are temporarily disabled: "+reason+".")
+	return true
+}
+
+// ReadOnlyHandler reads or changes manual read-only mode on the admin server.
+// PUT/POST ?enabled=true&reason=... enables it, ?enabled=false disables it.
+func ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+			return
+		}
+		SetReadOnly(enabled, r.URL.Query().Get("reason"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	readOnly, reason := ReadOnly()
+	writeAdminJSON(w, map[string]any{"read_only": readOnly, "reason": reason})
+}
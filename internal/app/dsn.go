@@ -0,0 +1,156 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// iamPasswordPlaceholder is sent when DBConfig has no password. The
+// IAM-authenticating Cloud SQL Proxy ignores it.
+const iamPasswordPlaceholder = "dummy-password"
+
+// Connection defaults used when the secret doesn't set them.
+const (
+	defaultSSLMode         = "disable" // The Cloud SQL Proxy encrypts the connection
+	defaultApplicationName = "todo-app-go"
+	defaultConnectTimeout  = 5 * time.Second
+)
+
+// DSN is a PostgreSQL connection string.
+//
+// Only ConnString contains the password. String, LogValue and MarshalJSON render
+// the redacted form, so a DSN can be logged or registered with RegisterConfig as is.
+type DSN struct {
+	User            string
+	Password        string
+	Host            string
+	Port            string
+	Database        string
+	SSLMode         string // disable, require, verify-ca, verify-full
+	SSLRootCert     string // CA certificate file for verify-ca/verify-full
+	SSLCert         string // Client certificate file
+	SSLKey          string // Client key file
+	ApplicationName string // Shown in pg_stat_activity
+	ConnectTimeout  time.Duration
+	SearchPath      string
+}
+
+// DSN returns the connection string for the database at host and port.
+// TLS PEM contents must have been written to files (see resolveTLSFiles).
+func (c DBConfig) DSN(host, port string) DSN {
+	dsn := DSN{
+		User:            c.DBUser,
+		Password:        c.DBPassword,
+		Host:            host,
+		Port:            port,
+		Database:        c.DBName,
+		SSLMode:         c.DBSSLMode,
+		SSLRootCert:     c.DBSSLRootCert,
+		SSLCert:         c.DBSSLCert,
+		SSLKey:          c.DBSSLKey,
+		ApplicationName: c.DBApplicationName,
+		ConnectTimeout:  time.Duration(c.DBConnectTimeout) * time.Second,
+		SearchPath:      c.DBSearchPath,
+	}
+	if dsn.Password == "" {
+		dsn.Password = iamPasswordPlaceholder
+	}
+	if dsn.SSLMode == "" {
+		dsn.SSLMode = defaultSSLMode
+	}
+	if dsn.ApplicationName == "" {
+		dsn.ApplicationName = defaultApplicationName
+	}
+	if dsn.ConnectTimeout <= 0 {
+		dsn.ConnectTimeout = defaultConnectTimeout
+	}
+	return dsn
+}
+
+// PrimaryDSN returns the connection string for the primary.
+func (c DBConfig) PrimaryDSN() DSN {
+	return c.DSN(c.DBHost, c.DBPort)
+}
+
+func (d DSN) url() *url.URL {
+	query := url.Values{}
+	query.Set("sslmode", d.SSLMode)
+	if d.SSLRootCert != "" {
+		query.Set("sslrootcert", d.SSLRootCert)
+	}
+	if d.SSLCert != "" {
+		query.Set("sslcert", d.SSLCert)
+	}
+	if d.SSLKey != "" {
+		query.Set("sslkey", d.SSLKey)
+	}
+	if d.ApplicationName != "" {
+		query.Set("application_name", d.ApplicationName)
+	}
+	if d.ConnectTimeout > 0 {
+		// libpq only accepts whole seconds; round up so short timeouts aren't disabled
+		query.Set("connect_timeout", strconv.Itoa(int((d.ConnectTimeout+time.Second-1)/time.Second)))
+	}
+	if d.SearchPath != "" {
+		// Unknown parameters are sent to the server as run-time parameters
+		query.Set("search_path", d.SearchPath)
+	}
+
+	u := &url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(d.Host, d.Port),
+		Path:     "/" + d.Database,
+		RawQuery: query.Encode(),
+	}
+	if d.Password != "" {
+		u.User = url.UserPassword(d.User, d.Password)
+	} else {
+		u.User = url.User(d.User)
+	}
+	return u
+}
+
+// ConnString returns the connection string, including the password, for sql.Open.
+func (d DSN) ConnString() string {
+	return d.url().String()
+}
+
+// String returns the connection string with the password redacted.
+func (d DSN) String() string {
+	return d.url().Redacted()
+}
+
+// LogValue logs the redacted connection string.
+func (d DSN) LogValue() slog.Value {
+	return slog.StringValue(d.String())
+}
+
+// MarshalJSON renders the redacted connection string.
+func (d DSN) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// dsnConfig is the /debug/config view of the connection strings in use.
+type dsnConfig struct {
+	Primary  DSN   `json:"primary"`
+	Replicas []DSN `json:"replicas,omitempty"`
+}
+
+// RegisterDBConfig makes config and its (redacted) connection strings visible on /debug/config.
+func RegisterDBConfig(config DBConfig) {
+	RegisterConfig("db", config)
+
+	dsns := dsnConfig{Primary: config.PrimaryDSN()}
+	for _, ep := range config.ReadReplicas() {
+		dsns.Replicas = append(dsns.Replicas, config.DSN(ep.Host, ep.Port))
+	}
+	RegisterConfig("db_dsn", dsns)
+}
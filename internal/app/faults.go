@@ -0,0 +1,367 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Fault injection.
+//
+// The chaos suite (test/chaos) simulates failures with sqlmock, which can't exercise
+// the circuit breaker or replica fallback of a deployed canary. The fault injector
+// lets operators inject failures into a running instance through the admin server:
+// - Store operations: "todos.list.replica", "todos.list.primary", "todos.add",
+//   "todos.update", "todos.delete" (a rule matches by prefix, so "todos.list" matches both reads)
+// - HTTP routes: by path prefix and optional method
+//
+// Faults are only injectable when enabled by configuration (FAULT_INJECTION_ENABLED=true)
+// and every rule expires automatically, so a forgotten experiment can't outlive its TTL.
+
+// FaultKind is the type of failure to inject.
+type FaultKind string
+
+const (
+	FaultLatency    FaultKind = "latency"    // Delay the operation by Latency
+	FaultError      FaultKind = "error"      // Fail the operation (routes: respond with Status)
+	FaultConnection FaultKind = "connection" // Simulate a broken connection
+)
+
+const (
+	defaultFaultTTL = 5 * time.Minute
+	maxFaultTTL     = time.Hour
+)
+
+var FaultsInjectedTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "faults_injected_total",
+		Help: "Faults injected by the fault injection subsystem",
+	},
+	[]string{"kind", "target"},
+)
+
+// FaultRule describes one injected fault. Exactly one of Operation or Route is set.
+type FaultRule struct {
+	ID        string        `json:"id"`
+	Operation string        `json:"operation,omitempty"`
+	Route     string        `json:"route,omitempty"`
+	Method    string        `json:"method,omitempty"`
+	Kind      FaultKind     `json:"kind"`
+	Percent   float64       `json:"percent"`
+	Latency   time.Duration `json:"-"`
+	Status    int           `json:"status,omitempty"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// MarshalJSON renders Latency as a duration string.
+func (f FaultRule) MarshalJSON() ([]byte, error) {
+	type rule FaultRule
+	return json.Marshal(struct {
+		rule
+		Latency string `json:"latency,omitempty"`
+	}{rule(f), durationString(f.Latency)})
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func (f *FaultRule) target() string {
+	if f.Operation != "" {
+		return "op:" + f.Operation
+	}
+	return "route:" + f.Route
+}
+
+func (f *FaultRule) fires() bool {
+	return rand.Float64()*100 < f.Percent
+}
+
+// FaultInjector holds the active fault rules.
+type FaultInjector struct {
+	mu      sync.Mutex
+	enabled bool
+	nextID  int
+	rules   map[string]*FaultRule
+}
+
+// NewFaultInjector creates a disabled fault injector.
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{rules: map[string]*FaultRule{}}
+}
+
+// Faults is the application's fault injector. It is disabled unless Enable is called.
+var Faults = NewFaultInjector()
+
+// Enable allows rules to be added.
+func (f *FaultInjector) Enable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled = true
+	slog.Warn("Fault injection is ENABLED; faults can be injected through the admin server")
+}
+
+// Enabled reports whether fault injection is allowed.
+func (f *FaultInjector) Enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled
+}
+
+// Add validates and installs a rule, returning it with its id and expiry set.
+func (f *FaultInjector) Add(rule FaultRule, ttl time.Duration) (FaultRule, error) {
+	if (rule.Operation == "") == (rule.Route == "") {
+		return FaultRule{}, fmt.Errorf("exactly one of operation or route must be set")
+	}
+	switch rule.Kind {
+	case FaultLatency:
+		if rule.Latency <= 0 {
+			return FaultRule{}, fmt.Errorf("latency faults need a positive latency")
+		}
+	case FaultError:
+		if rule.Status == 0 {
+			rule.Status = http.StatusInternalServerError
+		}
+		if rule.Status < 400 || rule.Status > 599 {
+			return FaultRule{}, fmt.Errorf("status must be a 4xx or 5xx code")
+		}
+	case FaultConnection:
+	default:
+		return FaultRule{}, fmt.Errorf("unknown fault kind %q", rule.Kind)
+	}
+	if rule.Percent <= 0 || rule.Percent > 100 {
+		return FaultRule{}, fmt.Errorf("percent must be in (0, 100]")
+	}
+	if ttl <= 0 {
+		ttl = defaultFaultTTL
+	}
+	if ttl > maxFaultTTL {
+		ttl = maxFaultTTL
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return FaultRule{}, fmt.Errorf("fault injection is disabled")
+	}
+	f.nextID++
+	rule.ID = strconv.Itoa(f.nextID)
+	rule.Method = strings.ToUpper(rule.Method)
+	rule.ExpiresAt = time.Now().Add(ttl)
+	f.rules[rule.ID] = &rule
+
+	slog.Warn("Fault rule added", "id", rule.ID, "target", rule.target(), "kind", rule.Kind,
+		"percent", rule.Percent, "expires_at", rule.ExpiresAt)
+	return rule, nil
+}
+
+// Remove deletes a rule by id, or all rules if id is empty.
+func (f *FaultInjector) Remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id == "" {
+		f.rules = map[string]*FaultRule{}
+	} else {
+		delete(f.rules, id)
+	}
+	slog.Warn("Fault rules removed", "id", id)
+}
+
+// Rules returns the active rules, dropping expired ones.
+func (f *FaultInjector) Rules() []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expireLocked(time.Now())
+
+	rules := make([]FaultRule, 0, len(f.rules))
+	for _, r := range f.rules {
+		rules = append(rules, *r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ExpiresAt.Before(rules[j].ExpiresAt) })
+	return rules
+}
+
+func (f *FaultInjector) expireLocked(now time.Time) {
+	for id, r := range f.rules {
+		if now.After(r.ExpiresAt) {
+			slog.Info("Fault rule expired", "id", id, "target", r.target())
+			delete(f.rules, id)
+		}
+	}
+}
+
+// match returns the rules that apply, or nil when nothing is injected.
+func (f *FaultInjector) match(pred func(*FaultRule) bool) []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.rules) == 0 {
+		return nil
+	}
+	f.expireLocked(time.Now())
+
+	var matched []FaultRule
+	for _, r := range f.rules {
+		if pred(r) {
+			matched = append(matched, *r)
+		}
+	}
+	return matched
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Inject applies matching rules to the store operation op.
+// It returns a non-nil error if the operation should fail.
+func (f *FaultInjector) Inject(ctx context.Context, op string) error {
+	rules := f.match(func(r *FaultRule) bool {
+		return r.Operation != "" && strings.HasPrefix(op, r.Operation)
+	})
+
+	for _, r := range rules {
+		if !r.fires() {
+			continue
+		}
+		FaultsInjectedTotal.WithLabelValues(string(r.Kind), r.target()).Inc()
+		switch r.Kind {
+		case FaultLatency:
+			if err := sleepContext(ctx, r.Latency); err != nil {
+				return err
+			}
+		case FaultError:
+			return fmt.Errorf("injected fault %s on %s", r.ID, op)
+		case FaultConnection:
+			return fmt.Errorf("injected fault %s on %s: %w", r.ID, op, driver.ErrBadConn)
+		}
+	}
+	return nil
+}
+
+// FaultInjectionMiddleware applies matching route rules to requests.
+func FaultInjectionMiddleware(f *FaultInjector) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rules := f.match(func(rule *FaultRule) bool {
+				return rule.Route != "" && strings.HasPrefix(r.URL.Path, rule.Route) &&
+					(rule.Method == "" || rule.Method == r.Method)
+			})
+
+			for _, rule := range rules {
+				if !rule.fires() {
+					continue
+				}
+				FaultsInjectedTotal.WithLabelValues(string(rule.Kind), rule.target()).Inc()
+				switch rule.Kind {
+				case FaultLatency:
+					if err := sleepContext(r.Context(), rule.Latency); err != nil {
+						return
+					}
+				case FaultError:
+					WriteProblem(w, r, rule.Status, http.StatusText(rule.Status), "Injected fault "+rule.ID+".")
+					return
+				case FaultConnection:
+					// Aborts the response and closes the connection without logging a panic
+					panic(http.ErrAbortHandler)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// faultRuleRequest is the body accepted by FaultsHandler.
+type faultRuleRequest struct {
+	Operation string    `json:"operation"`
+	Route     string    `json:"route"`
+	Method    string    `json:"method"`
+	Kind      FaultKind `json:"kind"`
+	Percent   float64   `json:"percent"`
+	Latency   string    `json:"latency"` // e.g. "250ms"
+	Status    int       `json:"status"`
+	TTL       string    `json:"ttl"` // e.g. "5m", default 5m, max 1h
+}
+
+// FaultsHandler manages fault rules on the admin server:
+//
+//	GET    /debug/faults          list active rules
+//	POST   /debug/faults          add a rule (faultRuleRequest JSON body)
+//	DELETE /debug/faults?id=N     remove a rule (all rules without id)
+func FaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !Faults.Enabled() {
+		http.Error(w, "Fault injection is disabled (set FAULT_INJECTION_ENABLED=true)", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, Faults.Rules())
+	case http.MethodPost:
+		var req faultRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule := FaultRule{
+			Operation: req.Operation,
+			Route:     req.Route,
+			Method:    req.Method,
+			Kind:      req.Kind,
+			Percent:   req.Percent,
+			Status:    req.Status,
+		}
+		var ttl time.Duration
+		var err error
+		if req.Latency != "" {
+			if rule.Latency, err = time.ParseDuration(req.Latency); err != nil {
+				http.Error(w, "Invalid latency: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.TTL != "" {
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				http.Error(w, "Invalid ttl: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		added, err := Faults.Add(rule, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeAdminJSON(w, added)
+	case http.MethodDelete:
+		Faults.Remove(r.URL.Query().Get("id"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,253 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Hedged reads.
+//
+// Without hedging, a slow-but-alive read replica adds its full latency to the tail,
+// because the primary is only tried after the replica returns an error.
+// With hedging enabled, if the replica hasn't answered within the configured
+// percentile of its recent latency, the same read is sent to the primary and
+// the first successful result wins; the other query is cancelled.
+//
+// Hedges are capped by a budget (a fraction of all reads) so a replica that is
+// slow across the board can't double the load on the primary.
+
+var (
+	HedgedReadsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hedged_reads_total",
+			Help: "Reads that were hedged to the primary because the replica was slow",
+		},
+	)
+	HedgedReadsWon = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hedged_reads_won_total",
+			Help: "Hedged reads where the primary answered first",
+		},
+	)
+	HedgesSkippedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hedged_reads_budget_exhausted_total",
+			Help: "Hedges not issued because the hedge budget was exhausted",
+		},
+	)
+)
+
+// HedgeConfig tunes hedged reads.
+type HedgeConfig struct {
+	Enabled     bool
+	Percentile  float64       // Replica latency percentile after which to hedge (e.g. 0.95)
+	MinDelay    time.Duration // Never hedge sooner than this
+	MaxDelay    time.Duration // Always hedge after this, even if the replica is usually slower
+	BudgetRatio float64       // Maximum fraction of reads that may be hedged
+	MaxBurst    float64       // Maximum hedges that can be issued back to back
+	SampleSize  int           // Number of recent replica latencies to keep
+}
+
+// DefaultHedgeConfig keeps hedging off until enabled explicitly.
+var DefaultHedgeConfig = HedgeConfig{
+	Enabled:     false,
+	Percentile:  0.95,
+	MinDelay:    10 * time.Millisecond,
+	MaxDelay:    500 * time.Millisecond,
+	BudgetRatio: 0.1,
+	MaxBurst:    10,
+	SampleSize:  1000,
+}
+
+// Hedger tracks replica latency and the hedge budget.
+type Hedger struct {
+	cfg HedgeConfig
+
+	mu        sync.Mutex
+	latencies []time.Duration // Ring buffer of recent replica latencies
+	next      int
+	filled    bool
+	tokens    float64
+}
+
+// NewHedger creates a Hedger with cfg.
+func NewHedger(cfg HedgeConfig) *Hedger {
+	if cfg.SampleSize < 1 {
+		cfg.SampleSize = 1
+	}
+	return &Hedger{cfg: cfg, latencies: make([]time.Duration, cfg.SampleSize), tokens: cfg.MaxBurst}
+}
+
+// Hedging is used by GetTodos when a distinct read replica is configured.
+var Hedging = NewHedger(DefaultHedgeConfig)
+
+// Enabled reports whether hedging is turned on.
+func (h *Hedger) Enabled() bool {
+	return h.cfg.Enabled
+}
+
+// Observe records a replica latency sample.
+func (h *Hedger) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latencies[h.next] = d
+	h.next = (h.next + 1) % len(h.latencies)
+	if h.next == 0 {
+		h.filled = true
+	}
+}
+
+// Delay is how long to wait for the replica before hedging.
+func (h *Hedger) Delay() time.Duration {
+	h.mu.Lock()
+	n := h.next
+	if h.filled {
+		n = len(h.latencies)
+	}
+	samples := append([]time.Duration(nil), h.latencies[:n]...)
+	h.mu.Unlock()
+
+	if len(samples) == 0 {
+		return h.cfg.MaxDelay
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	d := samples[int(h.cfg.Percentile*float64(len(samples)-1))]
+
+	if d < h.cfg.MinDelay {
+		d = h.cfg.MinDelay
+	}
+	if h.cfg.MaxDelay > 0 && d > h.cfg.MaxDelay {
+		d = h.cfg.MaxDelay
+	}
+	return d
+}
+
+// earn adds budget for one read.
+func (h *Hedger) earn() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens += h.cfg.BudgetRatio
+	if h.tokens > h.cfg.MaxBurst {
+		h.tokens = h.cfg.MaxBurst
+	}
+}
+
+// spend takes budget for one hedge, returning false if there is none left.
+func (h *Hedger) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+type hedgeResult struct {
+	todos   []Todo
+	err     error
+	primary bool
+}
+
+// Read runs query against replica and, if it is slow or fails, against primary.
+// The first successful result is returned; if both fail, the primary's error.
+// report, if set, is called with the outcome of the replica query whenever it
+// completes, also after the read was hedged, so that the replica pool can eject a
+// replica that only fails on slow reads. A replica query cancelled because the
+// primary won, or because ctx is done, isn't reported.
+func (h *Hedger) Read(ctx context.Context, replica, primary *sql.DB, query func(context.Context, *sql.DB) ([]Todo, error),
+	report func(latency time.Duration, err error)) ([]Todo, error) {
+	h.earn()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Cancels the losing query
+
+	results := make(chan hedgeResult, 2)
+	run := func(db *sql.DB, isPrimary bool) {
+		start := time.Now()
+		todos, err := query(ctx, db)
+		// Reported before the result is sent, so a winning replica is never seen as cancelled
+		if !isPrimary && report != nil && ctx.Err() == nil && !errors.Is(err, ErrNoTenant) {
+			report(time.Since(start), err)
+		}
+		results <- hedgeResult{todos: todos, err: err, primary: isPrimary}
+	}
+
+	start := time.Now()
+	go run(replica, false)
+	pending := 1
+
+	timer := time.NewTimer(h.Delay())
+	defer timer.Stop()
+
+	hedged, primaryStarted := false, false
+	var replicaErr, primaryErr error
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.primary {
+					if hedged {
+						HedgedReadsWon.Inc()
+						// The replica took at least this long; keep it as a sample so the delay adapts
+						h.Observe(time.Since(start))
+					}
+				} else {
+					h.Observe(time.Since(start))
+				}
+				return res.todos, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				replicaErr = res.err
+				if errors.Is(res.err, ErrNoTenant) {
+					return nil, res.err // The primary would fail the same way
+				}
+			}
+			if !res.primary && !primaryStarted {
+				// Replica failed outright: plain fallback, not counted against the hedge budget
+				slog.Warn("Read replica failed, falling back to primary", "error", res.err)
+				primaryStarted = true
+				pending++
+				go run(primary, true)
+				continue
+			}
+			if pending == 0 {
+				// The primary's error is the one that matters to the caller and the breaker
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, replicaErr
+			}
+
+		case <-timer.C:
+			if primaryStarted {
+				continue
+			}
+			if !h.spend() {
+				HedgesSkippedTotal.Inc()
+				continue
+			}
+			slog.Debug("Replica slow, hedging read to primary", "delay", time.Since(start).String())
+			HedgedReadsTotal.Inc()
+			hedged, primaryStarted = true, true
+			pending++
+			go run(primary, true)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Adaptive load shedding.
+//
+// When the database slows down, requests pile up for the whole RetryOperation budget
+// and exhaust goroutines and connections before the circuit breaker trips.
+// The AIMD (additive increase, multiplicative decrease) limiter caps the number of
+// in-flight requests and adapts the cap to observed latency:
+// - A request that is fast and succeeds grows the limit by 1/limit (≈ +1 per "window" of requests)
+// - A request that is slow or fails with 5xx shrinks the limit by BackoffRatio
+//
+// Excess load is shed with 503 + Retry-After, lowest priority first.
+
+// Priority orders requests for shedding. Higher priorities are shed last.
+type Priority int
+
+const (
+	PriorityLow      Priority = iota // Reads: cheap to retry, shed first
+	PriorityNormal                   // Writes: user intent that is costly to lose
+	PriorityCritical                 // Probes and sign-in (criticalPaths): never shed
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
+var (
+	ConcurrencyLimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "concurrency_limit",
+			Help: "Current adaptive concurrency limit",
+		},
+	)
+	ConcurrencyInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "concurrency_in_flight",
+			Help: "Requests currently admitted by the concurrency limiter",
+		},
+	)
+	ConcurrencyRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "concurrency_rejected_total",
+			Help: "Requests shed by the concurrency limiter",
+		},
+		[]string{"priority"},
+	)
+)
+
+// LimiterConfig tunes the AIMD limiter.
+type LimiterConfig struct {
+	InitialLimit     int           // Starting limit
+	MinLimit         int           // Limit never drops below this
+	MaxLimit         int           // Limit never grows above this
+	LatencyThreshold time.Duration // Requests slower than this count as congestion
+	BackoffRatio     float64       // Multiplier applied to the limit on congestion (0-1)
+	LowPriorityShare float64       // Fraction of the limit low priority requests may use
+	RetryAfter       time.Duration // Value of the Retry-After header on shed requests
+}
+
+// DefaultLimiterConfig uses the latency SLO threshold as the congestion signal.
+var DefaultLimiterConfig = LimiterConfig{
+	InitialLimit:     20,
+	MinLimit:         2,
+	MaxLimit:         200,
+	LatencyThreshold: 500 * time.Millisecond,
+	BackoffRatio:     0.9,
+	LowPriorityShare: 0.8,
+	RetryAfter:       time.Second,
+}
+
+// AIMDLimiter is an adaptive concurrency limiter.
+type AIMDLimiter struct {
+	cfg LimiterConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+}
+
+// NewAIMDLimiter creates a limiter with cfg.
+func NewAIMDLimiter(cfg LimiterConfig) *AIMDLimiter {
+	if cfg.MinLimit < 1 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit < cfg.MinLimit {
+		cfg.MaxLimit = cfg.MinLimit
+	}
+	if cfg.InitialLimit < cfg.MinLimit || cfg.InitialLimit > cfg.MaxLimit {
+		cfg.InitialLimit = cfg.MinLimit
+	}
+	l := &AIMDLimiter{cfg: cfg, limit: float64(cfg.InitialLimit)}
+	ConcurrencyLimit.Set(l.limit)
+	return l
+}
+
+// Limiter guards the public handlers. It is applied by ConcurrencyLimitMiddleware.
+var Limiter = NewAIMDLimiter(DefaultLimiterConfig)
+
+// Limit returns the current limit.
+func (l *AIMDLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Acquire admits a request of priority p, returning false if it must be shed.
+// Every successful Acquire must be followed by exactly one Release.
+func (l *AIMDLimiter) Acquire(p Priority) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if p < PriorityCritical {
+		capacity := l.limit
+		if p == PriorityLow {
+			capacity *= l.cfg.LowPriorityShare
+		}
+		if float64(l.inFlight) >= capacity {
+			return false
+		}
+	}
+	l.inFlight++
+	ConcurrencyInFlight.Set(float64(l.inFlight))
+	return true
+}
+
+// Release returns a slot and adapts the limit to how the request went.
+// Critical requests don't influence the limit, they only hold a slot.
+func (l *AIMDLimiter) Release(p Priority, latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	ConcurrencyInFlight.Set(float64(l.inFlight))
+	if p == PriorityCritical {
+		return
+	}
+
+	if failed || latency > l.cfg.LatencyThreshold {
+		l.limit *= l.cfg.BackoffRatio
+		if l.limit < float64(l.cfg.MinLimit) {
+			l.limit = float64(l.cfg.MinLimit)
+		}
+	} else {
+		l.limit += 1 / l.limit
+		if l.limit > float64(l.cfg.MaxLimit) {
+			l.limit = float64(l.cfg.MaxLimit)
+		}
+	}
+	ConcurrencyLimit.Set(l.limit)
+}
+
+// criticalPaths are never shed: probes, so that an overloaded pod isn't
+// restarted or taken out of the Service, and the sign-in and sign-out flow.
+// Other /auth/ endpoints (e.g. /auth/me) are ordinary reads. Paths ending in / are prefixes.
+var criticalPaths = []string{"/healthz", "/readyz", "/auth/login", "/auth/callback", "/auth/logout"}
+
+// RequestPriority classifies requests for the limiter: criticalPaths are
+// critical, and everything else is sheddable, reads (low) before writes (normal).
+// New endpoints are sheddable unless they are added to criticalPaths.
+func RequestPriority(r *http.Request) Priority {
+	for _, path := range criticalPaths {
+		if r.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path)) {
+			return PriorityCritical
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return PriorityLow
+	}
+	return PriorityNormal
+}
+
+// ConcurrencyLimitMiddleware sheds requests that exceed the adaptive limit of l
+// with 503 Service Unavailable and a Retry-After header.
+func ConcurrencyLimitMiddleware(l *AIMDLimiter) Middleware {
+	retryAfter := strconv.Itoa(int(l.cfg.RetryAfter.Seconds()))
+	if retryAfter == "0" {
+		retryAfter = "1"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := RequestPriority(r)
+			if !l.Acquire(p) {
+				ConcurrencyRejected.WithLabelValues(p.String()).Inc()
+				slog.Warn("Request shed by concurrency limiter", "path", r.URL.Path, "method", r.Method,
+					"priority", p.String(), "limit", l.Limit(), "request_id", RequestIDFromContext(r.Context()))
+				w.Header().Set("Retry-After", retryAfter)
+				WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "The server is overloaded, please retry later.")
+				return
+			}
+
+			start := time.Now()
+			rw := NewResponseWriter(w)
+			completed := false
+			defer func() {
+				// A panicking handler hasn't written its status yet (RecoveryMiddleware
+				// turns it into a 500 further out), so it is a failure too
+				l.Release(p, time.Since(start), !completed || rw.StatusCode >= 500)
+			}()
+			next.ServeHTTP(rw, r)
+			completed = true
+		})
+	}
+}
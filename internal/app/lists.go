@@ -0,0 +1,728 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shared lists.
+//
+// Todos belong to lists, and users see and change todos through their list
+// membership (list_members). Roles:
+// - viewer: read the list's todos
+// - editor: also add, complete and delete todos
+// - owner: also manage members and delete the list
+//
+// Every user has a personal list ("My todos"), created on first use, which is
+// where todos go when no list is given. Personal lists can't be shared or deleted.
+// Members are invited by user id, or by email: an email that doesn't belong to a
+// user yet becomes an invitation, which is accepted when that user signs in.
+//
+// The membership checks are part of the todo queries themselves (see app.go),
+// so no endpoint can read or change a todo without them.
+
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+
+	personalListName = "My todos"
+)
+
+var (
+	// ErrNotFound is returned for lists and todos that don't exist or that the user isn't a member of.
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the user's role doesn't allow the operation.
+	ErrForbidden = errors.New("forbidden")
+	// errLastOwner is returned when a change would leave a list without an owner.
+	errLastOwner = errors.New("a list must keep at least one owner")
+	// errUserNotFound is returned when adding a user id that doesn't exist.
+	errUserNotFound = errors.New("user not found")
+	// errListNotEmpty is returned when deleting a list that still has todos outside the trash.
+	errListNotEmpty = errors.New("list has todos")
+)
+
+// roleRank orders roles by what they allow.
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// List is a todo list as seen by one of its members.
+type List struct {
+	ID          int64            `json:"id"`
+	Name        string           `json:"name"`
+	Personal    bool             `json:"personal"`
+	Role        string           `json:"role"` // Role of the requesting user
+	CreatedAt   time.Time        `json:"created_at"`
+	Members     []ListMember     `json:"members,omitempty"`
+	Invitations []ListInvitation `json:"invitations,omitempty"`
+}
+
+// ListMember is a user's membership of a list.
+type ListMember struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email,omitempty"`
+	Role   string `json:"role"`
+}
+
+// ListInvitation is a pending invitation for an email without a user.
+type ListInvitation struct {
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ===== STORE =====
+//
+// All queries run in tenant transactions (inTenant), so they only see the
+// request tenant's lists.
+
+// personalLists caches personal list ids by user id; they never change, so
+// entries are only dropped to stay within MaxEntries. User ids are unique across tenants.
+var personalLists = newCredentialCache[int64](AuthCacheConfig{
+	TTL:        personalListCacheTTL,
+	MaxStale:   personalListCacheTTL,
+	MaxEntries: 10000,
+})
+
+const personalListCacheTTL = 24 * time.Hour
+
+// PersonalListID returns the user's personal list, creating it on first use.
+func PersonalListID(ctx context.Context, userID int64) (int64, error) {
+	key := strconv.FormatInt(userID, 10)
+	if id, ok := personalLists.fresh(key); ok {
+		return id, nil
+	}
+
+	var id int64
+	err := ExecuteWithRobustness(func() error {
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(ctx,
+				`INSERT INTO lists (name, created_by, personal) VALUES ($1, $2, true)
+				 ON CONFLICT (created_by) WHERE personal DO NOTHING RETURNING id`, personalListName, userID).Scan(&id)
+			if errors.Is(err, sql.ErrNoRows) {
+				// Created earlier (or concurrently, in which case this waited for it)
+				return tx.QueryRowContext(ctx, "SELECT id FROM lists WHERE created_by = $1 AND personal", userID).Scan(&id)
+			}
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, 'owner')", id, userID)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	personalLists.put(key, id, time.Now().Add(personalListCacheTTL))
+	return id, nil
+}
+
+// listRole returns the user's role on the list, or "" if the user isn't a member.
+func listRole(ctx context.Context, userID, listID int64) (string, error) {
+	var role string
+	err := ExecuteWithRobustness(func() error {
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			var err error
+			role, err = txListRole(ctx, tx, userID, listID)
+			return err
+		})
+	})
+	return role, err
+}
+
+// txListRole is listRole within tx.
+func txListRole(ctx context.Context, tx *sql.Tx, userID, listID int64) (string, error) {
+	var role string
+	err := tx.QueryRowContext(ctx,
+		"SELECT role FROM list_members WHERE list_id = $1 AND user_id = $2", listID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// requireListRole returns ErrNotFound if the user isn't a member of the list and
+// ErrForbidden if the user's role is lower than min.
+func requireListRole(ctx context.Context, userID, listID int64, min string) error {
+	role, err := listRole(ctx, userID, listID)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrNotFound
+	}
+	if roleRank[role] < roleRank[min] {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// todoAccessError explains why a todo mutation scoped to the user's lists
+// changed nothing: ErrForbidden if the user can only view the todo's list,
+// ErrNotFound otherwise (including when the todo is, or for a restore isn't, trashed).
+func todoAccessError(ctx context.Context, userID int64, todoID int, trashed bool) error {
+	var role string
+	err := ExecuteWithRobustness(func() error {
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(ctx,
+				`SELECT m.role FROM todos t JOIN list_members m ON m.list_id = t.list_id
+				 WHERE t.id = $1 AND m.user_id = $2 AND (t.deleted_at IS NOT NULL) = $3`, todoID, userID, trashed).Scan(&role)
+			if errors.Is(err, sql.ErrNoRows) {
+				role = ""
+				return nil
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrNotFound
+	}
+	return ErrForbidden
+}
+
+// CreateList creates a shared list owned by the user.
+func CreateList(ctx context.Context, userID int64, name string) (*List, error) {
+	l := &List{Name: name, Role: RoleOwner}
+	err := ExecuteWithRobustness(func() error {
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			if err := tx.QueryRowContext(ctx,
+				"INSERT INTO lists (name, created_by) VALUES ($1, $2) RETURNING id, created_at", name, userID).
+				Scan(&l.ID, &l.CreatedAt); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, 'owner')", l.ID, userID)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// UserLists returns the lists the user is a member of.
+func UserLists(ctx context.Context, userID int64) ([]List, error) {
+	var lists []List
+	err := ExecuteWithRobustness(func() error {
+		lists = []List{}
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx,
+				`SELECT l.id, l.name, l.personal, m.role, l.created_at
+				 FROM lists l JOIN list_members m ON m.list_id = l.id
+				 WHERE m.user_id = $1 ORDER BY l.personal DESC, l.id`, userID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var l List
+				if err := rows.Scan(&l.ID, &l.Name, &l.Personal, &l.Role, &l.CreatedAt); err != nil {
+					return err
+				}
+				lists = append(lists, l)
+			}
+			return rows.Err()
+		})
+	})
+	return lists, err
+}
+
+// GetList returns a list with its members and invitations. Any member may read it.
+func GetList(ctx context.Context, userID, listID int64) (*List, error) {
+	var l *List
+	err := ExecuteWithRobustness(func() error {
+		l = &List{ID: listID}
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(ctx,
+				`SELECT l.name, l.personal, m.role, l.created_at
+				 FROM lists l JOIN list_members m ON m.list_id = l.id
+				 WHERE l.id = $1 AND m.user_id = $2`, listID, userID).
+				Scan(&l.Name, &l.Personal, &l.Role, &l.CreatedAt)
+			if errors.Is(err, sql.ErrNoRows) {
+				l = nil
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			rows, err := tx.QueryContext(ctx,
+				`SELECT m.user_id, COALESCE(u.email, ''), m.role
+				 FROM list_members m JOIN users u ON u.id = m.user_id
+				 WHERE m.list_id = $1 ORDER BY m.user_id`, listID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var m ListMember
+				if err := rows.Scan(&m.UserID, &m.Email, &m.Role); err != nil {
+					return err
+				}
+				l.Members = append(l.Members, m)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			rows, err = tx.QueryContext(ctx,
+				"SELECT email, role, created_at FROM list_invitations WHERE list_id = $1 ORDER BY email", listID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var i ListInvitation
+				if err := rows.Scan(&i.Email, &i.Role, &i.CreatedAt); err != nil {
+					return err
+				}
+				l.Invitations = append(l.Invitations, i)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, ErrNotFound
+	}
+	return l, nil
+}
+
+// DeleteList deletes a shared list. Only owners may delete a list, and only once
+// its todos are in the trash, so no todo is deleted without passing through it.
+// The trashed todos are deleted with the list; their deletions are recorded in
+// the audit log.
+func DeleteList(ctx context.Context, userID, listID int64) error {
+	var result error
+	err := ExecuteWithRobustness(func() error {
+		result = nil
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			denied, err := lockSharedList(ctx, tx, userID, listID, RoleOwner)
+			if err != nil || denied != nil {
+				result = denied
+				return err
+			}
+
+			rows, err := tx.QueryContext(ctx,
+				"SELECT "+todoColumns+" FROM todos t WHERE t.list_id = $1 ORDER BY t.id FOR UPDATE", listID)
+			if err != nil {
+				return err
+			}
+			var todos []Todo
+			for rows.Next() {
+				t, err := scanTodo(rows)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				todos = append(todos, *t)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for _, t := range todos {
+				if t.DeletedAt == nil {
+					result = errListNotEmpty
+					return nil
+				}
+			}
+			for i := range todos {
+				if err := recordTodoEvent(ctx, tx, TodoEventDelete, &todos[i], nil); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.ExecContext(ctx, "DELETE FROM lists WHERE id = $1", listID)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// lockSharedList locks the list row for a change by userID, who needs at least
+// role min, in the transaction that makes the change, so neither the list nor the
+// role can change in between. The first result is why the change is denied:
+// ErrNotFound if the list doesn't exist (or was just deleted) or the user isn't a
+// member, ErrForbidden for a lower role or a personal list. The second is a
+// database error.
+func lockSharedList(ctx context.Context, tx *sql.Tx, userID, listID int64, min string) (denied, err error) {
+	var personal bool
+	err = tx.QueryRowContext(ctx, "SELECT personal FROM lists WHERE id = $1 FOR UPDATE", listID).Scan(&personal)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	role, err := txListRole(ctx, tx, userID, listID)
+	switch {
+	case err != nil:
+		return nil, err
+	case role == "":
+		return ErrNotFound, nil
+	case roleRank[role] < roleRank[min] || personal:
+		return ErrForbidden, nil
+	}
+	return nil, nil
+}
+
+// SetMember adds a user to the list or changes the user's role. Only owners may
+// manage members, and only users of the same tenant can be added.
+func SetMember(ctx context.Context, userID, listID, memberID int64, role string) error {
+	var result error
+	err := ExecuteWithRobustness(func() error {
+		result = nil
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			denied, err := lockSharedList(ctx, tx, userID, listID, RoleOwner)
+			if err != nil || denied != nil {
+				result = denied
+				return err
+			}
+			result, err = setMember(ctx, tx, listID, memberID, role)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// setMember is SetMember within tx, after lockSharedList. It returns why the
+// change is denied, and database errors.
+func setMember(ctx context.Context, tx *sql.Tx, listID, memberID int64, role string) (denied, err error) {
+	if role != RoleOwner {
+		if last, err := isLastOwner(ctx, tx, listID, memberID); err != nil || last {
+			return errLastOwner, err
+		}
+	}
+	// Only users of the same tenant can be members
+	tenant, _ := TenantFromContext(ctx) // Set, or inTenant would have failed
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND tenant_id = $2)", memberID, tenant).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return errUserNotFound, nil
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)
+		 ON CONFLICT (list_id, user_id) DO UPDATE SET role = EXCLUDED.role`, listID, memberID, role)
+	return nil, err
+}
+
+// InviteMember adds the user with email to the list, or records an invitation if
+// there is no such user in the tenant yet. It reports whether the user was added directly.
+// Invitations can only be claimed by users of the same tenant.
+func InviteMember(ctx context.Context, userID, listID int64, email, role string) (bool, error) {
+	var (
+		added  bool
+		result error
+	)
+	err := ExecuteWithRobustness(func() error {
+		added, result = false, nil
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			denied, err := lockSharedList(ctx, tx, userID, listID, RoleOwner)
+			if err != nil || denied != nil {
+				result = denied
+				return err
+			}
+			tenant, _ := TenantFromContext(ctx)
+			var memberID int64
+			err = tx.QueryRowContext(ctx,
+				"SELECT id FROM users WHERE lower(email) = lower($1) AND tenant_id = $2 ORDER BY id LIMIT 1",
+				email, tenant).Scan(&memberID)
+			if err == nil {
+				added = true
+				result, err = setMember(ctx, tx, listID, memberID, role)
+				return err
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO list_invitations (list_id, email, role, invited_by) VALUES ($1, lower($2), $3, $4)
+				 ON CONFLICT (list_id, email) DO UPDATE SET role = EXCLUDED.role`, listID, email, role, userID)
+			return err
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	return added, result
+}
+
+// RemoveMember removes a user from the list. Owners may remove anyone; other
+// members may only leave.
+func RemoveMember(ctx context.Context, userID, listID, memberID int64) error {
+	min := RoleOwner
+	if memberID == userID {
+		min = RoleViewer
+	}
+	var result error
+	err := ExecuteWithRobustness(func() error {
+		result = nil
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			denied, err := lockSharedList(ctx, tx, userID, listID, min)
+			if err != nil || denied != nil {
+				result = denied
+				return err
+			}
+			if last, err := isLastOwner(ctx, tx, listID, memberID); err != nil || last {
+				result = errLastOwner
+				return err
+			}
+			res, err := tx.ExecContext(ctx, "DELETE FROM list_members WHERE list_id = $1 AND user_id = $2", listID, memberID)
+			if err != nil {
+				return err
+			}
+			if found, err := rowsAffected(res); err != nil || !found {
+				result = ErrNotFound
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// isLastOwner reports whether memberID is the list's only owner.
+// The list row must be locked (lockSharedList).
+func isLastOwner(ctx context.Context, tx *sql.Tx, listID, memberID int64) (bool, error) {
+	var isOwner bool
+	var owners int
+	err := tx.QueryRowContext(ctx,
+		`SELECT COALESCE(bool_or(user_id = $2), false), count(*)
+		 FROM list_members WHERE list_id = $1 AND role = 'owner'`, listID, memberID).Scan(&isOwner, &owners)
+	return isOwner && owners == 1, err
+}
+
+// ClaimInvitations turns pending invitations for a verified email into
+// memberships. Only invitations of the context's tenant are claimed.
+func ClaimInvitations(ctx context.Context, userID int64, email string) error {
+	if email == "" {
+		return nil
+	}
+	return ExecuteWithRobustness(func() error {
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx,
+				`WITH claimed AS (
+				   DELETE FROM list_invitations WHERE email = lower($2) RETURNING list_id, role
+				 )
+				 INSERT INTO list_members (list_id, user_id, role) SELECT list_id, $1, role FROM claimed
+				 ON CONFLICT (list_id, user_id) DO NOTHING`, userID, email)
+			return err
+		})
+	})
+}
+
+// ===== HANDLERS =====
+
+// writeListError maps store errors to responses.
+func writeListError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		WriteProblem(w, r, http.StatusNotFound, "Not Found", "List not found.")
+	case errors.Is(err, ErrForbidden):
+		WriteProblem(w, r, http.StatusForbidden, "Forbidden", "Your role on this list doesn't allow this. Personal lists can't be shared or deleted.")
+	case errors.Is(err, errUserNotFound):
+		WriteProblem(w, r, http.StatusNotFound, "Not Found", "User not found.")
+	case errors.Is(err, errLastOwner):
+		WriteProblem(w, r, http.StatusConflict, "Conflict", "A list must keep at least one owner.")
+	case errors.Is(err, errListNotEmpty):
+		WriteProblem(w, r, http.StatusConflict, "Conflict", "The list still has todos. Move them to the trash first.")
+	case errors.Is(err, ErrNoTenant):
+		writeNoTenant(w, r)
+	default:
+		slog.Error("List operation failed", "error", err, "request_id", RequestIDFromContext(r.Context()))
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not complete the request.")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// HandleLists lists (GET) and creates (POST) lists.
+func HandleLists(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		// Make sure the personal list shows up before the first todo is added
+		if _, err := PersonalListID(r.Context(), principal.UserID); err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		lists, err := UserLists(r.Context(), principal.UserID)
+		if err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, lists)
+	case http.MethodPost:
+		if rejectIfReadOnly(w, r) {
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Invalid JSON body.")
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 200 {
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "name is required (at most 200 characters).")
+			return
+		}
+		l, err := CreateList(r.Context(), principal.UserID, req.Name)
+		if err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, l)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleList serves a single list and its members:
+//
+//	GET    /lists/{id}
+//	DELETE /lists/{id}
+//	POST   /lists/{id}/members            {"user_id": 7, "role": "editor"} or {"email": "...", "role": "viewer"}
+//	DELETE /lists/{id}/members/{user_id}
+func HandleList(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/lists/"):], "/"), "/")
+	listID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid list ID", http.StatusBadRequest)
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		l, err := GetList(r.Context(), principal.UserID, listID)
+		if err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if rejectIfReadOnly(w, r) {
+			return
+		}
+		if err := DeleteList(r.Context(), principal.UserID, listID); err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodPost:
+		if rejectIfReadOnly(w, r) {
+			return
+		}
+		addListMember(w, r, principal, listID)
+	case len(parts) == 3 && parts[1] == "members" && r.Method == http.MethodDelete:
+		if rejectIfReadOnly(w, r) {
+			return
+		}
+		memberID, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if err := RemoveMember(r.Context(), principal.UserID, listID, memberID); err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) <= 3:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func addListMember(w http.ResponseWriter, r *http.Request, principal *Principal, listID int64) {
+	var req struct {
+		UserID int64  `json:"user_id"`
+		Email  string `json:"email"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Invalid JSON body.")
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	switch {
+	case !validRole(req.Role):
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", `role must be "owner", "editor" or "viewer".`)
+		return
+	case (req.UserID == 0) == (req.Email == ""):
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Either user_id or email is required.")
+		return
+	case req.Email != "" && !strings.Contains(req.Email, "@"):
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Invalid email.")
+		return
+	}
+
+	if req.UserID != 0 {
+		if err := SetMember(r.Context(), principal.UserID, listID, req.UserID, req.Role); err != nil {
+			writeListError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListMember{UserID: req.UserID, Role: req.Role})
+		return
+	}
+	added, err := InviteMember(r.Context(), principal.UserID, listID, req.Email, req.Role)
+	if err != nil {
+		writeListError(w, r, err)
+		return
+	}
+	if added {
+		writeJSON(w, http.StatusOK, ListMember{Email: req.Email, Role: req.Role})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, ListInvitation{Email: strings.ToLower(req.Email), Role: req.Role, CreatedAt: time.Now()})
+}
@@ -0,0 +1,382 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// OpenID Connect login.
+//
+// /auth/login redirects to the identity provider with the authorization code flow
+// and PKCE (S256). The per-login state, nonce and PKCE verifier are kept in a
+// short-lived HttpOnly cookie scoped to /auth/callback, so the callback can be
+// served by any pod. /auth/callback checks the state, exchanges the code with the
+// verifier and starts a session (see Sessions).
+//
+// The ID token is received directly from the token endpoint over TLS, so per
+// OpenID Connect Core 3.1.3.7 the TLS server validation stands in for the token
+// signature; the issuer, audience, expiry and nonce claims are still checked.
+// For that reason the issuer must use https, except on loopback addresses
+// (e.g. a mock provider in tests).
+
+// OIDCConfig configures the identity provider.
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"` // e.g. https://todo.example.com/auth/callback
+	Scopes       []string `json:"scopes"`       // Default openid, email, profile
+}
+
+const (
+	loginCookieName = "todo_login"
+	loginCookiePath = "/auth/callback"
+	loginTTL        = 10 * time.Minute
+	clockSkew       = time.Minute
+)
+
+// OIDCProvider runs the login flow against one issuer.
+type OIDCProvider struct {
+	cfg      OIDCConfig
+	sessions *Sessions
+	client   *http.Client
+
+	mu     sync.Mutex
+	oauth2 *oauth2.Config // Set once discovery succeeds
+}
+
+// NewOIDCProvider creates a provider. The issuer's discovery document is fetched
+// on the first login, so an unreachable provider doesn't block startup.
+func NewOIDCProvider(cfg OIDCConfig, sessions *Sessions) (*OIDCProvider, error) {
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid OIDC issuer %q", cfg.Issuer)
+	}
+	if u.Scheme != "https" && !isLoopback(u.Hostname()) {
+		return nil, fmt.Errorf("OIDC issuer must use https: %q", cfg.Issuer)
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC client id and redirect url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{cfg: cfg, sessions: sessions, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// discover fetches the discovery document once.
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery failed: %s", resp.Status)
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid OIDC discovery document: %w", err)
+	}
+	if doc.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery issuer %q doesn't match %q", doc.Issuer, p.cfg.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing endpoints")
+	}
+
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Scopes:       p.cfg.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  doc.AuthorizationEndpoint,
+			TokenURL: doc.TokenEndpoint,
+		},
+	}
+	slog.Info("OIDC provider discovered", "issuer", doc.Issuer)
+	return p.oauth2, nil
+}
+
+// loginState is stored in the login cookie between /auth/login and /auth/callback.
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	ReturnTo string `json:"r"`
+}
+
+// safeReturnTo only allows local paths, so the login can't be used as an open redirect.
+func safeReturnTo(v string) string {
+	if !strings.HasPrefix(v, "/") || strings.HasPrefix(v, "//") || strings.HasPrefix(v, "/\\") {
+		return "/"
+	}
+	return v
+}
+
+// LoginHandler starts the login flow (GET /auth/login?return_to=/path).
+func (p *OIDCProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	config, err := p.discover(r.Context())
+	if err != nil {
+		slog.Error("OIDC login unavailable", "error", err)
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Sign-in is temporarily unavailable.")
+		return
+	}
+
+	state, err1 := randomToken(24)
+	nonce, err2 := randomToken(24)
+	if err := errors.Join(err1, err2); err != nil {
+		WriteProblem(w, r, http.StatusInternalServerError, "Internal Server Error", "")
+		return
+	}
+	login := loginState{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: safeReturnTo(r.URL.Query().Get("return_to")),
+	}
+	value, _ := json.Marshal(login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     loginCookiePath,
+		MaxAge:   int(loginTTL.Seconds()),
+		Secure:   !p.sessions.Cookie.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Sent on the top-level redirect back from the provider
+	})
+
+	authURL := config.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(login.Verifier),
+		oauth2.SetAuthURLParam("nonce", nonce))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// CallbackHandler completes the login flow (GET /auth/callback).
+func (p *OIDCProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := p.readLoginCookie(w, r)
+	if err != nil {
+		slog.Warn("Invalid OIDC callback", "error", err, "request_id", RequestIDFromContext(r.Context()))
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "The sign-in attempt is invalid or expired. Please sign in again.")
+		return
+	}
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		slog.Warn("OIDC provider returned an error", "error", errParam, "description", r.URL.Query().Get("error_description"))
+		WriteProblem(w, r, http.StatusUnauthorized, "Unauthorized", "Sign-in was not completed.")
+		return
+	}
+
+	config, err := p.discover(r.Context())
+	if err != nil {
+		slog.Error("OIDC login unavailable", "error", err)
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Sign-in is temporarily unavailable.")
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, p.client)
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		slog.Warn("OIDC code exchange failed", "error", err)
+		WriteProblem(w, r, http.StatusUnauthorized, "Unauthorized", "Sign-in failed. Please try again.")
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	claims, err := p.verifyIDToken(rawIDToken, login.Nonce, time.Now())
+	if err != nil {
+		slog.Warn("Invalid OIDC ID token", "error", err)
+		WriteProblem(w, r, http.StatusUnauthorized, "Unauthorized", "Sign-in failed. Please try again.")
+		return
+	}
+
+	// Subjects are only unique per issuer
+	subject := claims.Issuer + "#" + claims.Subject
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+	user, err := Users.Ensure(r.Context(), subject, email)
+	if err != nil {
+		slog.Error("Failed to create user", "error", err)
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Sign-in is temporarily unavailable.")
+		return
+	}
+	if err := ClaimInvitations(WithTenant(r.Context(), user.TenantID), user.ID, email); err != nil {
+		// Invitations stay pending and are claimed on the next sign-in
+		slog.Warn("Failed to claim list invitations", "error", err, "user_id", user.ID)
+	}
+	if _, err := p.sessions.Start(w, r, user, subject, email); err != nil {
+		slog.Error("Failed to create session", "error", err)
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Sign-in is temporarily unavailable.")
+		return
+	}
+
+	slog.Info("User signed in", "user_id", user.ID, "tenant_id", user.TenantID, "request_id", RequestIDFromContext(r.Context()))
+	http.Redirect(w, r, login.ReturnTo, http.StatusFound)
+}
+
+// readLoginCookie returns the login state matching the callback's state parameter
+// and clears the cookie, so a login can't be completed twice.
+func (p *OIDCProvider) readLoginCookie(w http.ResponseWriter, r *http.Request) (loginState, error) {
+	var login loginState
+	c, err := r.Cookie(loginCookieName)
+	if err != nil {
+		return login, fmt.Errorf("missing login cookie")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Path:     loginCookiePath,
+		MaxAge:   -1,
+		Secure:   !p.sessions.Cookie.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	data, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return login, fmt.Errorf("malformed login cookie")
+	}
+	if err := json.Unmarshal(data, &login); err != nil {
+		return login, fmt.Errorf("malformed login cookie")
+	}
+	state := r.URL.Query().Get("state")
+	if login.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		return login, fmt.Errorf("state mismatch")
+	}
+	login.ReturnTo = safeReturnTo(login.ReturnTo)
+	return login, nil
+}
+
+// idTokenClaims are the ID token claims used by the login flow.
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedFor string   `json:"azp"`
+	Expiry        int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+}
+
+// audience is the aud claim, which is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// verifyIDToken checks the claims of an ID token received from the token endpoint.
+func (p *OIDCProvider) verifyIDToken(raw, nonce string, now time.Time) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token payload: %w", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+
+	if claims.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+	validAudience := false
+	for _, aud := range claims.Audience {
+		if aud == p.cfg.ClientID {
+			validAudience = true
+		}
+	}
+	if !validAudience || (len(claims.Audience) > 1 && claims.AuthorizedFor != p.cfg.ClientID) {
+		return nil, fmt.Errorf("ID token is not for this client")
+	}
+	if now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	return &claims, nil
+}
+
+// LogoutHandler ends the session (POST /auth/logout).
+func (s *Sessions) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.End(w, r); err != nil {
+		slog.Error("Failed to delete session", "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MeHandler returns the signed-in user (GET /auth/me), or 401.
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Error("Failed to encode principal", "error", err)
+	}
+}
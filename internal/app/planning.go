@@ -0,0 +1,145 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Planning fields.
+//
+// Todos have an optional due date, a priority, markdown notes, and timestamps
+// maintained by the store: created_at, updated_at (last change through
+// PUT /todos/{id}) and completed_at (when completed was last set). GET /todos
+// filters and sorts on them (see parseTodoFilter).
+
+// Todo priorities, lowest first.
+const (
+	TodoPriorityLow    = "low"
+	TodoPriorityNormal = "normal"
+	TodoPriorityHigh   = "high"
+	TodoPriorityUrgent = "urgent"
+)
+
+// priorities are the valid priorities, lowest first; the order is used for sorting.
+var priorities = []string{TodoPriorityLow, TodoPriorityNormal, TodoPriorityHigh, TodoPriorityUrgent}
+
+// Limits of the free text fields of a todo, in bytes.
+const (
+	MaxTaskLength  = 500
+	MaxNotesLength = 10000
+)
+
+// TodoSorts maps the sort keys of GET /todos to their ORDER BY expressions.
+// Todos without a due date or completion time sort last in both directions.
+var TodoSorts = map[string]string{
+	"created_at":   "t.created_at",
+	"updated_at":   "t.updated_at",
+	"due_at":       "t.due_at",
+	"completed_at": "t.completed_at",
+	"priority":     "array_position(ARRAY['low', 'normal', 'high', 'urgent'], t.priority)",
+}
+
+func validPriority(p string) bool {
+	for _, v := range priorities {
+		if p == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTodo checks the user-editable fields of a todo, trimming the task.
+func validateTodo(t *Todo) error {
+	t.Task = strings.TrimSpace(t.Task)
+	switch {
+	case t.Task == "" || len(t.Task) > MaxTaskLength:
+		return fmt.Errorf("task is required (at most %d characters).", MaxTaskLength)
+	case len(t.Notes) > MaxNotesLength:
+		return fmt.Errorf("notes must be at most %d characters.", MaxNotesLength)
+	case !validPriority(t.Priority):
+		return fmt.Errorf("priority must be one of %s.", strings.Join(priorities, ", "))
+	}
+	return nil
+}
+
+// mergeTodo applies the fields of an update request body to a copy of before
+// and validates the result. Fields maintained by the store are kept.
+func mergeTodo(before *Todo, body []byte) (*Todo, error) {
+	t := *before
+	if err := json.Unmarshal(body, &t); err != nil {
+		return nil, err
+	}
+	t.ID, t.ListID = before.ID, before.ListID
+	t.CreatedAt, t.UpdatedAt = before.CreatedAt, before.UpdatedAt
+	t.CompletedAt, t.DeletedAt = before.CompletedAt, before.DeletedAt
+	t.Tags = before.Tags // Changed with /todos/{id}/tags
+	if err := validateTodo(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parsePlanningFilter reads the priority, completed, due_after, due_before and
+// sort parameters of q into f.
+func parsePlanningFilter(f *TodoFilter, q url.Values) error {
+	if v := q.Get("priority"); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			if !validPriority(p) {
+				return fmt.Errorf("priority must be a comma-separated list of %s.", strings.Join(priorities, ", "))
+			}
+			f.Priorities = append(f.Priorities, p)
+		}
+	}
+	if v := q.Get("completed"); v != "" {
+		completed, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("completed must be true or false.")
+		}
+		f.Completed = &completed
+	}
+	for param, dst := range map[string]**time.Time{"due_after": &f.DueAfter, "due_before": &f.DueBefore} {
+		if v := q.Get(param); v != "" {
+			due, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return fmt.Errorf("%s must be an RFC 3339 time, e.g. 2026-01-02T15:04:05Z.", param)
+			}
+			*dst = &due
+		}
+	}
+	if v := q.Get("sort"); v != "" {
+		if _, ok := TodoSorts[strings.TrimPrefix(v, "-")]; !ok {
+			keys := make([]string, 0, len(TodoSorts))
+			for k := range TodoSorts {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return fmt.Errorf("sort must be one of %s, optionally prefixed with - for descending.", strings.Join(keys, ", "))
+		}
+		f.Sort = v
+	}
+	return nil
+}
+
+// todoOrderBy returns the ORDER BY clause of a list query sorted by sort.
+func todoOrderBy(sort string) string {
+	key, desc := strings.CutPrefix(sort, "-")
+	expr, ok := TodoSorts[key]
+	if !ok {
+		return "t.id"
+	}
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+	return expr + " " + dir + " NULLS LAST, t.id"
+}
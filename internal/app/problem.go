@@ -0,0 +1,41 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Problem is an RFC 7807 "problem details" error body.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteProblem writes an application/problem+json response.
+// The request id (if any) is included so users can quote it in bug reports.
+func WriteProblem(w http.ResponseWriter, r *http.Request, status int, title, detail string) {
+	p := Problem{
+		Type:      "about:blank",
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Error("Failed to encode problem response", "error", err)
+	}
+}
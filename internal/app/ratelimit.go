@@ -0,0 +1,293 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Per-client rate limiting.
+//
+// Cloud Armor (terraform/security_policy.tf) only throttles at the edge. The in-app
+// limiter applies token buckets per client and per route policy, so a single user,
+// script or the load generator CronJob can't monopolise the write path.
+//
+// Clients are identified by their authenticated user, or by client IP for requests
+// without credentials. RateLimitMiddleware runs after AuthMiddleware (see
+// dataEndpoint in main.go), so made-up credentials can't buy a fresh bucket:
+// requests with invalid credentials are rejected by AuthMiddleware and counted
+// per client IP against the AuthFailures policy instead.
+// Responses carry the IETF RateLimit-* headers; rejected requests get 429 + Retry-After.
+
+var RateLimitedTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limited_total",
+		Help: "Requests rejected by the per-client rate limiter",
+	},
+	[]string{"policy"},
+)
+
+// RateLimitPolicy is a token bucket: Burst tokens, refilled at Rate tokens per second.
+type RateLimitPolicy struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+// RateLimitRule applies Policy to requests matching Method (empty = any) and PathPrefix.
+// ExceptMethod excludes a method, e.g. to give reads and writes to the same path different policies.
+type RateLimitRule struct {
+	Method       string
+	ExceptMethod string
+	PathPrefix   string
+	Policy       RateLimitPolicy
+}
+
+func (r RateLimitRule) matches(req *http.Request) bool {
+	if r.Method != "" && req.Method != r.Method {
+		return false
+	}
+	if r.ExceptMethod != "" && req.Method == r.ExceptMethod {
+		return false
+	}
+	return strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// Policies of DefaultRateLimitRules. The data endpoints share one read and one
+// write bucket per client; creating API tokens has its own, smaller budget.
+var (
+	DataReadPolicy    = RateLimitPolicy{Name: "data-read", Rate: 20, Burst: 50}
+	DataWritePolicy   = RateLimitPolicy{Name: "data-write", Rate: 5, Burst: 20}
+	TokenCreatePolicy = RateLimitPolicy{Name: "tokens-create", Rate: 0.1, Burst: 5}
+)
+
+// dataPaths are the path prefixes of the data endpoints.
+var dataPaths = []string{"/todos", "/lists", "/tags", "/trash", "/tokens"}
+
+// DefaultRateLimitRules limit the data endpoints; everything else is unlimited.
+var DefaultRateLimitRules = defaultRateLimitRules()
+
+func defaultRateLimitRules() []RateLimitRule {
+	rules := []RateLimitRule{{Method: http.MethodPost, PathPrefix: "/tokens", Policy: TokenCreatePolicy}}
+	for _, path := range dataPaths {
+		rules = append(rules,
+			RateLimitRule{Method: http.MethodGet, PathPrefix: path, Policy: DataReadPolicy},
+			RateLimitRule{ExceptMethod: http.MethodGet, PathPrefix: path, Policy: DataWritePolicy})
+	}
+	return rules
+}
+
+// DefaultAuthFailurePolicy allows a client IP about one request with invalid
+// credentials every 5 seconds, after a burst of 20.
+var DefaultAuthFailurePolicy = RateLimitPolicy{Name: "auth-failures", Rate: 0.2, Burst: 20}
+
+// RateLimitResult is the outcome of taking a token.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until the next token is available (when not allowed)
+}
+
+// RateLimitStore holds bucket state. The in-memory store is per instance;
+// a shared store (e.g. Redis/Memorystore) can implement the same interface to
+// enforce limits across replicas.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimitStore keeps token buckets in process memory.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	idleTTL   time.Duration
+}
+
+// NewMemoryRateLimitStore creates an in-memory store. Buckets idle for longer than
+// idleTTL (by which time they are full anyway) are dropped to bound memory.
+func NewMemoryRateLimitStore(idleTTL time.Duration) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}, idleTTL: idleTTL}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	burst := float64(policy.Burst)
+	bucketKey := policy.Name + "|" + key
+	b, ok := s.buckets[bucketKey]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		s.buckets[bucketKey] = b
+	}
+
+	// Refill
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*policy.Rate)
+		b.last = now
+	}
+
+	res := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else if policy.Rate > 0 {
+		res.RetryAfter = time.Duration((1 - b.tokens) / policy.Rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	if policy.Rate > 0 {
+		res.Reset = time.Duration((burst - b.tokens) / policy.Rate * float64(time.Second))
+	}
+	return res, nil
+}
+
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.idleTTL {
+		return
+	}
+	s.lastSweep = now
+	for k, b := range s.buckets {
+		if now.Sub(b.last) > s.idleTTL {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// RateLimiter applies Rules using Store.
+type RateLimiter struct {
+	Rules []RateLimitRule
+	Store RateLimitStore
+
+	// AuthFailures limits requests with invalid credentials per client IP (see
+	// AllowAuthFailure). A zero Burst disables it.
+	AuthFailures RateLimitPolicy
+
+	// TrustedProxyHops is the number of proxies that append to X-Forwarded-For in
+	// front of the app (2 behind the GKE ingress: client and load balancer entries).
+	// 0 means X-Forwarded-For is ignored and the TCP peer address is used.
+	TrustedProxyHops int
+}
+
+// RateLimit is the application's rate limiter.
+var RateLimit = &RateLimiter{
+	Rules:        DefaultRateLimitRules,
+	Store:        NewMemoryRateLimitStore(10 * time.Minute),
+	AuthFailures: DefaultAuthFailurePolicy,
+}
+
+// ClientIP returns the client address, trusting the last hops entries of X-Forwarded-For.
+func ClientIP(r *http.Request, hops int) string {
+	if hops > 0 {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if i := len(parts) - hops; i >= 0 {
+				if ip := strings.TrimSpace(parts[i]); ip != "" {
+					return ip
+				}
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientKey identifies the client for rate limiting: the authenticated user, or
+// the client IP. Credentials are only trusted once AuthMiddleware has verified
+// them, so the Authorization header itself is never part of the key.
+func (rl *RateLimiter) ClientKey(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		return "user:" + strconv.FormatInt(p.UserID, 10)
+	}
+	return "ip:" + ClientIP(r, rl.TrustedProxyHops)
+}
+
+func (rl *RateLimiter) policyFor(r *http.Request) (RateLimitPolicy, bool) {
+	for _, rule := range rl.Rules {
+		if rule.matches(r) {
+			return rule.Policy, true
+		}
+	}
+	return RateLimitPolicy{}, false
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// take takes a token for r from policy's bucket, writing the RateLimit-* headers
+// and a 429 if the bucket is empty. It returns false if the request was rejected.
+// If the store fails, the request is allowed.
+func (rl *RateLimiter) take(w http.ResponseWriter, r *http.Request, key string, policy RateLimitPolicy) bool {
+	res, err := rl.Store.Take(r.Context(), key, policy, time.Now())
+	if err != nil {
+		slog.Error("Rate limit store failed, allowing request", "error", err, "policy", policy.Name)
+		return true
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(policy.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", ceilSeconds(res.Reset))
+	if policy.Rate > 0 {
+		h.Set("RateLimit-Policy", strconv.Itoa(policy.Burst)+";w="+ceilSeconds(time.Duration(float64(policy.Burst)/policy.Rate*float64(time.Second)))+`;name="`+policy.Name+`"`)
+	}
+
+	if !res.Allowed {
+		RateLimitedTotal.WithLabelValues(policy.Name).Inc()
+		h.Set("Retry-After", ceilSeconds(res.RetryAfter))
+		WriteProblem(w, r, http.StatusTooManyRequests, "Too Many Requests", "Rate limit exceeded for policy "+policy.Name+".")
+		return false
+	}
+	return true
+}
+
+// AllowAuthFailure counts a request with invalid credentials against the
+// AuthFailures policy of its client IP. If the budget is used up it writes a 429
+// and returns false; otherwise the caller answers with 401.
+func (rl *RateLimiter) AllowAuthFailure(w http.ResponseWriter, r *http.Request) bool {
+	if rl == nil || rl.AuthFailures.Burst == 0 {
+		return true
+	}
+	return rl.take(w, r, "ip:"+ClientIP(r, rl.TrustedProxyHops), rl.AuthFailures)
+}
+
+// RateLimitMiddleware rejects requests over their route policy with 429 Too Many Requests.
+// It must run after AuthMiddleware, so that clients are keyed by their verified user.
+// If the store fails, requests are allowed (fail open) so a shared backend outage
+// doesn't take the API down.
+func RateLimitMiddleware(rl *RateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, ok := rl.policyFor(r)
+			if ok && !rl.take(w, r, rl.ClientKey(r), policy) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,283 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Read replica pool.
+//
+// Reads are spread across any number of replicas. A background health checker pings
+// every replica and:
+// - Ejects a replica after EjectAfter consecutive failures (pings or queries)
+// - Re-admits it after ReadmitAfter consecutive successful pings
+//
+// Replicas that are down at boot start ejected and are admitted as soon as they
+// answer, instead of reads being pinned to the primary for the life of the process.
+// When every replica is ejected, reads go to the primary.
+
+var (
+	ReplicaHealthy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "db_replica_healthy",
+			Help: "Whether a read replica is currently admitted (1) or ejected (0)",
+		},
+		[]string{"replica"},
+	)
+	ReplicaEjectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_replica_ejections_total",
+			Help: "Number of times a read replica was ejected from the pool",
+		},
+		[]string{"replica"},
+	)
+)
+
+// Balancing strategies for ReplicaPool.
+const (
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastLatency = "least_latency"
+)
+
+// ReplicaPoolConfig tunes the health checker.
+type ReplicaPoolConfig struct {
+	Balancing     string
+	CheckInterval time.Duration
+	CheckTimeout  time.Duration
+	EjectAfter    int
+	ReadmitAfter  int
+}
+
+// DefaultReplicaPoolConfig checks replicas every 5s.
+var DefaultReplicaPoolConfig = ReplicaPoolConfig{
+	Balancing:     BalanceRoundRobin,
+	CheckInterval: 5 * time.Second,
+	CheckTimeout:  2 * time.Second,
+	EjectAfter:    3,
+	ReadmitAfter:  2,
+}
+
+// Replica is one read replica endpoint.
+type Replica struct {
+	Name string
+	db   *sql.DB
+
+	mu                   sync.Mutex
+	healthy              bool
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	latency              time.Duration // EWMA of ping and query latency
+	lastError            string
+}
+
+// ReplicaPool balances reads across healthy replicas.
+type ReplicaPool struct {
+	cfg      ReplicaPoolConfig
+	replicas []*Replica
+	next     atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Replicas is the read replica pool set up by InitDB (nil when no replica is configured).
+var Replicas *ReplicaPool
+
+// NewReplicaPool creates an empty pool.
+func NewReplicaPool(cfg ReplicaPoolConfig) *ReplicaPool {
+	if cfg.EjectAfter < 1 {
+		cfg.EjectAfter = 1
+	}
+	if cfg.ReadmitAfter < 1 {
+		cfg.ReadmitAfter = 1
+	}
+	return &ReplicaPool{cfg: cfg, stop: make(chan struct{})}
+}
+
+// Add registers a replica. It is admitted only if healthy is true; otherwise the
+// health checker admits it once it answers.
+func (p *ReplicaPool) Add(name string, db *sql.DB, healthy bool) *Replica {
+	r := &Replica{Name: name, db: db, healthy: healthy}
+	p.replicas = append(p.replicas, r)
+	ReplicaHealthy.WithLabelValues(name).Set(boolToFloat(healthy))
+	return r
+}
+
+// Len returns the number of configured replicas, healthy or not.
+func (p *ReplicaPool) Len() int {
+	return len(p.replicas)
+}
+
+// Pick returns a healthy replica, or nil if all are ejected.
+func (p *ReplicaPool) Pick() *Replica {
+	var healthy []*Replica
+	for _, r := range p.replicas {
+		if r.Healthy() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	if p.cfg.Balancing == BalanceLeastLatency {
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.Latency() < best.Latency() {
+				best = r
+			}
+		}
+		return best
+	}
+	return healthy[p.next.Add(1)%uint64(len(healthy))]
+}
+
+// DB returns the replica's connection pool.
+func (r *Replica) DB() *sql.DB {
+	return r.db
+}
+
+// Healthy reports whether the replica is admitted.
+func (r *Replica) Healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.healthy
+}
+
+// Latency returns the smoothed latency of the replica.
+func (r *Replica) Latency() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latency
+}
+
+// report records the outcome of a query or ping against the replica.
+// admitAfter successes are needed to re-admit an ejected replica; queries pass 0
+// so that only health checks can re-admit.
+func (r *Replica) report(latency time.Duration, err error, ejectAfter, admitAfter int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.consecutiveSuccesses = 0
+		r.consecutiveFailures++
+		r.lastError = err.Error()
+		if r.healthy && r.consecutiveFailures >= ejectAfter {
+			r.healthy = false
+			ReplicaHealthy.WithLabelValues(r.Name).Set(0)
+			ReplicaEjectionsTotal.WithLabelValues(r.Name).Inc()
+			slog.Warn("Read replica ejected", "replica", r.Name, "error", err, "consecutive_failures", r.consecutiveFailures)
+		}
+		return
+	}
+
+	r.consecutiveFailures = 0
+	r.consecutiveSuccesses++
+	r.lastError = ""
+	if r.latency == 0 {
+		r.latency = latency
+	} else {
+		r.latency = (r.latency*4 + latency) / 5
+	}
+	if !r.healthy && admitAfter > 0 && r.consecutiveSuccesses >= admitAfter {
+		r.healthy = true
+		ReplicaHealthy.WithLabelValues(r.Name).Set(1)
+		slog.Info("Read replica admitted", "replica", r.Name, "latency", r.latency.String())
+	}
+}
+
+// ReportQuery records the outcome of a read served by r.
+func (p *ReplicaPool) ReportQuery(r *Replica, latency time.Duration, err error) {
+	r.report(latency, err, p.cfg.EjectAfter, 0)
+}
+
+// Check pings every replica once.
+func (p *ReplicaPool) Check(ctx context.Context) {
+	for _, r := range p.replicas {
+		ctx, cancel := context.WithTimeout(ctx, p.cfg.CheckTimeout)
+		start := time.Now()
+		err := r.db.PingContext(ctx)
+		cancel()
+		r.report(time.Since(start), err, p.cfg.EjectAfter, p.cfg.ReadmitAfter)
+	}
+}
+
+// Start runs the health checker until Close is called.
+func (p *ReplicaPool) Start() {
+	go func() {
+		ticker := time.NewTicker(p.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Check(context.Background())
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the health checker and closes all replica connections.
+func (p *ReplicaPool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	for _, r := range p.replicas {
+		if err := r.db.Close(); err != nil {
+			slog.Warn("Failed to close read replica", "replica", r.Name, "error", err)
+		}
+	}
+}
+
+// ReplicaStatus is the JSON view of a replica.
+type ReplicaStatus struct {
+	Name                string `json:"name"`
+	Healthy             bool   `json:"healthy"`
+	Latency             string `json:"latency"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// Status returns the state of every replica.
+func (p *ReplicaPool) Status() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		r.mu.Lock()
+		statuses = append(statuses, ReplicaStatus{
+			Name:                r.Name,
+			Healthy:             r.healthy,
+			Latency:             r.latency.String(),
+			ConsecutiveFailures: r.consecutiveFailures,
+			LastError:           r.lastError,
+		})
+		r.mu.Unlock()
+	}
+	return statuses
+}
+
+// ReplicasHandler reports the replica pool on the admin server.
+func ReplicasHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, replicas := stores()
+	if replicas == nil {
+		writeAdminJSON(w, []ReplicaStatus{})
+		return
+	}
+	writeAdminJSON(w, replicas.Status())
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
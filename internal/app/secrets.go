@@ -0,0 +1,168 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Secret rotation.
+//
+// The database secret is re-read periodically from Secret Manager (or a mounted file).
+// When the DBConfig changes, e.g. a rotated password or a new replica, ReloadDB opens
+// and pings new connection pools before swapping them in. The old pools are closed
+// after DrainTimeout, so requests that already hold them finish normally.
+// If the new configuration can't connect, the old pools stay in use and the
+// change is retried on the next poll.
+
+var SecretReloadsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "db_secret_reloads_total",
+		Help: "Database configuration changes detected in the secret, by result",
+	},
+	[]string{"result"},
+)
+
+// DrainTimeout is how long replaced connection pools are kept open for
+// in-flight requests. It is longer than the server's write timeout.
+var DrainTimeout = 90 * time.Second
+
+// SecretSource returns the raw database secret.
+type SecretSource func(ctx context.Context) (string, error)
+
+// SecretManagerSource reads the latest version of a Secret Manager secret.
+func SecretManagerSource(name string) SecretSource {
+	return func(ctx context.Context) (string, error) {
+		return AccessSecretVersion(name)
+	}
+}
+
+// FileSecretSource reads the secret from a file, e.g. a mounted Kubernetes secret.
+func FileSecretSource(path string) SecretSource {
+	return func(ctx context.Context) (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return string(data), nil
+	}
+}
+
+// LoadDBConfig reads and parses the database secret.
+func LoadDBConfig(ctx context.Context, source SecretSource) (DBConfig, error) {
+	var config DBConfig
+	value, err := source(ctx)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		return config, fmt.Errorf("failed to parse secret JSON: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid database configuration: %w", err)
+	}
+	return config, nil
+}
+
+// SecretWatcher polls a SecretSource and calls OnChange when the DBConfig changes.
+type SecretWatcher struct {
+	source   SecretSource
+	onChange func(DBConfig) error
+	current  DBConfig
+}
+
+// NewSecretWatcher creates a watcher for source, starting from the config in use.
+func NewSecretWatcher(source SecretSource, current DBConfig, onChange func(DBConfig) error) *SecretWatcher {
+	return &SecretWatcher{source: source, onChange: onChange, current: current}
+}
+
+// Poll reads the secret once. It returns true if a changed config was applied.
+// A config that fails to apply is retried on the next poll.
+func (w *SecretWatcher) Poll(ctx context.Context) (bool, error) {
+	config, err := LoadDBConfig(ctx, w.source)
+	if err != nil {
+		return false, err
+	}
+	if reflect.DeepEqual(config, w.current) {
+		return false, nil
+	}
+
+	slog.Info("Database secret changed, reloading connections")
+	if err := w.onChange(config); err != nil {
+		SecretReloadsTotal.WithLabelValues("error").Inc()
+		return false, err
+	}
+	SecretReloadsTotal.WithLabelValues("success").Inc()
+	w.current = config
+	return true, nil
+}
+
+// Run polls every interval until ctx is cancelled.
+func (w *SecretWatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := w.Poll(ctx); err != nil {
+				slog.Error("Failed to reload database secret, keeping current connections", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReloadDB switches to a new database configuration.
+// While the initial connection is still pending it is restarted with config.
+// Otherwise new pools are connected and verified before the current ones are
+// replaced; on error the current pools stay in use.
+func ReloadDB(config DBConfig) error {
+	if storeState.Load() == storeConnecting {
+		stopConnecting()
+		// The loop may have connected just before it was stopped
+		if storeState.Load() == storeConnecting {
+			slog.Info("Restarting database connection with the new configuration")
+			InitDB(config)
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	config, err := config.resolveTLSFiles()
+	if err != nil {
+		return err
+	}
+	dsn := config.PrimaryDSN()
+	slog.Info("Connecting to PRIMARY database with new configuration", "dsn", dsn)
+	primary, err := openPrimary(ctx, dsn.ConnString())
+	if err != nil {
+		return fmt.Errorf("new PRIMARY configuration failed: %w", err)
+	}
+
+	var pool *ReplicaPool
+	if len(config.ReadReplicas()) > 0 {
+		pool = connectReplicas(ctx, config)
+	}
+
+	setStoreTLS(checkTLS(ctx, primary, config))
+	oldPrimary, oldReplicas := setStores(primary, pool)
+	slog.Info("Swapped database connections, draining previous pools", "drain_timeout", DrainTimeout.String())
+	time.AfterFunc(DrainTimeout, func() {
+		closeStores(oldPrimary, oldReplicas)
+	})
+	return nil
+}
@@ -0,0 +1,329 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sessions.
+//
+// A successful login creates a server-side session; the browser only holds a
+// random session id in an HttpOnly cookie. Stores keep a SHA-256 hash of the id,
+// so a leaked sessions table can't be replayed. DBSessionStore is shared by all
+// pods, wrapped in a CachedSessionStore so an outage doesn't sign users out;
+// MemorySessionStore is for tests and single-instance development.
+
+// DefaultSessionTTL is the absolute lifetime of a session.
+const DefaultSessionTTL = 12 * time.Hour
+
+// Session is a signed-in browser session.
+type Session struct {
+	ID        string // Cookie value; only its hash is stored
+	UserID    int64
+	TenantID  int64
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// SessionStore persists sessions.
+type SessionStore interface {
+	// Create stores s.
+	Create(ctx context.Context, s *Session) error
+	// Get returns the unexpired session with id, or nil if there is none.
+	Get(ctx context.Context, id string) (*Session, error)
+	// Delete removes the session with id, if any.
+	Delete(ctx context.Context, id string) error
+}
+
+// newSessionID returns a random, URL-safe session id.
+func newSessionID() (string, error) {
+	return randomToken(32)
+}
+
+// randomToken returns n random bytes, base64url encoded.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret is how session ids and API tokens are stored.
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// ===== MEMORY STORE =====
+
+// MemorySessionStore keeps sessions in process memory.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session // By hashed id
+}
+
+// NewMemorySessionStore creates an empty in-memory store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]Session{}}
+}
+
+func (m *MemorySessionStore) Create(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, existing := range m.sessions {
+		if now.After(existing.ExpiresAt) {
+			delete(m.sessions, key)
+		}
+	}
+	stored := *s
+	stored.ID = ""
+	m.sessions[string(hashSecret(s.ID))] = stored
+	return nil
+}
+
+func (m *MemorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[string(hashSecret(id))]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return nil, nil
+	}
+	s.ID = id
+	return &s, nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, string(hashSecret(id)))
+	return nil
+}
+
+// ===== DATABASE STORE =====
+
+// DBSessionStore keeps sessions in the sessions table of the primary database.
+type DBSessionStore struct{}
+
+func (DBSessionStore) Create(ctx context.Context, s *Session) error {
+	return ExecuteWithRobustness(func() error {
+		// Expired sessions of the user are removed on each login
+		if _, err := primaryDB().ExecContext(ctx,
+			"DELETE FROM sessions WHERE user_id = $1 AND expires_at < now()", s.UserID); err != nil {
+			return err
+		}
+		_, err := primaryDB().ExecContext(ctx,
+			"INSERT INTO sessions (id_hash, user_id, tenant_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+			hashSecret(s.ID), s.UserID, s.TenantID, s.CreatedAt, s.ExpiresAt)
+		return err
+	})
+}
+
+func (DBSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	s := &Session{ID: id}
+	var email sql.NullString
+	err := ExecuteWithRobustness(func() error {
+		err := primaryDB().QueryRowContext(ctx,
+			`SELECT s.user_id, u.tenant_id, u.subject, u.email, s.created_at, s.expires_at
+			 FROM sessions s JOIN users u ON u.id = s.user_id
+			 WHERE s.id_hash = $1 AND s.expires_at > now()`, hashSecret(id)).
+			Scan(&s.UserID, &s.TenantID, &s.Subject, &email, &s.CreatedAt, &s.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			s = nil
+			return nil // Not a failure of the database
+		}
+		return err
+	})
+	if err != nil || s == nil {
+		return nil, err
+	}
+	s.Email = email.String
+	return s, nil
+}
+
+func (DBSessionStore) Delete(ctx context.Context, id string) error {
+	return ExecuteWithRobustness(func() error {
+		_, err := primaryDB().ExecContext(ctx, "DELETE FROM sessions WHERE id_hash = $1", hashSecret(id))
+		return err
+	})
+}
+
+// ===== CACHED STORE =====
+
+// CachedSessionStore remembers the sessions of another store (see AuthCacheConfig),
+// so signed-in users can keep reading while that store is unavailable.
+type CachedSessionStore struct {
+	Store SessionStore
+	cache *credentialCache[Session]
+}
+
+// NewCachedSessionStore wraps store with a cache of validated sessions.
+func NewCachedSessionStore(store SessionStore, config AuthCacheConfig) *CachedSessionStore {
+	return &CachedSessionStore{Store: store, cache: newCredentialCache[Session](config)}
+}
+
+func (c *CachedSessionStore) Create(ctx context.Context, s *Session) error {
+	if err := c.Store.Create(ctx, s); err != nil {
+		return err
+	}
+	c.remember(s)
+	return nil
+}
+
+func (c *CachedSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	key := string(hashSecret(id))
+	if s, ok := c.cache.fresh(key); ok {
+		s.ID = id
+		return &s, nil
+	}
+	s, err := c.Store.Get(ctx, id)
+	if err != nil {
+		cached, ok := c.cache.fallback(key)
+		if !ok {
+			return nil, err
+		}
+		AuthCacheFallbacksTotal.WithLabelValues("session").Inc()
+		slog.Warn("Session store unavailable, using cached session", "error", err, "user_id", cached.UserID)
+		cached.ID = id
+		return &cached, nil
+	}
+	if s == nil {
+		c.cache.remove(key)
+		return nil, nil
+	}
+	c.remember(s)
+	return s, nil
+}
+
+func (c *CachedSessionStore) Delete(ctx context.Context, id string) error {
+	c.cache.remove(string(hashSecret(id)))
+	return c.Store.Delete(ctx, id)
+}
+
+func (c *CachedSessionStore) remember(s *Session) {
+	stored := *s
+	stored.ID = ""
+	c.cache.put(string(hashSecret(s.ID)), stored, s.ExpiresAt)
+}
+
+// ===== COOKIES =====
+
+// SessionCookieConfig controls the session cookie.
+type SessionCookieConfig struct {
+	// Insecure allows the cookie over plain HTTP for local development.
+	// Secure cookies use the __Host- prefix, which binds them to this host and path /.
+	Insecure bool
+	TTL      time.Duration
+}
+
+// Sessions holds the session store and cookie settings used by the login
+// handlers and SessionAuthenticator.
+type Sessions struct {
+	Store  SessionStore
+	Cookie SessionCookieConfig
+}
+
+func (s *Sessions) cookieName() string {
+	if s.Cookie.Insecure {
+		return "todo_session"
+	}
+	return "__Host-todo_session"
+}
+
+func (s *Sessions) ttl() time.Duration {
+	if s.Cookie.TTL <= 0 {
+		return DefaultSessionTTL
+	}
+	return s.Cookie.TTL
+}
+
+// Start creates a session for the user and sets the session cookie.
+func (s *Sessions) Start(w http.ResponseWriter, r *http.Request, user User, subject, email string) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &Session{
+		ID:        id,
+		UserID:    user.ID,
+		TenantID:  user.TenantID,
+		Subject:   subject,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl()),
+	}
+	if err := s.Store.Create(r.Context(), session); err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    id,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		MaxAge:   int(s.ttl().Seconds()),
+		Secure:   !s.Cookie.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session, nil
+}
+
+// End deletes the request's session, if any, and clears the cookie.
+func (s *Sessions) End(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   !s.Cookie.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c, err := r.Cookie(s.cookieName())
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	return s.Store.Delete(r.Context(), c.Value)
+}
+
+// Authenticator resolves the session cookie to a principal.
+func (s *Sessions) Authenticator() Authenticator {
+	return func(r *http.Request) (*Principal, error) {
+		c, err := r.Cookie(s.cookieName())
+		if err != nil || c.Value == "" {
+			return nil, nil
+		}
+		session, err := s.Store.Get(r.Context(), c.Value)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			return nil, ErrUnauthenticated
+		}
+		return &Principal{
+			UserID:   session.UserID,
+			TenantID: session.TenantID,
+			Subject:  session.Subject,
+			Email:    session.Email,
+			Method:   "session",
+		}, nil
+	}
+}
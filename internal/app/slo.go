@@ -0,0 +1,288 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// In-process SLO tracking.
+//
+// The source of truth for SLOs is Cloud Monitoring (terraform/slos.tf), which is not
+// available when running locally or in CI. SLOTracker evaluates the same objectives
+// from this instance's own request stream so burn rates can be observed anywhere:
+// - Availability: 99.9% of requests are not 5xx
+// - Latency: 95% of requests complete within 500ms
+//
+// Burn rate = observed error ratio / allowed error ratio (1 - target).
+// A burn rate of 1 consumes exactly the error budget over the SLO period;
+// the alert policies page at 10x over 1h (fast burn) and warn at 2x over 6h (slow burn).
+
+// BurnRateAlert mirrors a burn-rate alert policy.
+type BurnRateAlert struct {
+	Window    time.Duration
+	Threshold float64
+}
+
+// SLOConfig defines the objectives and the windows they are evaluated over.
+type SLOConfig struct {
+	AvailabilityTarget float64         // Fraction of requests that must not be 5xx
+	LatencyTarget      float64         // Fraction of requests that must be faster than LatencyThreshold
+	LatencyThreshold   time.Duration   // Latency considered "good"
+	Windows            []time.Duration // Rolling windows to report; the longest bounds memory usage
+	Alerts             []BurnRateAlert // Burn-rate alerts to evaluate
+}
+
+// DefaultSLOConfig matches terraform/slos.tf.
+var DefaultSLOConfig = SLOConfig{
+	AvailabilityTarget: 0.999,
+	LatencyTarget:      0.95,
+	LatencyThreshold:   500 * time.Millisecond,
+	Windows:            []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour},
+	Alerts: []BurnRateAlert{
+		{Window: time.Hour, Threshold: 10},    // availability_fast_burn
+		{Window: 6 * time.Hour, Threshold: 2}, // availability_slow_burn
+	},
+}
+
+// sloBucket holds the counts of one minute of traffic.
+type sloBucket struct {
+	minute int64
+	total  uint64
+	errors uint64 // 5xx responses
+	slow   uint64 // responses slower than LatencyThreshold
+}
+
+// SLOTracker keeps per-minute request counts in a ring buffer covering the
+// longest configured window.
+type SLOTracker struct {
+	cfg     SLOConfig
+	started time.Time
+
+	mu      sync.Mutex
+	buckets []sloBucket
+
+	burnRateDesc *prometheus.Desc
+	sliDesc      *prometheus.Desc
+	budgetDesc   *prometheus.Desc
+}
+
+// NewSLOTracker creates a tracker for cfg.
+func NewSLOTracker(cfg SLOConfig) *SLOTracker {
+	longest := time.Minute
+	for _, w := range cfg.Windows {
+		if w > longest {
+			longest = w
+		}
+	}
+	for _, a := range cfg.Alerts {
+		if a.Window > longest {
+			longest = a.Window
+		}
+	}
+
+	return &SLOTracker{
+		cfg:     cfg,
+		started: time.Now(),
+		buckets: make([]sloBucket, int(longest/time.Minute)),
+		burnRateDesc: prometheus.NewDesc("slo_burn_rate",
+			"Error budget burn rate over a rolling window (1 = budget consumed exactly over the SLO period)",
+			[]string{"slo", "window"}, nil),
+		sliDesc: prometheus.NewDesc("slo_sli",
+			"Fraction of good requests over a rolling window",
+			[]string{"slo", "window"}, nil),
+		budgetDesc: prometheus.NewDesc("slo_error_budget_remaining",
+			"Fraction of the error budget left over a rolling window (negative = exhausted)",
+			[]string{"slo", "window"}, nil),
+	}
+}
+
+// SLO tracks the objectives of this instance. It is fed by SLOMiddleware.
+var SLO = NewSLOTracker(DefaultSLOConfig)
+
+func init() {
+	prometheus.MustRegister(SLO)
+}
+
+// Record adds a completed request to the current minute.
+func (t *SLOTracker) Record(status int, duration time.Duration) {
+	t.RecordAt(time.Now(), status, duration)
+}
+
+// RecordAt adds a completed request observed at the given time.
+func (t *SLOTracker) RecordAt(at time.Time, status int, duration time.Duration) {
+	minute := at.Unix() / 60
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[minute%int64(len(t.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if status >= 500 {
+		b.errors++
+	}
+	if duration > t.cfg.LatencyThreshold {
+		b.slow++
+	}
+}
+
+// counts sums the buckets of the last window ending at now.
+func (t *SLOTracker) counts(now time.Time, window time.Duration) (total, errors, slow uint64) {
+	current := now.Unix() / 60
+	minutes := int64(window / time.Minute)
+	if minutes > int64(len(t.buckets)) {
+		minutes = int64(len(t.buckets))
+	}
+
+	for m := current - minutes + 1; m <= current; m++ {
+		b := t.buckets[m%int64(len(t.buckets))]
+		if b.minute == m {
+			total += b.total
+			errors += b.errors
+			slow += b.slow
+		}
+	}
+	return total, errors, slow
+}
+
+// SLIWindow is the state of one objective over one rolling window.
+type SLIWindow struct {
+	Window               string  `json:"window"`
+	Total                uint64  `json:"total"`
+	Good                 uint64  `json:"good"`
+	SLI                  float64 `json:"sli"`
+	BurnRate             float64 `json:"burn_rate"`
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+}
+
+// BurnRateAlertStatus reports whether a burn-rate alert would fire.
+type BurnRateAlertStatus struct {
+	Window    string  `json:"window"`
+	Threshold float64 `json:"threshold"`
+	BurnRate  float64 `json:"burn_rate"`
+	Firing    bool    `json:"firing"`
+}
+
+// ObjectiveSummary is the state of one objective across all windows.
+type ObjectiveSummary struct {
+	Name    string                `json:"name"`
+	Target  float64               `json:"target"`
+	Windows []SLIWindow           `json:"windows"`
+	Alerts  []BurnRateAlertStatus `json:"alerts"`
+}
+
+// SLOSummary is served on /slo.
+type SLOSummary struct {
+	Since            time.Time          `json:"since"`
+	LatencyThreshold string             `json:"latency_threshold"`
+	Objectives       []ObjectiveSummary `json:"objectives"`
+}
+
+func newSLIWindow(window time.Duration, total, bad uint64, target float64) SLIWindow {
+	w := SLIWindow{Window: windowLabel(window), Total: total, Good: total - bad, SLI: 1}
+	if total > 0 {
+		w.SLI = float64(w.Good) / float64(total)
+	}
+	if budget := 1 - target; budget > 0 {
+		w.BurnRate = (1 - w.SLI) / budget
+	}
+	w.ErrorBudgetRemaining = 1 - w.BurnRate
+	return w
+}
+
+// windowLabel renders windows the way the alert policies name them ("5m", "1h", "6h").
+func windowLabel(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	case d%time.Minute == 0:
+		return strconv.Itoa(int(d/time.Minute)) + "m"
+	default:
+		return d.String()
+	}
+}
+
+// Summary evaluates all objectives now.
+func (t *SLOTracker) Summary() SLOSummary {
+	return t.SummaryAt(time.Now())
+}
+
+// SummaryAt evaluates all objectives for windows ending at now.
+func (t *SLOTracker) SummaryAt(now time.Time) SLOSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	availability := ObjectiveSummary{Name: "availability", Target: t.cfg.AvailabilityTarget}
+	latency := ObjectiveSummary{Name: "latency", Target: t.cfg.LatencyTarget}
+
+	for _, window := range t.cfg.Windows {
+		total, errors, slow := t.counts(now, window)
+		availability.Windows = append(availability.Windows, newSLIWindow(window, total, errors, t.cfg.AvailabilityTarget))
+		latency.Windows = append(latency.Windows, newSLIWindow(window, total, slow, t.cfg.LatencyTarget))
+	}
+
+	for _, alert := range t.cfg.Alerts {
+		total, errors, slow := t.counts(now, alert.Window)
+		for _, obj := range []struct {
+			summary *ObjectiveSummary
+			bad     uint64
+		}{{&availability, errors}, {&latency, slow}} {
+			rate := newSLIWindow(alert.Window, total, obj.bad, obj.summary.Target).BurnRate
+			obj.summary.Alerts = append(obj.summary.Alerts, BurnRateAlertStatus{
+				Window:    windowLabel(alert.Window),
+				Threshold: alert.Threshold,
+				BurnRate:  rate,
+				Firing:    rate > alert.Threshold,
+			})
+		}
+	}
+
+	return SLOSummary{
+		Since:            t.started,
+		LatencyThreshold: t.cfg.LatencyThreshold.String(),
+		Objectives:       []ObjectiveSummary{availability, latency},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *SLOTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.burnRateDesc
+	ch <- t.sliDesc
+	ch <- t.budgetDesc
+}
+
+// Collect implements prometheus.Collector, evaluating the windows at scrape time.
+func (t *SLOTracker) Collect(ch chan<- prometheus.Metric) {
+	for _, obj := range t.Summary().Objectives {
+		for _, w := range obj.Windows {
+			ch <- prometheus.MustNewConstMetric(t.burnRateDesc, prometheus.GaugeValue, w.BurnRate, obj.Name, w.Window)
+			ch <- prometheus.MustNewConstMetric(t.sliDesc, prometheus.GaugeValue, w.SLI, obj.Name, w.Window)
+			ch <- prometheus.MustNewConstMetric(t.budgetDesc, prometheus.GaugeValue, w.ErrorBudgetRemaining, obj.Name, w.Window)
+		}
+	}
+}
+
+// SLOMiddleware feeds every completed request into SLO.
+func SLOMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		SLO.Record(rw.StatusCode, time.Since(start))
+	})
+}
+
+// SLOHandler serves the current SLO summary as JSON.
+func SLOHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, SLO.Summary())
+}
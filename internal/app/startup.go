@@ -0,0 +1,341 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Store startup.
+//
+// The HTTP server starts before the database is reachable (the Cloud SQL Proxy sidecar
+// can take a while to come up). InitDB connects in the background:
+// - The TLS files of the configuration are written first; failures (e.g. a full
+//   disk) are retried with the same backoff and reported as the tls_failed phase
+// - The primary is retried with backoff until it answers; there is no deadline
+// - Replicas are connected once the primary is up; unreachable ones are admitted
+//   later by the replica pool's health checker
+//
+// Until the primary answers, /readyz returns 503 with the connection progress and
+// data endpoints (RequireStore) return 503 with Retry-After. Health endpoints and
+// the static UI are served from the start.
+
+var StoreReadyGauge = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "db_store_ready",
+		Help: "Whether the database connection has been established (1) or is still connecting (0)",
+	},
+)
+
+// Store phases reported by /readyz.
+const (
+	StorePhaseTLSFailed          = "tls_failed"
+	StorePhaseConnectingPrimary  = "connecting_primary"
+	StorePhaseConnectingReplicas = "connecting_replicas"
+	StorePhaseReady              = "ready"
+)
+
+// storeState values. storeIdle means InitDB was never called and DB, if set,
+// was assigned directly (e.g. by tests).
+const (
+	storeIdle int32 = iota
+	storeConnecting
+	storeReady
+)
+
+var (
+	storeState atomic.Int32
+
+	storeMu        sync.Mutex
+	storePhase     string
+	storeAttempts  int
+	storeLastError string
+	storeStarted   time.Time
+	storeTLS       *TLSStatus
+	storeCancel    context.CancelFunc
+	storeDone      chan struct{}
+)
+
+// dbMu guards DB, DBRead and Replicas once the store is connected, so that
+// ReloadDB can swap connection pools while requests are running. Handlers get
+// the pools through primaryDB or stores for each request instead of reading the
+// globals directly.
+var dbMu sync.RWMutex
+
+// primaryDB returns the current primary connection pool.
+func primaryDB() *sql.DB {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+	return DB
+}
+
+// stores returns the current primary, read and replica pools.
+func stores() (*sql.DB, *sql.DB, *ReplicaPool) {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+	return DB, DBRead, Replicas
+}
+
+// setStores installs new pools and returns the previous ones.
+func setStores(primary *sql.DB, replicas *ReplicaPool) (*sql.DB, *ReplicaPool) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	oldPrimary, oldReplicas := DB, Replicas
+	DB, DBRead, Replicas = primary, primary, replicas
+	return oldPrimary, oldReplicas
+}
+
+// closeStores closes the given pools.
+func closeStores(primary *sql.DB, replicas *ReplicaPool) {
+	if replicas != nil {
+		replicas.Close()
+	}
+	if primary != nil {
+		if err := primary.Close(); err != nil {
+			slog.Warn("Failed to close PRIMARY database", "error", err)
+		}
+	}
+}
+
+// StoreReady reports whether DB (and DBRead, Replicas) can be used.
+// The state is loaded atomically after the connection globals are set,
+// so handlers that check it first never race with the background connection.
+func StoreReady() bool {
+	s := storeState.Load()
+	return s == storeIdle || s == storeReady
+}
+
+// StoreStatus is the JSON body of /readyz.
+type StoreStatus struct {
+	Ready     bool            `json:"ready"`
+	Phase     string          `json:"phase"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	Elapsed   string          `json:"elapsed,omitempty"`
+	TLS       *TLSStatus      `json:"tls,omitempty"`
+	Replicas  []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// GetStoreStatus returns the progress of the database connection.
+func GetStoreStatus() StoreStatus {
+	ready := StoreReady()
+	primary, _, replicas := stores()
+
+	storeMu.Lock()
+	status := StoreStatus{
+		Ready:     ready && primary != nil,
+		Phase:     storePhase,
+		Attempts:  storeAttempts,
+		LastError: storeLastError,
+		TLS:       storeTLS,
+	}
+	if !storeStarted.IsZero() {
+		status.Elapsed = time.Since(storeStarted).Round(time.Second).String()
+	}
+	storeMu.Unlock()
+
+	if status.Phase == "" && status.Ready {
+		status.Phase = StorePhaseReady
+	}
+	if ready && replicas != nil {
+		status.Replicas = replicas.Status()
+	}
+	return status
+}
+
+func setStoreTLS(status TLSStatus) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	storeTLS = &status
+}
+
+func setStorePhase(phase string) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	storePhase = phase
+}
+
+// startStore marks the store as connecting and returns the context of the connection loop.
+func startStore() (context.Context, chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	storeMu.Lock()
+	storePhase = StorePhaseConnectingPrimary
+	storeAttempts = 0
+	storeLastError = ""
+	storeTLS = nil
+	storeStarted = time.Now()
+	storeCancel = cancel
+	storeDone = done
+	storeMu.Unlock()
+
+	storeState.Store(storeConnecting)
+	StoreReadyGauge.Set(0)
+	return ctx, done
+}
+
+// markStoreReady publishes the connection globals to handlers.
+func markStoreReady() {
+	storeMu.Lock()
+	storePhase = StorePhaseReady
+	storeLastError = ""
+	elapsed := time.Since(storeStarted)
+	storeMu.Unlock()
+
+	storeState.Store(storeReady)
+	StoreReadyGauge.Set(1)
+	slog.Info("Database store ready", "elapsed", elapsed.String())
+}
+
+// storeBackoff is the retry policy of the background connection.
+func storeBackoff(ctx context.Context) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 500 * time.Millisecond
+	b.MaxInterval = 30 * time.Second
+	b.MaxElapsedTime = 0 // Keep trying; readiness reports the progress
+	return backoff.WithContext(b, ctx)
+}
+
+// resolveStoreTLS writes the TLS files of config, retrying until it succeeds or
+// ctx is cancelled. Meanwhile /readyz reports the tls_failed phase and the error;
+// a corrected secret restarts the connection (see ReloadDB).
+func resolveStoreTLS(ctx context.Context, config DBConfig) (DBConfig, error) {
+	resolved := config
+	op := func() error {
+		var err error
+		if resolved, err = config.resolveTLSFiles(); err != nil {
+			storeMu.Lock()
+			storePhase = StorePhaseTLSFailed
+			storeAttempts++
+			storeLastError = err.Error()
+			storeMu.Unlock()
+		}
+		return err
+	}
+	err := backoff.RetryNotify(op, storeBackoff(ctx), func(err error, d time.Duration) {
+		slog.Error("Invalid database TLS configuration, retrying...", "error", err, "duration", d)
+	})
+	if err != nil {
+		return config, err
+	}
+
+	storeMu.Lock()
+	storePhase = StorePhaseConnectingPrimary
+	storeAttempts = 0
+	storeLastError = ""
+	storeMu.Unlock()
+	return resolved, nil
+}
+
+// connectPrimary opens the primary and retries pinging it until it answers or ctx is cancelled.
+func connectPrimary(ctx context.Context, connStr string) (*sql.DB, error) {
+	var db *sql.DB
+	op := func() error {
+		storeMu.Lock()
+		storeAttempts++
+		storeMu.Unlock()
+
+		candidate, err := openPrimary(ctx, connStr)
+		if err != nil {
+			storeMu.Lock()
+			storeLastError = err.Error()
+			storeMu.Unlock()
+			return err
+		}
+		db = candidate
+		return nil
+	}
+
+	err := backoff.RetryNotify(op, storeBackoff(ctx), func(err error, d time.Duration) {
+		slog.Warn("Could not connect to PRIMARY database, retrying...", "error", err, "duration", d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openPrimary opens a connection pool and pings it once.
+func openPrimary(ctx context.Context, connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// stopConnecting cancels a pending background connection and waits for it to exit.
+func stopConnecting() {
+	storeMu.Lock()
+	cancel, done := storeCancel, storeDone
+	storeCancel, storeDone = nil, nil
+	storeMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// CloseDB stops a pending background connection and closes all database connections.
+func CloseDB() {
+	stopConnecting()
+	closeStores(setStores(nil, nil))
+
+	storeMu.Lock()
+	storePhase = ""
+	storeTLS = nil
+	storeStarted = time.Time{}
+	storeMu.Unlock()
+	storeState.Store(storeIdle)
+	StoreReadyGauge.Set(0)
+}
+
+// RequireStore returns 503 from data endpoints until the database is connected.
+func RequireStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !StoreReady() {
+			w.Header().Set("Retry-After", "5")
+			WriteProblem(w, r, http.StatusServiceUnavailable, "Service is starting",
+				"The database connection is not established yet.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReadyzHandler is the startup and readiness probe. It returns 503 until the
+// primary database is connected, with the connection progress as JSON.
+// Once connected it stays ready through later database outages, which are
+// handled by the circuit breaker and degraded mode instead of taking every
+// pod out of the Service at once.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := GetStoreStatus()
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.Error("Failed to encode readiness status", "error", err)
+	}
+}
@@ -0,0 +1,288 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sony/gobreaker"
+)
+
+// Tags.
+//
+// Tags group todos by context ("oncall", "release") across lists. A tag is a
+// name shared by the todos of a tenant (tags), attached to todos through
+// todo_tags. Names are lowercased. Tagging needs the owner or editor role on the
+// todo's list and is recorded as an update in the audit log:
+//
+//	POST   /todos/{id}/tags        {"tag": "oncall"}
+//	DELETE /todos/{id}/tags/{tag}
+//	GET    /tags                   Tags of the user's todos with counts (?list=<id>)
+//
+// GET /todos?tag=a,b&tag=c returns todos tagged (a or b) and c (see parseTagFilter).
+
+// tagPattern is the format of tag names, after lowercasing.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,49}$`)
+
+// MaxTodoTags limits the tags of a todo.
+const MaxTodoTags = 20
+
+// TagCount is an entry of GET /tags.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// normalizeTag lowercases and validates a tag name.
+func normalizeTag(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !tagPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid tag %q: tags are 1-50 letters, digits, '_', '.', ':' or '-'.", name)
+	}
+	return name, nil
+}
+
+// normalizeTags normalizes, sorts and deduplicates the tags of a new todo
+// ({"task": "...", "tags": ["oncall"]}).
+func normalizeTags(names []string) ([]string, error) {
+	var tags []string
+	for _, name := range names {
+		tag, err := normalizeTag(name)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+	if len(tags) > MaxTodoTags {
+		return nil, fmt.Errorf("a todo can have at most %d tags.", MaxTodoTags)
+	}
+	return tags, nil
+}
+
+// parseTagFilter reads the tag parameters of q into f. Repeated parameters are
+// ANDed; the comma-separated tags of one parameter are ORed.
+func parseTagFilter(f *TodoFilter, q url.Values) error {
+	for _, v := range q["tag"] {
+		var group []string
+		for _, name := range strings.Split(v, ",") {
+			tag, err := normalizeTag(name)
+			if err != nil {
+				return err
+			}
+			group = append(group, tag)
+		}
+		f.Tags = append(f.Tags, group)
+	}
+	return nil
+}
+
+// tagTodo attaches a tag to a todo, creating the tag in the transaction's tenant
+// if needed. It returns false if the todo already has the tag.
+func tagTodo(ctx context.Context, tx *sql.Tx, todoID int, tag string) (bool, error) {
+	var tagID int64
+	if err := tx.QueryRowContext(ctx,
+		`INSERT INTO tags (name) VALUES ($1)
+		 ON CONFLICT (tenant_id, name) DO UPDATE SET name = EXCLUDED.name RETURNING id`, tag).Scan(&tagID); err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO todo_tags (todo_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", todoID, tagID)
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected(res)
+}
+
+// touchTodo bumps the updated_at of a changed todo and returns it.
+func touchTodo(ctx context.Context, tx *sql.Tx, id int) (*Todo, error) {
+	return scanTodo(tx.QueryRowContext(ctx,
+		"UPDATE todos t SET updated_at = now() WHERE t.id = $1 RETURNING "+todoColumns, id))
+}
+
+// changeTodoTags runs change on a todo the user may edit and records an update
+// if it changed the tags. It returns the todo, or nil if the user can't edit it.
+func changeTodoTags(ctx context.Context, userID int64, id int,
+	change func(tx *sql.Tx, before *Todo) (bool, error)) (*Todo, error) {
+	var todo *Todo
+	err := ExecuteWithRobustness(func() error {
+		todo = nil
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			before, err := lockEditableTodo(ctx, tx, userID, id, false)
+			if before == nil || err != nil {
+				return err
+			}
+			changed, err := change(tx, before)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				todo = before
+				return nil
+			}
+			if todo, err = touchTodo(ctx, tx, id); err != nil {
+				return err
+			}
+			return recordTodoEvent(ctx, tx, TodoEventUpdate, before, todo)
+		})
+	})
+	return todo, err
+}
+
+// AddTodoTag serves POST /todos/{id}/tags, returning the todo.
+func AddTodoTag(w http.ResponseWriter, r *http.Request, id int) {
+	if rejectIfReadOnly(w, r) {
+		return
+	}
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Invalid JSON body.")
+		return
+	}
+	tag, err := normalizeTag(req.Tag)
+	if err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var tooMany bool
+	todo, err := changeTodoTags(r.Context(), principal.UserID, id, func(tx *sql.Tx, before *Todo) (bool, error) {
+		if tooMany = len(before.Tags) >= MaxTodoTags && !slices.Contains(before.Tags, tag); tooMany {
+			return false, nil
+		}
+		return tagTodo(r.Context(), tx, id, tag)
+	})
+	if err == nil && todo != nil && tooMany {
+		WriteProblem(w, r, http.StatusConflict, "Conflict", fmt.Sprintf("A todo can have at most %d tags.", MaxTodoTags))
+		return
+	}
+	writeTodoTagResult(w, r, principal, id, todo, err)
+}
+
+// RemoveTodoTag serves DELETE /todos/{id}/tags/{tag}, returning the todo.
+// Removing a tag the todo doesn't have changes nothing.
+func RemoveTodoTag(w http.ResponseWriter, r *http.Request, id int, name string) {
+	if rejectIfReadOnly(w, r) {
+		return
+	}
+	tag, err := normalizeTag(name)
+	if err != nil {
+		WriteProblem(w, r, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	todo, err := changeTodoTags(r.Context(), principal.UserID, id, func(tx *sql.Tx, before *Todo) (bool, error) {
+		res, err := tx.ExecContext(r.Context(),
+			"DELETE FROM todo_tags tt USING tags g WHERE g.id = tt.tag_id AND tt.todo_id = $1 AND g.name = $2", id, tag)
+		if err != nil {
+			return false, err
+		}
+		return rowsAffected(res)
+	})
+	writeTodoTagResult(w, r, principal, id, todo, err)
+}
+
+// writeTodoTagResult answers a tag change of todo id.
+func writeTodoTagResult(w http.ResponseWriter, r *http.Request, principal *Principal, id int, todo *Todo, err error) {
+	switch {
+	case errors.Is(err, ErrNoTenant):
+		writeNoTenant(w, r)
+	case err == gobreaker.ErrOpenState:
+		http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case todo == nil:
+		writeTodoAccessError(w, r, todoAccessError(r.Context(), principal.UserID, id, false))
+	default:
+		writeJSON(w, http.StatusOK, todo)
+	}
+}
+
+// TagCounts returns the tags of the todos the user can see (in listID, or in
+// all of the user's lists if 0) with their number of todos. Trashed todos
+// aren't counted.
+func TagCounts(ctx context.Context, userID, listID int64) ([]TagCount, error) {
+	query := `SELECT g.name, count(*) FROM tags g
+		JOIN todo_tags tt ON tt.tag_id = g.id
+		JOIN todos t ON t.id = tt.todo_id AND t.deleted_at IS NULL
+		JOIN list_members m ON m.list_id = t.list_id AND m.user_id = $1`
+	args := []any{userID}
+	if listID != 0 {
+		query += " WHERE t.list_id = $2"
+		args = append(args, listID)
+	}
+	query += " GROUP BY g.name ORDER BY g.name"
+
+	var counts []TagCount
+	err := ExecuteWithRobustness(func() error {
+		counts = []TagCount{}
+		return tenantTx(ctx, primaryDB(), readOnly, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var c TagCount
+				if err := rows.Scan(&c.Name, &c.Count); err != nil {
+					return err
+				}
+				counts = append(counts, c)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// HandleTags serves GET /tags.
+func HandleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := parseTodoFilter(w, r)
+	if !ok {
+		return
+	}
+	counts, err := TagCounts(r.Context(), principal.UserID, filter.ListID)
+	switch {
+	case errors.Is(err, ErrNoTenant):
+		writeNoTenant(w, r)
+	case err == gobreaker.ErrOpenState:
+		http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, counts)
+	}
+}
@@ -0,0 +1,157 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Multi-tenancy.
+//
+// One deployment serves several teams (tenants). Every user belongs to one
+// tenant, chosen by email domain when the user is created (TenantDomains), and
+// every row carries a tenant_id. The tenant data tables (todos, lists,
+// list_members, list_invitations) have row-level security policies that only
+// show rows of the tenant in the app.tenant_id setting, so a query that forgets
+// a filter still can't see another tenant's data.
+//
+// Store queries on tenant data run through inTenant/tenantTx, which set
+// app.tenant_id for the transaction from the request's tenant (the principal's)
+// and refuse to run without one (ErrNoTenant). With no setting the policies match
+// no rows, so a query that bypasses them fails closed.
+//
+// Identity tables (tenants, users, sessions, api_tokens) are read to find out who
+// is calling, before the tenant is known, so they are not under RLS; they are only
+// looked up by subject or by secret hash.
+
+var TenantQueriesRefusedTotal = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "tenant_queries_refused_total",
+		Help: "Store queries refused because the request had no tenant",
+	},
+)
+
+// ErrNoTenant is returned by the store for a context without a tenant.
+var ErrNoTenant = errors.New("no tenant in context")
+
+// DefaultTenant is the tenant of users whose email domain isn't in TenantDomains.
+const DefaultTenant = "default"
+
+// TenantDomains maps email domains to tenant names (TENANT_EMAIL_DOMAINS).
+var TenantDomains = map[string]string{}
+
+// ParseTenantDomains parses a comma-separated list of tenant=domain pairs.
+func ParseTenantDomains(s string) (map[string]string, error) {
+	domains := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		tenant, domain, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		tenant, domain = strings.TrimSpace(tenant), strings.ToLower(strings.TrimSpace(domain))
+		if !ok || tenant == "" || domain == "" {
+			return nil, fmt.Errorf("invalid tenant domain %q, want tenant=domain", pair)
+		}
+		if _, dup := domains[domain]; dup {
+			return nil, fmt.Errorf("domain %q is assigned to more than one tenant", domain)
+		}
+		domains[domain] = tenant
+	}
+	return domains, nil
+}
+
+// TenantForEmail returns the tenant name for a new user with email.
+func TenantForEmail(email string) string {
+	if _, domain, ok := strings.Cut(strings.ToLower(email), "@"); ok {
+		if tenant, ok := TenantDomains[domain]; ok {
+			return tenant
+		}
+	}
+	return DefaultTenant
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx scoped to the tenant. WithPrincipal sets the
+// principal's tenant, so handlers normally don't need to call it.
+func WithTenant(ctx context.Context, tenantID int64) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant the request is scoped to.
+func TenantFromContext(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(tenantKey{}).(int64)
+	return id, ok && id != 0
+}
+
+// tenantIDs caches tenant ids by name; they never change.
+var tenantIDs sync.Map
+
+// tenantID returns the id of the named tenant, creating it if needed.
+func tenantID(ctx context.Context, name string) (int64, error) {
+	if id, ok := tenantIDs.Load(name); ok {
+		return id.(int64), nil
+	}
+	var id int64
+	err := ExecuteWithRobustness(func() error {
+		return primaryDB().QueryRowContext(ctx,
+			`INSERT INTO tenants (name) VALUES ($1)
+			 ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id`, name).Scan(&id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	tenantIDs.Store(name, id)
+	return id, nil
+}
+
+// tenantTx runs fn in a transaction on db with app.tenant_id set to the
+// context's tenant. It returns ErrNoTenant, without touching the database, if
+// there is none.
+func tenantTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		TenantQueriesRefusedTotal.Inc()
+		return backoff.Permanent(ErrNoTenant) // Not retried
+	}
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	// Local to the transaction, so the setting never leaks to the next user of the connection
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('app.tenant_id', $1, true)", strconv.FormatInt(tenant, 10)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// inTenant runs fn in a tenant transaction on the primary.
+func inTenant(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return tenantTx(ctx, primaryDB(), nil, fn)
+}
+
+// readOnly is used for tenant transactions that only read, e.g. on replicas.
+var readOnly = &sql.TxOptions{ReadOnly: true}
+
+// writeNoTenant answers a request whose principal has no tenant. This is a
+// misconfiguration rather than a client error, but the data must not be served.
+func writeNoTenant(w http.ResponseWriter, r *http.Request) {
+	slog.Error("Refused query without a tenant", "request_id", RequestIDFromContext(r.Context()))
+	WriteProblem(w, r, http.StatusForbidden, "Forbidden", "Your account is not assigned to a tenant.")
+}
@@ -0,0 +1,398 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Personal API tokens.
+//
+// Scripts (and the load generator) authenticate with a personal access token in
+// the Authorization: Bearer header. A token is shown once when it is created;
+// only its SHA-256 hash is stored. Tokens have a scope (read or write), an
+// expiry, and can be revoked. Tokens are managed on /tokens by signed-in users;
+// a token can't be used to create or revoke tokens.
+//
+// Validated tokens are cached like sessions (see AuthCacheConfig); a revoked token
+// stops working at once on the pod that revoked it, and within the cache TTL on
+// the others. Uses are collected in memory and written to last_used_at in one
+// statement per minute.
+
+const (
+	TokenScopeRead  = "read"  // GET only
+	TokenScopeWrite = "write" // Read and modify todos
+
+	tokenPrefix = "todo_"
+
+	DefaultTokenExpiryDays = 90
+	MaxTokenExpiryDays     = 365
+
+	// lastUsedResolution is how often token uses are written to last_used_at
+	lastUsedResolution = time.Minute
+)
+
+// APIToken is a personal access token as listed to its owner.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Prefix     string     `json:"prefix"` // First characters of the token, to tell tokens apart
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Token      string     `json:"token,omitempty"` // Only in the response to create
+}
+
+// ===== STORE =====
+
+// CreateToken creates a token for the user and returns it including the secret.
+func CreateToken(ctx context.Context, userID int64, name, scope string, expiresIn time.Duration) (*APIToken, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	t := &APIToken{
+		Name:   name,
+		Scope:  scope,
+		Token:  tokenPrefix + secret,
+		Prefix: tokenPrefix + secret[:6],
+	}
+	err = ExecuteWithRobustness(func() error {
+		return primaryDB().QueryRowContext(ctx,
+			`INSERT INTO api_tokens (user_id, tenant_id, name, scope, prefix, token_hash, expires_at)
+			 VALUES ($1, (SELECT tenant_id FROM users WHERE id = $1), $2, $3, $4, $5, now() + $6 * interval '1 second')
+			 RETURNING id, created_at, expires_at`,
+			userID, name, scope, t.Prefix, hashSecret(t.Token), int64(expiresIn.Seconds())).
+			Scan(&t.ID, &t.CreatedAt, &t.ExpiresAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTokens returns the user's tokens that haven't been revoked, including expired ones.
+func ListTokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	var tokens []APIToken
+	err := ExecuteWithRobustness(func() error {
+		tokens = nil
+		rows, err := primaryDB().QueryContext(ctx,
+			`SELECT id, name, scope, prefix, created_at, expires_at, last_used_at
+			 FROM api_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY id`, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t APIToken
+			var lastUsed sql.NullTime
+			if err := rows.Scan(&t.ID, &t.Name, &t.Scope, &t.Prefix, &t.CreatedAt, &t.ExpiresAt, &lastUsed); err != nil {
+				return err
+			}
+			if lastUsed.Valid {
+				t.LastUsedAt = &lastUsed.Time
+			}
+			tokens = append(tokens, t)
+		}
+		return rows.Err()
+	})
+	return tokens, err
+}
+
+// RevokeToken revokes the user's token with id. It reports whether there was such a token.
+func RevokeToken(ctx context.Context, userID, id int64) (bool, error) {
+	var found bool
+	err := ExecuteWithRobustness(func() error {
+		result, err := primaryDB().ExecContext(ctx,
+			"UPDATE api_tokens SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", id, userID)
+		if err != nil {
+			return err
+		}
+		found, err = rowsAffected(result)
+		return err
+	})
+	if found {
+		tokenCache.removeFunc(func(t cachedToken) bool { return t.ID == id })
+	}
+	return found, err
+}
+
+// cachedToken is what a validated token is remembered as.
+type cachedToken struct {
+	ID        int64
+	Principal Principal
+}
+
+// tokenCache remembers validated tokens by hash (see AuthCacheConfig).
+var tokenCache = newCredentialCache[cachedToken](DefaultAuthCacheConfig)
+
+// SetTokenCacheConfig empties the token cache and applies config.
+func SetTokenCacheConfig(config AuthCacheConfig) {
+	tokenCache.reset(config)
+}
+
+// lookupToken returns the principal of a valid token, or nil.
+func lookupToken(ctx context.Context, token string) (*Principal, error) {
+	key := string(hashSecret(token))
+	if cached, ok := tokenCache.fresh(key); ok {
+		recordTokenUse(cached.ID)
+		p := cached.Principal
+		return &p, nil
+	}
+
+	var (
+		p         *Principal
+		tokenID   int64
+		email     sql.NullString
+		expiresAt time.Time
+	)
+	err := ExecuteWithRobustness(func() error {
+		p = &Principal{Method: "token"}
+		err := primaryDB().QueryRowContext(ctx,
+			`SELECT t.id, t.user_id, u.tenant_id, u.subject, u.email, t.scope, t.expires_at
+			 FROM api_tokens t JOIN users u ON u.id = t.user_id
+			 WHERE t.token_hash = $1 AND t.revoked_at IS NULL AND t.expires_at > now()`, hashSecret(token)).
+			Scan(&tokenID, &p.UserID, &p.TenantID, &p.Subject, &email, &p.Scope, &expiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			p = nil
+			return nil // Not a failure of the database
+		}
+		return err
+	})
+	if err != nil {
+		cached, ok := tokenCache.fallback(key)
+		if !ok {
+			return nil, err
+		}
+		AuthCacheFallbacksTotal.WithLabelValues("token").Inc()
+		slog.Warn("Token store unavailable, using cached token", "error", err, "token_id", cached.ID)
+		recordTokenUse(cached.ID)
+		p := cached.Principal
+		return &p, nil
+	}
+	if p == nil {
+		tokenCache.remove(key)
+		return nil, nil
+	}
+	p.Email = email.String
+	tokenCache.put(key, cachedToken{ID: tokenID, Principal: *p}, expiresAt)
+	recordTokenUse(tokenID)
+	return p, nil
+}
+
+// ===== LAST USE =====
+
+// tokenUses are the token uses not yet written to last_used_at, by token id.
+var (
+	tokenUsesMu sync.Mutex
+	tokenUses   = map[int64]time.Time{}
+)
+
+func recordTokenUse(id int64) {
+	tokenUsesMu.Lock()
+	defer tokenUsesMu.Unlock()
+	tokenUses[id] = time.Now()
+}
+
+// FlushTokenUses writes the recorded token uses to last_used_at in one statement.
+// Uses that can't be written are kept for the next flush.
+func FlushTokenUses(ctx context.Context) error {
+	tokenUsesMu.Lock()
+	uses := tokenUses
+	tokenUses = map[int64]time.Time{}
+	tokenUsesMu.Unlock()
+	if len(uses) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(uses))
+	usedAt := make([]string, 0, len(uses))
+	for id, at := range uses {
+		ids = append(ids, id)
+		usedAt = append(usedAt, at.UTC().Format(time.RFC3339Nano))
+	}
+	err := ExecuteWithRobustness(func() error {
+		_, err := primaryDB().ExecContext(ctx,
+			`UPDATE api_tokens t SET last_used_at = u.used_at
+			 FROM unnest($1::bigint[], $2::timestamptz[]) AS u(id, used_at)
+			 WHERE t.id = u.id AND (t.last_used_at IS NULL OR t.last_used_at < u.used_at)`,
+			pq.Array(ids), pq.Array(usedAt))
+		return err
+	})
+	if err != nil {
+		tokenUsesMu.Lock()
+		for id, at := range uses {
+			if later, ok := tokenUses[id]; !ok || at.After(later) {
+				tokenUses[id] = at
+			}
+		}
+		tokenUsesMu.Unlock()
+	}
+	return err
+}
+
+// RunTokenUseFlusher flushes token uses every lastUsedResolution until ctx is
+// done. Flushes are skipped while the store isn't ready or the service is read-only.
+func RunTokenUseFlusher(ctx context.Context) {
+	ticker := time.NewTicker(lastUsedResolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if readOnly, _ := ReadOnly(); readOnly || !StoreReady() {
+				continue
+			}
+			if err := FlushTokenUses(ctx); err != nil {
+				slog.Warn("Failed to record token uses", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TokenAuthenticator accepts personal API tokens in the Authorization: Bearer header.
+func TokenAuthenticator() Authenticator {
+	return func(r *http.Request) (*Principal, error) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return nil, nil
+		}
+		token = strings.TrimSpace(token)
+		if !strings.HasPrefix(token, tokenPrefix) {
+			return nil, ErrUnauthenticated
+		}
+		p, err := lookupToken(r.Context(), token)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return nil, ErrUnauthenticated
+		}
+		return p, nil
+	}
+}
+
+// ===== HANDLERS =====
+
+// HandleTokens lists (GET) and creates (POST) the user's tokens.
+func HandleTokens(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requireTokenManager(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := ListTokens(r.Context(), principal.UserID)
+		if err != nil {
+			slog.Error("Failed to list tokens", "error", err)
+			WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not list tokens.")
+			return
+		}
+		if tokens == nil {
+			tokens = []APIToken{}
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	case http.MethodPost:
+		if rejectIfReadOnly(w, r) {
+			return
+		}
+		var req struct {
+			Name          string `json:"name"`
+			Scope         string `json:"scope"`
+			ExpiresInDays int    `json:"expires_in_days"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "Invalid JSON body.")
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = DefaultTokenExpiryDays
+		}
+		switch {
+		case req.Name == "" || len(req.Name) > 100:
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "name is required (at most 100 characters).")
+			return
+		case req.Scope != TokenScopeRead && req.Scope != TokenScopeWrite:
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", `scope must be "read" or "write".`)
+			return
+		case req.ExpiresInDays < 1 || req.ExpiresInDays > MaxTokenExpiryDays:
+			WriteProblem(w, r, http.StatusBadRequest, "Bad Request", "expires_in_days must be between 1 and "+strconv.Itoa(MaxTokenExpiryDays)+".")
+			return
+		}
+
+		token, err := CreateToken(r.Context(), principal.UserID, req.Name, req.Scope, time.Duration(req.ExpiresInDays)*24*time.Hour)
+		if err != nil {
+			slog.Error("Failed to create token", "error", err)
+			WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not create the token.")
+			return
+		}
+		slog.Info("API token created", "user_id", principal.UserID, "token_id", token.ID, "scope", token.Scope)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusCreated, token)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleToken revokes a token (DELETE /tokens/{id}).
+func HandleToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Path[len("/tokens/"):], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	principal, ok := requireTokenManager(w, r)
+	if !ok {
+		return
+	}
+	if rejectIfReadOnly(w, r) {
+		return
+	}
+
+	found, err := RevokeToken(r.Context(), principal.UserID, id)
+	if err != nil {
+		slog.Error("Failed to revoke token", "error", err)
+		WriteProblem(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not revoke the token.")
+		return
+	}
+	if !found {
+		WriteProblem(w, r, http.StatusNotFound, "Not Found", "Token not found.")
+		return
+	}
+	slog.Info("API token revoked", "user_id", principal.UserID, "token_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireTokenManager returns the principal if it may manage tokens. Tokens can't
+// manage tokens, so a leaked token can't be used to mint longer-lived ones.
+func requireTokenManager(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	p, ok := requirePrincipal(w, r)
+	if !ok {
+		return nil, false
+	}
+	if p.Method == "token" {
+		WriteProblem(w, r, http.StatusForbidden, "Forbidden", "API tokens can't be used to manage tokens. Sign in to manage tokens.")
+		return nil, false
+	}
+	return p, true
+}
@@ -0,0 +1,285 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+// Trash.
+//
+// DELETE /todos/{id} moves a todo to the trash by setting deleted_at; list
+// endpoints leave trashed todos out unless asked (?trash=include). GET /trash
+// lists them and POST /todos/{id}/restore takes one back out. A background job
+// (see TrashPurger) hard-deletes todos that have been in the trash for longer
+// than the retention period. Restores and purges are recorded in the audit log.
+
+const (
+	TodoEventRestore = "restore"
+	TodoEventPurge   = "purge"
+)
+
+// DefaultTrashRetention is how long trashed todos are kept before they are purged.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+const (
+	// trashPurgeBatch bounds the todos purged, and audit events written, per transaction
+	trashPurgeBatch = 500
+	// trashPurgeLock is the advisory lock that lets one instance purge at a time
+	trashPurgeLock = 0x7472617368 // "trash"
+)
+
+var (
+	TodosRestored = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "todos_restored_total",
+			Help: "Total number of todos restored from the trash",
+		},
+	)
+	TodosPurged = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "todos_purged_total",
+			Help: "Total number of trashed todos purged after the retention period",
+		},
+	)
+)
+
+// GetTrash serves GET /trash: the trashed todos of the user's lists (?list=<id> for one list).
+// Unlike GetTodos, it is not served from TodoCache when the database is unavailable.
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := parseTodoFilter(w, r)
+	if !ok {
+		return
+	}
+	filter.Trash = TrashOnly
+
+	var todos []Todo
+	err := ExecuteWithRobustness(func() error {
+		var err error
+		todos, err = readTodos(r.Context(), principal.UserID, filter)
+		return err
+	})
+	if errors.Is(err, ErrNoTenant) {
+		writeNoTenant(w, r)
+		return
+	}
+	if err != nil {
+		if err == gobreaker.ErrOpenState {
+			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if todos == nil {
+		todos = []Todo{}
+	}
+	writeJSON(w, http.StatusOK, todos)
+}
+
+// RestoreTodo serves POST /todos/{id}/restore, taking a todo out of the trash.
+// Like other changes, it needs the owner or editor role on the todo's list.
+func RestoreTodo(w http.ResponseWriter, r *http.Request, id int) {
+	if rejectIfReadOnly(w, r) {
+		return
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var restored *Todo
+	err := ExecuteWithRobustness(func() error {
+		restored = nil
+		return inTenant(r.Context(), func(tx *sql.Tx) error {
+			before, err := lockEditableTodo(r.Context(), tx, principal.UserID, id, true)
+			if before == nil || err != nil {
+				return err
+			}
+			after, err := scanTodo(tx.QueryRowContext(r.Context(),
+				"UPDATE todos t SET deleted_at = NULL WHERE t.id = $1 RETURNING "+todoColumns, id))
+			if err != nil {
+				return err
+			}
+			if err := recordTodoEvent(r.Context(), tx, TodoEventRestore, before, after); err != nil {
+				return err
+			}
+			restored = after
+			return nil
+		})
+	})
+
+	if errors.Is(err, ErrNoTenant) {
+		writeNoTenant(w, r)
+		return
+	}
+	if err != nil {
+		if err == gobreaker.ErrOpenState {
+			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if restored == nil {
+		writeTodoAccessError(w, r, todoAccessError(r.Context(), principal.UserID, id, true))
+		return
+	}
+
+	TodosRestored.Inc()
+	writeJSON(w, http.StatusOK, restored)
+}
+
+// PurgeTrash hard-deletes the todos trashed before now - retention, in every
+// tenant, and returns how many were purged. Each purge is recorded in the audit
+// log with the "purge" actor method and no actor. Todos are purged in batches of
+// trashPurgeBatch, one transaction each. Only one instance purges at a time; while
+// another one holds the purge lock, PurgeTrash purges nothing.
+func PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	conn, err := primaryDB().Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", trashPurgeLock).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		slog.Debug("Trash is being purged by another instance")
+		return 0, nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", trashPurgeLock); err != nil {
+			// The lock is held until the session ends, so the connection mustn't go back to the pool
+			slog.Warn("Failed to release the trash purge lock", "error", err)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	var tenants []int64
+	err = ExecuteWithRobustness(func() error {
+		tenants = nil
+		rows, err := primaryDB().QueryContext(ctx, "SELECT id FROM tenants ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			tenants = append(tenants, id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	purged := 0
+	for _, tenant := range tenants {
+		for {
+			n, err := purgeTenantTrash(ctx, tenant, cutoff)
+			purged += n
+			if err != nil {
+				return purged, err
+			}
+			if n < trashPurgeBatch {
+				break
+			}
+		}
+	}
+	return purged, nil
+}
+
+// purgeTenantTrash purges up to trashPurgeBatch todos of one tenant trashed before cutoff.
+func purgeTenantTrash(ctx context.Context, tenant int64, cutoff time.Time) (int, error) {
+	ctx = WithPrincipal(ctx, &Principal{TenantID: tenant, Method: "purge"})
+	var todos []Todo
+	err := ExecuteWithRobustness(func() error {
+		todos = nil
+		return inTenant(ctx, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx,
+				`DELETE FROM todos t WHERE t.id IN (
+				   SELECT id FROM todos WHERE deleted_at < $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED
+				 ) RETURNING `+todoColumns, cutoff, trashPurgeBatch)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				t, err := scanTodo(rows)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				todos = append(todos, *t)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for i := range todos {
+				if err := recordTodoEvent(ctx, tx, TodoEventPurge, &todos[i], nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	TodosPurged.Add(float64(len(todos)))
+	return len(todos), nil
+}
+
+// TrashPurger periodically purges todos that have been in the trash for longer than Retention.
+type TrashPurger struct {
+	Retention time.Duration
+}
+
+// Run purges the trash every interval until ctx is done. Passes are skipped
+// while the store isn't ready or the service is read-only.
+func (p *TrashPurger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if readOnly, _ := ReadOnly(); readOnly || !StoreReady() {
+				continue
+			}
+			n, err := PurgeTrash(ctx, p.Retention)
+			if err != nil {
+				slog.Error("Failed to purge trash", "error", err, "purged", n)
+			} else if n > 0 {
+				slog.Info("Purged trash", "purged", n, "retention", p.Retention.String())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
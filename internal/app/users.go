@@ -0,0 +1,70 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"sync"
+)
+
+// User is a row of the users table.
+type User struct {
+	ID       int64
+	TenantID int64
+}
+
+// UserStore maps identity provider subjects to rows in the users table.
+// Users are created on first sign-in, in the tenant of their email domain
+// (see TenantForEmail). Subject to user mappings never change, so they are
+// cached to keep authentication off the database.
+type UserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+	limit int
+}
+
+// NewUserStore creates a UserStore caching up to limit users.
+func NewUserStore(limit int) *UserStore {
+	return &UserStore{users: map[string]User{}, limit: limit}
+}
+
+// Users is the application's user store.
+var Users = NewUserStore(10000)
+
+// Ensure returns the user with subject, creating the user if needed.
+// The email is updated when it changes; the tenant of an existing user is not.
+func (s *UserStore) Ensure(ctx context.Context, subject, email string) (User, error) {
+	if email == "" {
+		s.mu.RLock()
+		user, ok := s.users[subject]
+		s.mu.RUnlock()
+		if ok {
+			return user, nil
+		}
+	}
+
+	tenant, err := tenantID(ctx, TenantForEmail(email))
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	err = ExecuteWithRobustness(func() error {
+		return primaryDB().QueryRowContext(ctx,
+			`INSERT INTO users (subject, email, tenant_id) VALUES ($1, NULLIF($2, ''), $3)
+			 ON CONFLICT (subject) DO UPDATE SET email = COALESCE(EXCLUDED.email, users.email)
+			 RETURNING id, tenant_id`, subject, email, tenant).Scan(&user.ID, &user.TenantID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	s.mu.Lock()
+	if len(s.users) >= s.limit {
+		s.users = map[string]User{} // Cheap bound; entries are repopulated on demand
+	}
+	s.users[subject] = user
+	s.mu.Unlock()
+	return user, nil
+}
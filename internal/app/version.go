@@ -0,0 +1,125 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Build metadata injected at build time, e.g.:
+//
+//	go build -ldflags "-X github.com/stevemcghee/go-to-production/internal/app.Version=v1.2.3 \
+//	  -X github.com/stevemcghee/go-to-production/internal/app.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/stevemcghee/go-to-production/internal/app.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When they are empty (e.g. `go run`), values are read from debug.ReadBuildInfo.
+var (
+	Version   string
+	Commit    string
+	BuildTime string
+)
+
+// VersionHeader carries the running version on every response so canary
+// analysis and clients can tell which build served a request.
+const VersionHeader = "X-App-Version"
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// BuildInfoGauge lets dashboards and canary analysis join metrics on the running version.
+var BuildInfoGauge = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "build_info",
+		Help: "Build information of the running binary (always 1)",
+	},
+	[]string{"version", "commit", "build_time", "go_version"},
+)
+
+var (
+	buildInfoOnce sync.Once
+	buildInfo     BuildInfo
+)
+
+// GetBuildInfo returns the build metadata, resolving fallbacks on first use.
+func GetBuildInfo() BuildInfo {
+	buildInfoOnce.Do(func() {
+		buildInfo = resolveBuildInfo()
+		BuildInfoGauge.WithLabelValues(buildInfo.Version, buildInfo.Commit, buildInfo.BuildTime, buildInfo.GoVersion).Set(1)
+	})
+	return buildInfo
+}
+
+func resolveBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = s.Value
+				}
+			}
+		}
+	}
+
+	// Fall back to the commit so canaries built without a version can still be told apart
+	if info.Version == "" {
+		if info.Commit != "" {
+			info.Version = info.Commit
+		} else {
+			info.Version = "dev"
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+// VersionHandler serves the build metadata as JSON.
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(GetBuildInfo()); err != nil {
+		slog.Error("Failed to encode version", "error", err)
+	}
+}
+
+// VersionHeaderMiddleware adds the running version to every response.
+func VersionHeaderMiddleware(next http.Handler) http.Handler {
+	version := GetBuildInfo().Version
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(VersionHeader, version)
+		next.ServeHTTP(w, r)
+	})
+}
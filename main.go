@@ -5,23 +5,31 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/stevemcghee/go-to-production/internal/app"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	fmt.Println("Raw stdout: Application starting...")
 
-	jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	// The level can be changed at runtime via the admin server (/debug/loglevel)
+	app.LogLevel.Set(slog.LevelDebug)
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(v)); err == nil {
+			app.LogLevel.Set(level)
+		}
+	}
+	jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: app.LogLevel})
 	slog.SetDefault(slog.New(jsonHandler))
 
 	if _, err := os.Stat("templates/index.html"); os.IsNotExist(err) {
@@ -30,6 +38,7 @@ func main() {
 		slog.Info("templates/index.html found")
 	}
 
+	// Catches panics during startup; handler panics are handled per request by app.RecoveryMiddleware
 	defer func() {
 		if r := recover(); r != nil {
 			slog.Error("Application panicked", "panic", r)
@@ -37,7 +46,8 @@ func main() {
 		}
 	}()
 
-	slog.Info("Logger initialized")
+	buildInfo := app.GetBuildInfo()
+	slog.Info("Logger initialized", "version", buildInfo.Version, "commit", buildInfo.Commit, "build_time", buildInfo.BuildTime)
 
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
@@ -53,39 +63,211 @@ func main() {
 		defer shutdown()
 	}
 
-	secretName := fmt.Sprintf("projects/%s/secrets/todo-app-secret/versions/latest", projectID)
+	// The database secret comes from a mounted file (DB_SECRET_FILE) or Secret Manager
+	var secretSource app.SecretSource
+	if path := os.Getenv("DB_SECRET_FILE"); path != "" {
+		secretSource = app.FileSecretSource(path)
+		slog.Info("Reading database secret from file", "path", path)
+	} else {
+		secretName := fmt.Sprintf("projects/%s/secrets/todo-app-secret/versions/latest", projectID)
+		secretSource = app.SecretManagerSource(secretName)
+	}
 
-	secretValue, err := app.AccessSecretVersion(secretName)
+	dbConfig, err := app.LoadDBConfig(context.Background(), secretSource)
 	if err != nil {
-		slog.Error("Failed to fetch secret from Secret Manager", "error", err)
+		slog.Error("Failed to load database secret", "error", err)
 		os.Exit(1)
 	} else {
-		slog.Info("Successfully fetched secret from Secret Manager")
+		slog.Info("Successfully loaded database secret")
 	}
 
-	var dbConfig app.DBConfig
-	if err := json.Unmarshal([]byte(secretValue), &dbConfig); err != nil {
-		slog.Error("Failed to parse secret JSON", "error", err)
-		os.Exit(1)
+	app.RegisterDBConfig(dbConfig)
+
+	// Hedged reads race a slow read replica against the primary (off by default)
+	if os.Getenv("HEDGED_READS") == "true" {
+		hedgeConfig := app.DefaultHedgeConfig
+		hedgeConfig.Enabled = true
+		if v, err := strconv.ParseFloat(os.Getenv("HEDGE_PERCENTILE"), 64); err == nil && v > 0 && v <= 1 {
+			hedgeConfig.Percentile = v
+		}
+		if v, err := strconv.ParseFloat(os.Getenv("HEDGE_BUDGET_RATIO"), 64); err == nil && v >= 0 && v <= 1 {
+			hedgeConfig.BudgetRatio = v
+		}
+		app.Hedging = app.NewHedger(hedgeConfig)
+		app.RegisterConfig("hedging", hedgeConfig)
+		slog.Info("Hedged reads enabled", "percentile", hedgeConfig.Percentile, "budget_ratio", hedgeConfig.BudgetRatio)
 	}
 
+	// Connects in the background; data endpoints return 503 until the store is ready
 	app.InitDB(dbConfig)
-	defer app.DB.Close()
-	if app.DBRead != app.DB {
-		defer app.DBRead.Close()
+	defer app.CloseDB()
+
+	// Re-read the secret periodically and swap connection pools when it changes (e.g. password rotation)
+	secretRefresh := time.Minute
+	if v := os.Getenv("SECRET_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			secretRefresh = d
+		} else {
+			slog.Warn("Invalid SECRET_REFRESH_INTERVAL, using default", "value", v, "default", secretRefresh.String())
+		}
+	}
+	if secretRefresh > 0 {
+		watcher := app.NewSecretWatcher(secretSource, dbConfig, func(config app.DBConfig) error {
+			if err := app.ReloadDB(config); err != nil {
+				return err
+			}
+			app.RegisterDBConfig(config)
+			return nil
+		})
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		go watcher.Run(watchCtx, secretRefresh)
+	}
+
+	// Trashed todos are purged after TRASH_RETENTION; TRASH_PURGE_INTERVAL=0 disables purging
+	trashPurger := &app.TrashPurger{Retention: app.DefaultTrashRetention}
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			trashPurger.Retention = d
+		} else {
+			slog.Warn("Invalid TRASH_RETENTION, using default", "value", v, "default", trashPurger.Retention.String())
+		}
+	}
+	trashPurgeInterval := time.Hour
+	if v := os.Getenv("TRASH_PURGE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			trashPurgeInterval = d
+		} else {
+			slog.Warn("Invalid TRASH_PURGE_INTERVAL, using default", "value", v, "default", trashPurgeInterval.String())
+		}
+	}
+	app.RegisterConfig("trash", map[string]any{"retention": trashPurger.Retention.String(), "purge_interval": trashPurgeInterval.String()})
+	if trashPurgeInterval > 0 {
+		purgeCtx, stopPurging := context.WithCancel(context.Background())
+		defer stopPurging()
+		go trashPurger.Run(purgeCtx, trashPurgeInterval)
+	}
+
+	// API token uses are written to last_used_at in batches
+	flushCtx, stopFlushing := context.WithCancel(context.Background())
+	defer stopFlushing()
+	go app.RunTokenUseFlusher(flushCtx)
+
+	// New users are assigned to a tenant by email domain, e.g. "team-a=a.example.com,team-b=b.example.com"
+	if v := os.Getenv("TENANT_EMAIL_DOMAINS"); v != "" {
+		domains, err := app.ParseTenantDomains(v)
+		if err != nil {
+			slog.Error("Invalid TENANT_EMAIL_DOMAINS", "error", err)
+			os.Exit(1)
+		}
+		app.TenantDomains = domains
+		app.RegisterConfig("tenants", domains)
+	}
+
+	// Authenticators identify the user whose todos a request reads and writes
+	authenticators := []app.Authenticator{app.TokenAuthenticator()}
+
+	// Browser sign-in with OpenID Connect; sessions are stored in the database so any pod can serve them
+	sessions := &app.Sessions{
+		Store:  app.NewCachedSessionStore(app.DBSessionStore{}, app.DefaultAuthCacheConfig),
+		Cookie: app.SessionCookieConfig{Insecure: os.Getenv("SESSION_COOKIE_INSECURE") == "true"},
+	}
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			sessions.Cookie.TTL = d
+		} else {
+			slog.Warn("Invalid SESSION_TTL, using default", "value", v, "default", app.DefaultSessionTTL.String())
+		}
+	}
+	var oidcProvider *app.OIDCProvider
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		oidcConfig := app.OIDCConfig{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		}
+		oidcProvider, err = app.NewOIDCProvider(oidcConfig, sessions)
+		if err != nil {
+			slog.Error("Invalid OIDC configuration", "error", err)
+			os.Exit(1)
+		}
+		app.RegisterConfig("oidc", map[string]any{"issuer": oidcConfig.Issuer, "client_id": oidcConfig.ClientID, "redirect_url": oidcConfig.RedirectURL})
+		authenticators = append(authenticators, sessions.Authenticator())
+		slog.Info("OIDC sign-in enabled", "issuer", issuer)
+	}
+	if user := os.Getenv("DEV_AUTH_USER"); user != "" {
+		slog.Warn("Development authentication is ENABLED; every request is the same user", "user", user)
+		authenticators = append(authenticators, app.DevAuthenticator(user))
+	}
+	// State-changing browser requests must carry the CSRF token issued with the page
+	csrf := &app.CSRF{Insecure: sessions.Cookie.Insecure}
+
+	// Data endpoints need the store and a signed-in user. Rate limits apply per
+	// user, so they run once the credentials have been verified.
+	dataEndpoint := func(h http.HandlerFunc) http.Handler {
+		return app.Chain(h, app.RequireStore, app.AuthMiddleware(authenticators...), app.RateLimitMiddleware(app.RateLimit),
+			app.RequireAuth, csrf.Protect, app.RequireWriteScope)
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", app.ServeIndex)
-	mux.HandleFunc("/todos", app.HandleTodos)
-	mux.HandleFunc("/todos/", app.HandleTodo)
+	mux.Handle("/", csrf.Issue(http.HandlerFunc(app.ServeIndex)))
+	mux.Handle("/todos", dataEndpoint(app.HandleTodos))
+	mux.Handle("/todos/", dataEndpoint(app.HandleTodo))
+	mux.Handle("/trash", dataEndpoint(app.GetTrash))
+	mux.Handle("/tags", dataEndpoint(app.HandleTags))
+	mux.Handle("/lists", dataEndpoint(app.HandleLists))
+	mux.Handle("/lists/", dataEndpoint(app.HandleList))
+	mux.Handle("/tokens", dataEndpoint(app.HandleTokens))
+	mux.Handle("/tokens/", dataEndpoint(app.HandleToken))
+	if oidcProvider != nil {
+		mux.HandleFunc("/auth/login", oidcProvider.LoginHandler)
+		mux.Handle("/auth/callback", app.Chain(http.HandlerFunc(oidcProvider.CallbackHandler), app.RequireStore))
+		mux.Handle("/auth/logout", app.Chain(http.HandlerFunc(sessions.LogoutHandler), app.RequireStore, csrf.Protect))
+	}
+	mux.Handle("/auth/me", app.Chain(http.HandlerFunc(app.MeHandler), app.RequireStore, app.AuthMiddleware(authenticators...)))
 	mux.HandleFunc("/healthz", app.HealthzHandler)
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/readyz", app.ReadyzHandler)
+	mux.HandleFunc("/version", app.VersionHandler)
 
 	fs := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 
+	// Admin/debug server (metrics, pprof, config, breakers, log level, faults, read-only mode).
+	// It has no authentication, so it should only listen on localhost; use kubectl port-forward.
+	adminAddr := os.Getenv("ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = "localhost:9090"
+	}
+	if host, _, err := net.SplitHostPort(adminAddr); err != nil || !isLoopback(host) {
+		slog.Warn("Admin server is reachable from outside the pod; it has no authentication", "addr", adminAddr)
+	}
+	adminServer := &http.Server{
+		Addr:              adminAddr,
+		Handler:           app.NewAdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("Admin server starting", "addr", adminAddr)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Admin server stopped unexpectedly", "error", err)
+		}
+	}()
 
+	// Metrics server: /metrics only, for the metrics collector (in GKE METRICS_ADDR=:9091)
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		metricsServer := &http.Server{
+			Addr:              metricsAddr,
+			Handler:           app.NewMetricsHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Metrics server starting", "addr", metricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Metrics server stopped unexpectedly", "error", err)
+			}
+		}()
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -97,9 +279,49 @@ func main() {
 
 	slog.Info("Server starting", "port", port)
 
-	// Wrap handler with tracing and security middleware
+	// Security header configuration (HSTS is off unless explicitly enabled)
+	securityConfig := app.SecurityHeadersConfig{
+		CSP: os.Getenv("CONTENT_SECURITY_POLICY"),
+	}
+	if v := os.Getenv("HSTS_MAX_AGE"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Warn("Invalid HSTS_MAX_AGE, HSTS disabled", "value", v, "error", err)
+		} else {
+			securityConfig.HSTSMaxAge = maxAge
+			securityConfig.HSTSIncludeSubdomains = os.Getenv("HSTS_INCLUDE_SUBDOMAINS") == "true"
+		}
+	}
+	app.RegisterConfig("security_headers", securityConfig)
+
+	// Fault injection is only available when explicitly enabled (e.g. for canary chaos experiments)
+	if os.Getenv("FAULT_INJECTION_ENABLED") == "true" {
+		app.Faults.Enable()
+	}
+
+	// Number of proxies in front of the app that append to X-Forwarded-For (used for per-IP rate limits)
+	if v := os.Getenv("TRUSTED_PROXY_HOPS"); v != "" {
+		hops, err := strconv.Atoi(v)
+		if err != nil || hops < 0 {
+			slog.Warn("Invalid TRUSTED_PROXY_HOPS, ignoring X-Forwarded-For", "value", v)
+		} else {
+			app.RateLimit.TrustedProxyHops = hops
+		}
+	}
+
+	// Wrap handler with tracing and the middleware chain (outermost first)
 	handler := otelhttp.NewHandler(
-		app.SecurityHeadersMiddleware(mux),
+		app.Chain(mux,
+			app.RequestIDMiddleware,
+			app.AccessLogMiddleware,
+			app.MetricsMiddleware,
+			app.SLOMiddleware,
+			app.RecoveryMiddleware,
+			app.ConcurrencyLimitMiddleware(app.Limiter),
+			app.SecurityHeaders(securityConfig),
+			app.VersionHeaderMiddleware,
+			app.FaultInjectionMiddleware(app.Faults),
+		),
 		"go-to-production",
 	)
 
@@ -115,4 +337,13 @@ func main() {
 		slog.Error("Server stopped unexpectedly", "error", err)
 		os.Exit(1)
 	}
+}
+
+// isLoopback reports whether host only accepts connections from within the pod.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
\ No newline at end of file
@@ -6,65 +6,54 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stevemcghee/go-to-production/internal/app"
 	"github.com/sony/gobreaker"
 )
 
-// TestHealthzHandler tests the health check endpoint
+// TestHealthzHandler tests that the liveness probe doesn't depend on the database
 func TestHealthzHandler(t *testing.T) {
-	tests := []struct {
-		name string
-		dbInitialized bool
-		expectedStatus int
-		expectedBody   string
-	}{
-		{
-			name: "database not initialized",
-			dbInitialized: false,
-			expectedStatus: http.StatusInternalServerError,
-			expectedBody:   "Database connection not initialized",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Save original db states
-			originalDB := app.DB
-			originalDBRead := app.DBRead
-
-			if !tt.dbInitialized {
-				app.DB = nil
-				app.DBRead = nil
-			} else {
-				// For unit test, mock a healthy DB connection for other tests
-				// but this specific test only covers the nil case for now.
-				// app.DB = &sql.DB{} // We don't need this mock if we only test nil case
-				// app.DBRead = &sql.DB{}
-			}
-
-			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
-			w := httptest.NewRecorder()
+	originalDB := app.DB
+	originalDBRead := app.DBRead
+	app.DB = nil
+	app.DBRead = nil
+	defer func() {
+		app.DB = originalDB
+		app.DBRead = originalDBRead
+	}()
 
-			app.HealthzHandler(w, req)
-
-			if w.Code != tt.expectedStatus {
-				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
-			}
-
-			if !bytes.Contains(w.Body.Bytes(), []byte(tt.expectedBody)) {
-				t.Errorf("expected body to contain %q, got %q", tt.expectedBody, w.Body.String())
-			}
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+	app.HealthzHandler(w, req)
 
-			// Restore original state
-			app.DB = originalDB
-			app.DBRead = originalDBRead
-		})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d without a database, got %d", http.StatusOK, w.Code)
+	}
+	if w.Body.String() != "OK" {
+		t.Errorf("expected body 'OK', got %q", w.Body.String())
 	}
 }
 
@@ -372,4 +361,2467 @@ func TestCircuitBreakerOpensOnFailures(t *testing.T) {
 		t.Errorf("circuit breaker should allow request in half-open state, got error: %v", err)
 	}
 	app.CB = originalCB
-}
\ No newline at end of file
+}
+// TestResponseWriterPreservesFlusher tests that streaming handlers can still flush through the wrapper
+func TestResponseWriterPreservesFlusher(t *testing.T) {
+	w := httptest.NewRecorder()
+	rw := app.NewResponseWriter(w)
+
+	var _ http.Flusher = rw
+	rw.Write([]byte("chunk"))
+	if err := http.NewResponseController(rw).Flush(); err != nil {
+		t.Fatalf("expected flush to succeed, got %v", err)
+	}
+
+	if !w.Flushed {
+		t.Error("expected underlying recorder to be flushed")
+	}
+	if rw.BytesWritten != 5 {
+		t.Errorf("expected 5 bytes written, got %d", rw.BytesWritten)
+	}
+}
+
+// TestChainOrder tests that the first middleware passed to Chain is the outermost
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) app.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := app.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mw("a"), mw("b"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := strings.Join(order, ","); got != "a,b,handler" {
+		t.Errorf("expected order a,b,handler, got %s", got)
+	}
+}
+
+// TestSecurityHeadersHSTS tests that HSTS is only sent when configured
+func TestSecurityHeadersHSTS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	app.SecurityHeaders(app.SecurityHeadersConfig{})(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if v := w.Header().Get("Strict-Transport-Security"); v != "" {
+		t.Errorf("expected no HSTS header by default, got %q", v)
+	}
+
+	w = httptest.NewRecorder()
+	cfg := app.SecurityHeadersConfig{CSP: "default-src 'none'", HSTSMaxAge: 24 * time.Hour, HSTSIncludeSubdomains: true}
+	app.SecurityHeaders(cfg)(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if v := w.Header().Get("Strict-Transport-Security"); v != "max-age=86400; includeSubDomains" {
+		t.Errorf("unexpected HSTS header %q", v)
+	}
+	if v := w.Header().Get("Content-Security-Policy"); v != "default-src 'none'" {
+		t.Errorf("unexpected CSP header %q", v)
+	}
+}
+
+// TestRequestIDMiddleware tests that request ids are generated or propagated
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := app.RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = app.RequestIDFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(app.RequestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen != "abc-123" || w.Header().Get(app.RequestIDHeader) != "abc-123" {
+		t.Errorf("expected incoming request id to be propagated, got %q", seen)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(app.RequestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen == "" || seen == "bad id\n" {
+		t.Errorf("expected a generated request id, got %q", seen)
+	}
+}
+
+// TestRecoveryMiddleware tests that handler panics become a 500 problem response
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := app.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), app.RequestIDMiddleware, app.RecoveryMiddleware)
+
+	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected problem content type, got %q", ct)
+	}
+
+	var problem app.Problem
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Status != http.StatusInternalServerError || problem.RequestID == "" {
+		t.Errorf("unexpected problem body %+v", problem)
+	}
+	if problem.RequestID != w.Header().Get(app.RequestIDHeader) {
+		t.Errorf("expected problem request id to match header, got %q", problem.RequestID)
+	}
+}
+
+// TestRedactConfig tests that sensitive config fields are hidden on the admin config dump
+func TestRedactConfig(t *testing.T) {
+	cfg := map[string]any{
+		"db_user":     "app",
+		"db_password": "hunter2",
+		"nested":      map[string]any{"api_token": "abc", "host": "127.0.0.1"},
+	}
+
+	out, err := app.RedactConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to redact config: %v", err)
+	}
+	data, _ := json.Marshal(out)
+
+	if bytes.Contains(data, []byte("hunter2")) || bytes.Contains(data, []byte(`"abc"`)) {
+		t.Errorf("expected secrets to be redacted, got %s", data)
+	}
+	if !bytes.Contains(data, []byte(`"db_user":"app"`)) || !bytes.Contains(data, []byte("127.0.0.1")) {
+		t.Errorf("expected non-secret values to be kept, got %s", data)
+	}
+}
+
+// TestLogLevelHandler tests changing the global log level through the admin endpoint
+func TestLogLevelHandler(t *testing.T) {
+	original := app.LogLevel.Level()
+	defer app.LogLevel.Set(original)
+
+	req := httptest.NewRequest(http.MethodPut, "/debug/loglevel?level=warn", nil)
+	w := httptest.NewRecorder()
+	app.LogLevelHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if app.LogLevel.Level() != slog.LevelWarn {
+		t.Errorf("expected level WARN, got %s", app.LogLevel.Level())
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/debug/loglevel?level=loud", nil)
+	w = httptest.NewRecorder()
+	app.LogLevelHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid level, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// TestMetricsHandler tests that the metrics listener serves metrics and no admin endpoints
+func TestMetricsHandler(t *testing.T) {
+	handler := app.NewMetricsHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d for /metrics, got %d", http.StatusOK, w.Code)
+	}
+	for _, path := range []string{"/debug/faults", "/debug/readonly", "/debug/loglevel", "/debug/pprof/", "/debug/config"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected %s not to be served, got %d", path, w.Code)
+		}
+	}
+}
+
+// TestVersionEndpoint tests that build metadata is served and added to responses
+func TestVersionEndpoint(t *testing.T) {
+	w := httptest.NewRecorder()
+	app.VersionHandler(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	var info app.BuildInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("failed to decode version: %v", err)
+	}
+	if info.Version == "" || info.Commit == "" || info.GoVersion == "" {
+		t.Errorf("expected populated build info, got %+v", info)
+	}
+
+	w = httptest.NewRecorder()
+	app.VersionHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Header().Get(app.VersionHeader); got != info.Version {
+		t.Errorf("expected %s header %q, got %q", app.VersionHeader, info.Version, got)
+	}
+}
+
+// TestSLOTrackerBurnRate tests SLI and burn rate computation over rolling windows
+func TestSLOTrackerBurnRate(t *testing.T) {
+	tracker := app.NewSLOTracker(app.DefaultSLOConfig)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// 990 good requests and 10 server errors in the last hour => 1% errors = 10x burn
+	for i := 0; i < 990; i++ {
+		tracker.RecordAt(now.Add(-30*time.Minute), http.StatusOK, 10*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		tracker.RecordAt(now.Add(-30*time.Minute), http.StatusServiceUnavailable, time.Second)
+	}
+	// Old traffic outside the 1h window but inside 6h
+	tracker.RecordAt(now.Add(-3*time.Hour), http.StatusOK, time.Millisecond)
+
+	summary := tracker.SummaryAt(now)
+	availability := summary.Objectives[0]
+	if availability.Name != "availability" {
+		t.Fatalf("expected availability objective first, got %q", availability.Name)
+	}
+
+	windows := map[string]app.SLIWindow{}
+	for _, w := range availability.Windows {
+		windows[w.Window] = w
+	}
+	if w := windows["5m"]; w.Total != 0 || w.SLI != 1 {
+		t.Errorf("expected empty 5m window, got %+v", w)
+	}
+	if w := windows["1h"]; w.Total != 1000 || w.SLI != 0.99 {
+		t.Errorf("unexpected 1h window %+v", w)
+	}
+	if w := windows["6h"]; w.Total != 1001 {
+		t.Errorf("expected 1001 requests in 6h window, got %d", w.Total)
+	}
+	if rate := windows["1h"].BurnRate; rate < 9.99 || rate > 10.01 {
+		t.Errorf("expected 1h burn rate of 10, got %f", rate)
+	}
+}
+
+// TestAIMDLimiter tests priority-based shedding and limit adaptation
+func TestAIMDLimiter(t *testing.T) {
+	l := app.NewAIMDLimiter(app.LimiterConfig{
+		InitialLimit:     5,
+		MinLimit:         1,
+		MaxLimit:         10,
+		LatencyThreshold: 100 * time.Millisecond,
+		BackoffRatio:     0.5,
+		LowPriorityShare: 0.6,
+	})
+
+	// Low priority may only use 60% of the limit (3 of 5)
+	for i := 0; i < 3; i++ {
+		if !l.Acquire(app.PriorityLow) {
+			t.Fatalf("expected low priority request %d to be admitted", i)
+		}
+	}
+	if l.Acquire(app.PriorityLow) {
+		t.Error("expected low priority request to be shed above its share")
+	}
+	if !l.Acquire(app.PriorityNormal) || !l.Acquire(app.PriorityNormal) {
+		t.Fatal("expected normal priority requests to use the remaining capacity")
+	}
+	if l.Acquire(app.PriorityNormal) {
+		t.Error("expected normal priority request to be shed at the limit")
+	}
+	if !l.Acquire(app.PriorityCritical) {
+		t.Error("expected critical requests to never be shed")
+	}
+	l.Release(app.PriorityCritical, 0, false)
+
+	// A slow request halves the limit
+	l.Release(app.PriorityNormal, time.Second, false)
+	if got := l.Limit(); got != 2 {
+		t.Errorf("expected limit 2 after congestion, got %d", got)
+	}
+}
+
+// TestConcurrencyLimitMiddlewareSheds tests the 503 response for shed requests
+func TestConcurrencyLimitMiddlewareSheds(t *testing.T) {
+	l := app.NewAIMDLimiter(app.LimiterConfig{InitialLimit: 1, MinLimit: 1, MaxLimit: 1, LowPriorityShare: 1, RetryAfter: 2 * time.Second})
+	l.Acquire(app.PriorityNormal) // Occupy the only slot
+
+	handler := app.ConcurrencyLimitMiddleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/todos", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected health check to bypass the limiter, got %d", w.Code)
+	}
+}
+
+// TestRequestPriority tests that only probes and sign-in are never shed
+func TestRequestPriority(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		expected     app.Priority
+	}{
+		{http.MethodGet, "/healthz", app.PriorityCritical},
+		{http.MethodGet, "/readyz", app.PriorityCritical},
+		{http.MethodGet, "/auth/callback", app.PriorityCritical},
+		{http.MethodGet, "/auth/login", app.PriorityCritical},
+		{http.MethodPost, "/auth/logout", app.PriorityCritical},
+		{http.MethodGet, "/auth/me", app.PriorityLow},
+		{http.MethodGet, "/tokens", app.PriorityLow},
+		{http.MethodGet, "/todos", app.PriorityLow},
+		{http.MethodGet, "/todos/1/history", app.PriorityLow},
+		{http.MethodGet, "/lists", app.PriorityLow},
+		{http.MethodGet, "/tags", app.PriorityLow},
+		{http.MethodGet, "/trash", app.PriorityLow},
+		{http.MethodGet, "/", app.PriorityLow},
+		{http.MethodGet, "/healthzz", app.PriorityLow},
+		{http.MethodPost, "/todos", app.PriorityNormal},
+		{http.MethodDelete, "/lists/5", app.PriorityNormal},
+		{http.MethodPost, "/tokens", app.PriorityNormal},
+	} {
+		if p := app.RequestPriority(httptest.NewRequest(tc.method, tc.path, nil)); p != tc.expected {
+			t.Errorf("%s %s: expected priority %s, got %s", tc.method, tc.path, tc.expected, p)
+		}
+	}
+}
+
+// TestConcurrencyLimitMiddlewarePanic tests that a panicking handler counts as a failure
+func TestConcurrencyLimitMiddlewarePanic(t *testing.T) {
+	l := app.NewAIMDLimiter(app.LimiterConfig{InitialLimit: 4, MinLimit: 1, MaxLimit: 4, LatencyThreshold: time.Minute,
+		BackoffRatio: 0.5, LowPriorityShare: 1})
+	handler := app.ConcurrencyLimitMiddleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to reach the recovery middleware")
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/todos", nil))
+	}()
+	if got := l.Limit(); got != 2 {
+		t.Errorf("expected the limit to back off to 2 after a panic, got %d", got)
+	}
+	// The slot was released
+	for i := 0; i < 2; i++ {
+		if !l.Acquire(app.PriorityNormal) {
+			t.Fatalf("expected request %d to be admitted after the panic", i)
+		}
+	}
+}
+
+// TestRateLimitMiddleware tests token bucket limits, headers and per-client keys
+func TestRateLimitMiddleware(t *testing.T) {
+	rl := &app.RateLimiter{
+		Rules: []app.RateLimitRule{
+			{Method: http.MethodPost, PathPrefix: "/todos", Policy: app.RateLimitPolicy{Name: "test-write", Rate: 0.001, Burst: 2}},
+		},
+		Store: app.NewMemoryRateLimitStore(time.Minute),
+	}
+	handler := app.RateLimitMiddleware(rl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	post := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/todos", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("10.0.0.1:1234"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("expected first request allowed with 1 remaining, got %d %q", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+	post("10.0.0.1:1234")
+	w := post("10.0.0.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d after burst, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("expected Retry-After and RateLimit-Limit headers, got %v", w.Header())
+	}
+
+	// Other clients have their own bucket
+	if w := post("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected other client to be allowed, got %d", w.Code)
+	}
+
+	// Routes without a policy are not limited
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Header().Get("RateLimit-Limit") != "" {
+		t.Error("expected no rate limit headers on unlimited routes")
+	}
+}
+
+// TestRateLimitClientKey tests that clients are keyed by their verified user, never by unverified credentials
+func TestRateLimitClientKey(t *testing.T) {
+	rl := &app.RateLimiter{
+		Rules: []app.RateLimitRule{
+			{PathPrefix: "/lists", Policy: app.RateLimitPolicy{Name: "test", Rate: 0.001, Burst: 1}},
+		},
+		Store: app.NewMemoryRateLimitStore(time.Minute),
+	}
+	handler := app.RateLimitMiddleware(rl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr, bearer string, p *app.Principal) int {
+		req := httptest.NewRequest(http.MethodGet, "/lists", nil)
+		req.RemoteAddr = remoteAddr
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		if p != nil {
+			req = req.WithContext(app.WithPrincipal(req.Context(), p))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A new bearer value on every request doesn't get a new bucket
+	if code := serve("10.0.0.1:1234", "todo_random1", nil); code != http.StatusOK {
+		t.Errorf("expected first request allowed, got %d", code)
+	}
+	if code := serve("10.0.0.1:1234", "todo_random2", nil); code != http.StatusTooManyRequests {
+		t.Errorf("expected unverified credentials to share the client IP's bucket, got %d", code)
+	}
+
+	// Users are limited wherever they connect from
+	alice := &app.Principal{UserID: 7, TenantID: 1, Method: "token"}
+	if code := serve("10.0.0.2:1234", "", alice); code != http.StatusOK {
+		t.Errorf("expected first request of the user allowed, got %d", code)
+	}
+	if code := serve("10.0.0.3:1234", "", alice); code != http.StatusTooManyRequests {
+		t.Errorf("expected the user's bucket to follow them across IPs, got %d", code)
+	}
+	if code := serve("10.0.0.3:1234", "", &app.Principal{UserID: 8, TenantID: 1}); code != http.StatusOK {
+		t.Errorf("expected another user behind the same IP to be allowed, got %d", code)
+	}
+
+	// Every data endpoint is limited by default
+	for _, path := range []string{"/todos", "/todos/1/history", "/lists/5", "/tags", "/trash", "/tokens"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		matched := false
+		for _, rule := range app.DefaultRateLimitRules {
+			if req.Method == rule.Method && strings.HasPrefix(path, rule.PathPrefix) {
+				matched = true
+			}
+		}
+		if !matched {
+			t.Errorf("expected a default rate limit rule for GET %s", path)
+		}
+	}
+}
+
+// TestAuthFailureRateLimit tests that invalid credentials are limited per client IP
+func TestAuthFailureRateLimit(t *testing.T) {
+	originalRateLimit := app.RateLimit
+	app.RateLimit = &app.RateLimiter{
+		Store:        app.NewMemoryRateLimitStore(time.Minute),
+		AuthFailures: app.RateLimitPolicy{Name: "test-auth-failures", Rate: 0.001, Burst: 2},
+	}
+	defer func() { app.RateLimit = originalRateLimit }()
+
+	invalid := func(r *http.Request) (*app.Principal, error) { return nil, app.ErrUnauthenticated }
+	handler := app.AuthMiddleware(invalid)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := serve("10.0.0.1:1234"); code != http.StatusUnauthorized {
+			t.Errorf("expected status %d for invalid credentials, got %d", http.StatusUnauthorized, code)
+		}
+	}
+	if code := serve("10.0.0.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d once the IP used up its failures, got %d", http.StatusTooManyRequests, code)
+	}
+	if code := serve("10.0.0.2:1234"); code != http.StatusUnauthorized {
+		t.Errorf("expected another IP to be unaffected, got %d", code)
+	}
+}
+
+// TestClientIP tests X-Forwarded-For handling for trusted proxies
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.9:5555"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 130.211.0.1")
+
+	if ip := app.ClientIP(req, 0); ip != "10.0.0.9" {
+		t.Errorf("expected peer address without trusted hops, got %q", ip)
+	}
+	if ip := app.ClientIP(req, 2); ip != "203.0.113.7" {
+		t.Errorf("expected client appended by the load balancer, got %q", ip)
+	}
+}
+
+// TestListCacheEviction tests that the list cache is bounded and LRU-ordered
+func TestListCacheEviction(t *testing.T) {
+	c := app.NewListCache(2)
+	c.Put("a", []app.Todo{{ID: 1}})
+	c.Put("b", []app.Todo{{ID: 2}})
+	c.Get("a") // "b" is now least recently used
+	c.Put("c", []app.Todo{{ID: 3}})
+
+	if _, _, ok := c.Get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if todos, _, ok := c.Get("a"); !ok || todos[0].ID != 1 {
+		t.Errorf("expected entry a to be kept, got %v", todos)
+	}
+}
+
+// TestStaleTodosCacheKey tests that stale reads are keyed by the parsed filter, so
+// parameter order and unknown parameters don't matter but the filter does
+func TestStaleTodosCacheKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalDBRead, originalCB, originalBackoff := app.DB, app.DBRead, app.CB, app.BackoffStrategy
+	app.DB, app.DBRead = db, db
+	app.CB = gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "TestStaleKeyCB"})
+	app.BackoffStrategy = &backoff.StopBackOff{}
+	app.TodoCache.Clear()
+	defer func() {
+		app.DB, app.DBRead, app.CB, app.BackoffStrategy = originalDB, originalDBRead, originalCB, originalBackoff
+		app.TodoCache.Clear()
+	}()
+
+	principal := &app.Principal{UserID: 7, TenantID: 1}
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/todos?"+query, nil)
+		w := httptest.NewRecorder()
+		app.GetTodos(w, req.WithContext(app.WithPrincipal(req.Context(), principal)))
+		return w
+	}
+
+	expectTenantTx(mock, 1)
+	mock.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(todoRows(app.Todo{ID: 1, Task: "Cached", ListID: 5}))
+	mock.ExpectCommit()
+	if w := get("priority=high,urgent&tag=release&tag=oncall,infra&utm_source=mail"); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// The same filter, written differently, is served from the cache
+	expectTenantTx(mock, 1)
+	mock.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(errors.New("database unavailable"))
+	mock.ExpectRollback()
+	if w := get("tag=infra,oncall&priority=urgent,high&tag=release"); w.Code != http.StatusOK || w.Header().Get("X-Stale") != "true" {
+		t.Errorf("expected a stale response for the same filter, got %d (X-Stale=%q)", w.Code, w.Header().Get("X-Stale"))
+	}
+
+	// Another filter isn't
+	expectTenantTx(mock, 1)
+	mock.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(errors.New("database unavailable"))
+	mock.ExpectRollback()
+	if w := get("priority=high"); w.Header().Get("X-Stale") != "" {
+		t.Errorf("expected no stale response for another filter, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestReadOnlyModeRejectsWrites tests that writes fail fast with 503 in read-only mode
+func TestReadOnlyModeRejectsWrites(t *testing.T) {
+	app.SetReadOnly(true, "database maintenance")
+	defer app.SetReadOnly(false, "")
+
+	req := httptest.NewRequest(http.MethodPost, "/todos", bytes.NewBufferString(`{"task": "test"}`))
+	w := httptest.NewRecorder()
+	app.AddTodo(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "database maintenance") {
+		t.Errorf("expected reason in response, got %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, httptest.NewRequest(http.MethodDelete, "/todos/1", nil), 1)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected delete to be rejected, got %d", w.Code)
+	}
+}
+
+// TestReadOnlyModeRejectsListWrites tests that list changes fail fast with 503 in read-only mode
+func TestReadOnlyModeRejectsListWrites(t *testing.T) {
+	app.SetReadOnly(true, "database maintenance")
+	defer app.SetReadOnly(false, "")
+
+	principal := &app.Principal{UserID: 7, TenantID: 1}
+	tests := []struct {
+		method, path, body string
+		handler            http.HandlerFunc
+	}{
+		{http.MethodPost, "/lists", `{"name": "Release"}`, app.HandleLists},
+		{http.MethodDelete, "/lists/1", "", app.HandleList},
+		{http.MethodPost, "/lists/1/members", `{"user_id": 8, "role": "editor"}`, app.HandleList},
+		{http.MethodDelete, "/lists/1/members/8", "", app.HandleList},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		tt.handler(w, req.WithContext(app.WithPrincipal(req.Context(), principal)))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "database maintenance") {
+			t.Errorf("%s %s: expected status %d with the reason, got %d: %s", tt.method, tt.path, http.StatusServiceUnavailable, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestReadOnlyModeRejectsTokenWrites tests that creating and revoking tokens fail fast with 503 in read-only mode
+func TestReadOnlyModeRejectsTokenWrites(t *testing.T) {
+	app.SetReadOnly(true, "database maintenance")
+	defer app.SetReadOnly(false, "")
+
+	principal := &app.Principal{UserID: 7, TenantID: 1, Method: "session"}
+	tests := []struct {
+		method, path, body string
+		handler            http.HandlerFunc
+	}{
+		{http.MethodPost, "/tokens", `{"name": "script", "scope": "read"}`, app.HandleTokens},
+		{http.MethodDelete, "/tokens/3", "", app.HandleToken},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		tt.handler(w, req.WithContext(app.WithPrincipal(req.Context(), principal)))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "database maintenance") {
+			t.Errorf("%s %s: expected status %d with Retry-After and the reason, got %d: %s", tt.method, tt.path, http.StatusServiceUnavailable, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestFaultInjection tests that faults require enabling and are applied to operations and routes
+func TestFaultInjection(t *testing.T) {
+	f := app.NewFaultInjector()
+	if _, err := f.Add(app.FaultRule{Operation: "todos.add", Kind: app.FaultError, Percent: 100}, time.Minute); err == nil {
+		t.Fatal("expected rules to be refused while fault injection is disabled")
+	}
+
+	f.Enable()
+	if _, err := f.Add(app.FaultRule{Operation: "todos.list", Kind: app.FaultConnection, Percent: 100}, time.Minute); err != nil {
+		t.Fatalf("failed to add rule: %v", err)
+	}
+	if err := f.Inject(context.Background(), "todos.list.replica"); !errors.Is(err, driver.ErrBadConn) {
+		t.Errorf("expected injected connection failure, got %v", err)
+	}
+	if err := f.Inject(context.Background(), "todos.add"); err != nil {
+		t.Errorf("expected other operations to be unaffected, got %v", err)
+	}
+
+	if _, err := f.Add(app.FaultRule{Route: "/todos", Method: "post", Kind: app.FaultError, Status: http.StatusBadGateway, Percent: 100}, time.Minute); err != nil {
+		t.Fatalf("failed to add route rule: %v", err)
+	}
+	handler := app.FaultInjectionMiddleware(f)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/todos", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected injected status %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/todos", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected GET to be unaffected, got %d", w.Code)
+	}
+
+	// Expired rules are dropped
+	if _, err := f.Add(app.FaultRule{Operation: "todos.delete", Kind: app.FaultError, Percent: 100}, time.Nanosecond); err != nil {
+		t.Fatalf("failed to add rule: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := f.Inject(context.Background(), "todos.delete"); err != nil {
+		t.Errorf("expected expired rule to be ignored, got %v", err)
+	}
+}
+
+// TestDBConfigReadReplicas tests merging the legacy replica fields with the replica list
+func TestDBConfigReadReplicas(t *testing.T) {
+	var config app.DBConfig
+	err := json.Unmarshal([]byte(`{
+		"db_port": "5432",
+		"db_read_host": "127.0.0.1",
+		"db_read_port": "5433",
+		"db_read_replicas": [{"host": "10.0.0.5"}, {"host": "10.0.0.6", "port": "6432"}]
+	}`), &config)
+	if err != nil {
+		t.Fatalf("failed to unmarshal DBConfig: %v", err)
+	}
+
+	replicas := config.ReadReplicas()
+	expected := []app.ReplicaEndpoint{{Host: "127.0.0.1", Port: "5433"}, {Host: "10.0.0.5", Port: "5432"}, {Host: "10.0.0.6", Port: "6432"}}
+	if len(replicas) != len(expected) {
+		t.Fatalf("expected %d replicas, got %v", len(expected), replicas)
+	}
+	for i := range expected {
+		if replicas[i] != expected[i] {
+			t.Errorf("replica %d: expected %v, got %v", i, expected[i], replicas[i])
+		}
+	}
+}
+
+// TestHedgerRead tests when a read is hedged to the primary and which result wins
+func TestHedgerRead(t *testing.T) {
+	replicaDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer replicaDB.Close()
+	primaryDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer primaryDB.Close()
+
+	cfg := app.DefaultHedgeConfig
+	cfg.Enabled = true
+	cfg.MinDelay, cfg.MaxDelay = 30*time.Millisecond, 30*time.Millisecond
+	type outcome struct {
+		latency time.Duration
+		err     error
+	}
+
+	// The replica answers within the delay: no hedge
+	h := app.NewHedger(cfg)
+	var primaryCalls atomic.Int32
+	todos, err := h.Read(context.Background(), replicaDB, primaryDB, func(ctx context.Context, db *sql.DB) ([]app.Todo, error) {
+		if db == primaryDB {
+			primaryCalls.Add(1)
+			return []app.Todo{{Task: "primary"}}, nil
+		}
+		return []app.Todo{{Task: "replica"}}, nil
+	}, nil)
+	if err != nil || todos[0].Task != "replica" || primaryCalls.Load() != 0 {
+		t.Errorf("expected the fast replica to answer alone, got %v, %v, %d primary calls", todos, err, primaryCalls.Load())
+	}
+
+	// The replica is slow: the primary is tried after the delay, wins, and the replica is cancelled
+	h = app.NewHedger(cfg)
+	start := time.Now()
+	var hedgedAfter time.Duration
+	replicaCancelled := make(chan struct{})
+	var reports []outcome
+	todos, err = h.Read(context.Background(), replicaDB, primaryDB, func(ctx context.Context, db *sql.DB) ([]app.Todo, error) {
+		if db == primaryDB {
+			hedgedAfter = time.Since(start)
+			return []app.Todo{{Task: "primary"}}, nil
+		}
+		select {
+		case <-ctx.Done():
+			close(replicaCancelled)
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return []app.Todo{{Task: "replica"}}, nil
+		}
+	}, func(latency time.Duration, err error) { reports = append(reports, outcome{latency, err}) })
+	if err != nil || todos[0].Task != "primary" {
+		t.Errorf("expected the primary's result to win, got %v, %v", todos, err)
+	}
+	if hedgedAfter < cfg.MaxDelay {
+		t.Errorf("expected the hedge to fire after %v, fired after %v", cfg.MaxDelay, hedgedAfter)
+	}
+	select {
+	case <-replicaCancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the losing replica query to be cancelled")
+	}
+	if len(reports) != 0 {
+		t.Errorf("expected a cancelled replica query not to be reported, got %v", reports)
+	}
+
+	// A replica that fails after the hedge fired is still reported
+	h = app.NewHedger(cfg)
+	replicaErr := errors.New("replica broken")
+	reported := make(chan outcome, 1)
+	todos, err = h.Read(context.Background(), replicaDB, primaryDB, func(ctx context.Context, db *sql.DB) ([]app.Todo, error) {
+		if db == primaryDB {
+			time.Sleep(100 * time.Millisecond)
+			return []app.Todo{{Task: "primary"}}, nil
+		}
+		time.Sleep(60 * time.Millisecond)
+		return nil, replicaErr
+	}, func(latency time.Duration, err error) { reported <- outcome{latency, err} })
+	if err != nil || todos[0].Task != "primary" {
+		t.Errorf("expected the primary's result, got %v, %v", todos, err)
+	}
+	select {
+	case o := <-reported:
+		if !errors.Is(o.err, replicaErr) {
+			t.Errorf("expected the replica failure to be reported, got %v", o.err)
+		}
+	default:
+		t.Error("expected the hedged replica failure to be reported")
+	}
+
+	// When both fail, the caller gets the primary's error
+	h = app.NewHedger(cfg)
+	primaryErr := errors.New("primary broken")
+	_, err = h.Read(context.Background(), replicaDB, primaryDB, func(ctx context.Context, db *sql.DB) ([]app.Todo, error) {
+		if db == primaryDB {
+			return nil, primaryErr
+		}
+		return nil, replicaErr
+	}, nil)
+	if !errors.Is(err, primaryErr) {
+		t.Errorf("expected the primary's error, got %v", err)
+	}
+
+	// A query without a tenant isn't retried on the primary
+	primaryCalls.Store(0)
+	_, err = h.Read(context.Background(), replicaDB, primaryDB, func(ctx context.Context, db *sql.DB) ([]app.Todo, error) {
+		if db == primaryDB {
+			primaryCalls.Add(1)
+			return nil, primaryErr
+		}
+		return nil, app.ErrNoTenant
+	}, nil)
+	if !errors.Is(err, app.ErrNoTenant) || primaryCalls.Load() != 0 {
+		t.Errorf("expected ErrNoTenant without a primary call, got %v, %d primary calls", err, primaryCalls.Load())
+	}
+
+	// Without budget, the read waits for the replica
+	cfg.BudgetRatio, cfg.MaxBurst = 0, 0
+	h = app.NewHedger(cfg)
+	primaryCalls.Store(0)
+	todos, err = h.Read(context.Background(), replicaDB, primaryDB, func(ctx context.Context, db *sql.DB) ([]app.Todo, error) {
+		if db == primaryDB {
+			primaryCalls.Add(1)
+			return []app.Todo{{Task: "primary"}}, nil
+		}
+		time.Sleep(60 * time.Millisecond)
+		return []app.Todo{{Task: "replica"}}, nil
+	}, nil)
+	if err != nil || todos[0].Task != "replica" || primaryCalls.Load() != 0 {
+		t.Errorf("expected no hedge without budget, got %v, %v, %d primary calls", todos, err, primaryCalls.Load())
+	}
+}
+
+// TestHedgedReadsOnlyForReads tests that list reads are hedged and reported to the
+// replica pool, and that writes are never hedged
+func TestHedgedReadsOnlyForReads(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer primary.Close()
+	replica, replicaMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer replica.Close()
+
+	originalDB, originalDBRead, originalReplicas, originalHedging := app.DB, app.DBRead, app.Replicas, app.Hedging
+	defer func() {
+		app.DB, app.DBRead, app.Replicas, app.Hedging = originalDB, originalDBRead, originalReplicas, originalHedging
+		app.TodoCache.Clear()
+	}()
+	poolConfig := app.DefaultReplicaPoolConfig
+	poolConfig.EjectAfter = 1
+	pool := app.NewReplicaPool(poolConfig)
+	member := pool.Add("replica", replica, true)
+	app.DB, app.DBRead, app.Replicas = primary, primary, pool
+	cfg := app.DefaultHedgeConfig
+	cfg.Enabled = true
+	cfg.MinDelay, cfg.MaxDelay = 10*time.Millisecond, 10*time.Millisecond
+	app.Hedging = app.NewHedger(cfg)
+
+	alice := &app.Principal{UserID: 7, TenantID: 1, Subject: "test:alice", Method: "session"}
+	serve := func(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h(w, req.WithContext(app.WithPrincipal(req.Context(), alice)))
+		return w
+	}
+
+	// The replica fails after the read was hedged; the primary answers and the replica is ejected
+	hedged := counterValue(t, "hedged_reads_total")
+	replicaMock.ExpectBegin().WillDelayFor(50 * time.Millisecond).WillReturnError(errors.New("replica broken"))
+	expectTenantTx(primaryMock, alice.TenantID)
+	primaryMock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t").WillDelayFor(150 * time.Millisecond).
+		WillReturnRows(todoRows(app.Todo{ID: 1, Task: "From primary", ListID: 5}))
+	primaryMock.ExpectCommit()
+	if w := serve(app.GetTodos, http.MethodGet, "/todos", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "From primary") {
+		t.Errorf("expected the primary's result, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := counterValue(t, "hedged_reads_total"); got != hedged+1 {
+		t.Errorf("expected the read to be hedged, got %v hedges", got-hedged)
+	}
+	if member.Healthy() {
+		t.Error("expected the replica that failed a hedged read to be ejected")
+	}
+
+	// A slow write stays on the primary
+	hedged = counterValue(t, "hedged_reads_total")
+	expectTenantTx(primaryMock, alice.TenantID)
+	primaryMock.ExpectQuery("INSERT INTO todos AS t").WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(todoRows(app.Todo{ID: 2, Task: "Write", ListID: 5}))
+	primaryMock.ExpectExec("INSERT INTO todo_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	primaryMock.ExpectCommit()
+	if w := serve(app.AddTodo, http.MethodPost, "/todos", `{"task": "Write", "list_id": 5}`); w.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if got := counterValue(t, "hedged_reads_total"); got != hedged {
+		t.Errorf("expected writes not to be hedged, got %v hedges", got-hedged)
+	}
+
+	for _, mock := range []sqlmock.Sqlmock{primaryMock, replicaMock} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unfulfilled expectations: %v", err)
+		}
+	}
+}
+
+// counterValue returns the value of a counter registered with the default registry, summed over its labels.
+func counterValue(t *testing.T, name string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			var sum float64
+			for _, metric := range family.GetMetric() {
+				sum += metric.GetCounter().GetValue()
+			}
+			return sum
+		}
+	}
+	return 0
+}
+
+// TestReplicaPoolEjection tests balancing, ejection on failures and re-admission by health checks
+func TestReplicaPoolEjection(t *testing.T) {
+	dbA, mockA, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer dbA.Close()
+	dbB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer dbB.Close()
+
+	cfg := app.DefaultReplicaPoolConfig
+	cfg.EjectAfter = 2
+	cfg.ReadmitAfter = 1
+	pool := app.NewReplicaPool(cfg)
+	a := pool.Add("a", dbA, true)
+	b := pool.Add("b", dbB, true)
+
+	// Round robin alternates between healthy replicas
+	if first, second := pool.Pick(), pool.Pick(); first == second {
+		t.Error("expected round robin to alternate replicas")
+	}
+
+	// Two failed queries eject a
+	pool.ReportQuery(a, time.Millisecond, errors.New("boom"))
+	pool.ReportQuery(a, time.Millisecond, errors.New("boom"))
+	if a.Healthy() {
+		t.Fatal("expected replica a to be ejected")
+	}
+	for i := 0; i < 3; i++ {
+		if pool.Pick() != b {
+			t.Fatal("expected only replica b to be picked while a is ejected")
+		}
+	}
+
+	// A successful query doesn't re-admit, a health check does
+	pool.ReportQuery(a, time.Millisecond, nil)
+	if a.Healthy() {
+		t.Error("expected queries not to re-admit an ejected replica")
+	}
+	mockA.ExpectPing()
+	pool.Check(context.Background())
+	if !a.Healthy() {
+		t.Error("expected replica a to be re-admitted after a successful health check")
+	}
+}
+
+// TestStoreNotReadyWhileConnecting tests that data endpoints and probes return 503 until the database answers
+func TestStoreNotReadyWhileConnecting(t *testing.T) {
+	originalDB, originalDBRead := app.DB, app.DBRead
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	// Nothing listens on port 1, so the background connection keeps retrying
+	app.InitDB(app.DBConfig{DBUser: "test", DBName: "test", DBHost: "127.0.0.1", DBPort: "1"})
+	defer app.CloseDB()
+
+	if app.StoreReady() {
+		t.Fatal("expected store not to be ready while connecting")
+	}
+
+	handlerCalled := false
+	handler := app.RequireStore(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerCalled = true
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/todos", nil))
+	if w.Code != http.StatusServiceUnavailable || handlerCalled {
+		t.Errorf("expected 503 without calling the handler, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+
+	// The pod stays alive while connecting; only readiness waits for the database
+	w = httptest.NewRecorder()
+	app.HealthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected /healthz to return 200 while connecting, got %d", w.Code)
+	}
+
+	// Wait for the first failed attempt to be reported
+	var status app.StoreStatus
+	for i := 0; i < 100; i++ {
+		w = httptest.NewRecorder()
+		app.ReadyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected /readyz to return 503 while connecting, got %d", w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("failed to decode readiness status: %v", err)
+		}
+		if status.LastError != "" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status.Phase != app.StorePhaseConnectingPrimary || status.Attempts < 1 || status.LastError == "" {
+		t.Errorf("expected connection progress to be reported, got %+v", status)
+	}
+
+	app.CloseDB()
+	if !app.StoreReady() {
+		t.Error("expected CloseDB to reset the store state")
+	}
+}
+
+// TestStoreTLSFailureIsRetried tests that TLS files that can't be written are retried and reported by /readyz
+func TestStoreTLSFailureIsRetried(t *testing.T) {
+	originalDB, originalDBRead := app.DB, app.DBRead
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	// The TLS directory is created on first use, in a temporary directory that doesn't exist yet
+	tmp := os.TempDir()
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	const fakePEM = "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"
+	app.InitDB(app.DBConfig{DBUser: "test", DBName: "test", DBHost: "127.0.0.1", DBPort: "1",
+		DBSSLMode: "verify-full", DBSSLRootCertPEM: fakePEM})
+	defer app.CloseDB()
+
+	waitFor := func(done func(app.StoreStatus) bool) app.StoreStatus {
+		t.Helper()
+		var status app.StoreStatus
+		for i := 0; i < 200; i++ {
+			w := httptest.NewRecorder()
+			app.ReadyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected /readyz to return 503, got %d", w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("failed to decode readiness status: %v", err)
+			}
+			if done(status) {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return status
+	}
+
+	status := waitFor(func(s app.StoreStatus) bool { return s.Attempts >= 2 })
+	if status.Phase != app.StorePhaseTLSFailed || status.Attempts < 2 || !strings.Contains(status.LastError, "TLS directory") {
+		t.Errorf("expected the TLS failure to be retried and reported, got %+v", status)
+	}
+
+	// Once the files can be written, the connection moves on to the primary
+	t.Setenv("TMPDIR", tmp)
+	status = waitFor(func(s app.StoreStatus) bool { return s.Phase != app.StorePhaseTLSFailed })
+	if status.Phase != app.StorePhaseConnectingPrimary {
+		t.Errorf("expected the connection to proceed to the primary, got %+v", status)
+	}
+}
+
+// TestSecretWatcher tests that config changes in the secret are applied once, and retried on failure
+func TestSecretWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret.json")
+	write := func(password string) {
+		secret := fmt.Sprintf(`{"db_user": "app", "db_host": "127.0.0.1", "db_port": "5432", "db_password": %q}`, password)
+		if err := os.WriteFile(path, []byte(secret), 0o600); err != nil {
+			t.Fatalf("failed to write secret: %v", err)
+		}
+	}
+	write("first")
+
+	source := app.FileSecretSource(path)
+	initial, err := app.LoadDBConfig(context.Background(), source)
+	if err != nil {
+		t.Fatalf("failed to load secret: %v", err)
+	}
+	if initial.DBPassword != "first" {
+		t.Fatalf("expected password to be parsed, got %+v", initial)
+	}
+
+	var applied []app.DBConfig
+	failNext := false
+	watcher := app.NewSecretWatcher(source, initial, func(config app.DBConfig) error {
+		if failNext {
+			failNext = false
+			return errors.New("connect failed")
+		}
+		applied = append(applied, config)
+		return nil
+	})
+
+	if changed, err := watcher.Poll(context.Background()); changed || err != nil {
+		t.Errorf("expected no change for an unchanged secret, got %v, %v", changed, err)
+	}
+
+	write("second")
+	failNext = true
+	if changed, err := watcher.Poll(context.Background()); changed || err == nil {
+		t.Errorf("expected failed reload to be reported, got %v, %v", changed, err)
+	}
+	if changed, err := watcher.Poll(context.Background()); !changed || err != nil {
+		t.Errorf("expected failed reload to be retried, got %v, %v", changed, err)
+	}
+	if changed, _ := watcher.Poll(context.Background()); changed {
+		t.Error("expected the applied config not to be reloaded again")
+	}
+	if len(applied) != 1 || applied[0].DBPassword != "second" {
+		t.Errorf("expected the rotated config to be applied once, got %+v", applied)
+	}
+}
+
+// TestReloadDBWhileConnecting tests that a new config restarts a pending connection
+func TestReloadDBWhileConnecting(t *testing.T) {
+	originalDB, originalDBRead := app.DB, app.DBRead
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	app.InitDB(app.DBConfig{DBUser: "test", DBName: "test", DBHost: "127.0.0.1", DBPort: "1"})
+	defer app.CloseDB()
+
+	if err := app.ReloadDB(app.DBConfig{DBUser: "test", DBName: "test", DBHost: "127.0.0.1", DBPort: "2", DBPassword: "rotated"}); err != nil {
+		t.Fatalf("expected reload of a pending connection to succeed, got %v", err)
+	}
+	if app.StoreReady() {
+		t.Error("expected the store to still be connecting")
+	}
+	if status := app.GetStoreStatus(); status.Phase != app.StorePhaseConnectingPrimary {
+		t.Errorf("expected connection to restart, got phase %q", status.Phase)
+	}
+}
+
+// TestDSNRedaction tests that connection strings only contain the password where they are used to connect
+func TestDSNRedaction(t *testing.T) {
+	config := app.DBConfig{
+		DBUser:           "app",
+		DBPassword:       "s3cret/pass",
+		DBName:           "todos",
+		DBHost:           "10.0.0.1",
+		DBPort:           "5432",
+		DBSSLMode:        "verify-full",
+		DBSSLRootCert:    "/etc/ssl/db-ca.pem",
+		DBConnectTimeout: 10,
+		DBSearchPath:     "app,public",
+	}
+	dsn := config.PrimaryDSN()
+
+	connString := dsn.ConnString()
+	for _, want := range []string{"s3cret%2Fpass", "sslmode=verify-full", "sslrootcert=%2Fetc%2Fssl%2Fdb-ca.pem",
+		"application_name=todo-app-go", "connect_timeout=10", "search_path=app%2Cpublic"} {
+		if !strings.Contains(connString, want) {
+			t.Errorf("expected connection string to contain %q, got %q", want, connString)
+		}
+	}
+
+	var logs bytes.Buffer
+	slog.New(slog.NewJSONHandler(&logs, nil)).Info("Connecting", "dsn", dsn)
+	jsonDSN, err := json.Marshal(dsn)
+	if err != nil {
+		t.Fatalf("failed to marshal DSN: %v", err)
+	}
+	for name, rendered := range map[string]string{
+		"String": dsn.String(), "fmt": fmt.Sprint(dsn), "log": logs.String(), "JSON": string(jsonDSN),
+	} {
+		if strings.Contains(rendered, "s3cret") {
+			t.Errorf("%s rendering leaks the password: %s", name, rendered)
+		}
+		if !strings.Contains(rendered, "app:") || !strings.Contains(rendered, "10.0.0.1:5432") {
+			t.Errorf("%s rendering lost the user or host: %s", name, rendered)
+		}
+	}
+
+	// Without a password the IAM proxy placeholder is sent
+	config.DBPassword = ""
+	if !strings.Contains(config.PrimaryDSN().ConnString(), "app:dummy-password@") {
+		t.Errorf("expected placeholder password, got %q", config.PrimaryDSN().ConnString())
+	}
+}
+
+// TestDBConfigValidateTLS tests validation of the sslmode and certificate options
+func TestDBConfigValidateTLS(t *testing.T) {
+	const fakePEM = "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"
+
+	tests := []struct {
+		name    string
+		config  app.DBConfig
+		wantErr bool
+	}{
+		{"default disable", app.DBConfig{}, false},
+		{"unknown mode", app.DBConfig{DBSSLMode: "strict"}, true},
+		{"verify-full without CA", app.DBConfig{DBSSLMode: "verify-full"}, true},
+		{"verify-full with CA file", app.DBConfig{DBSSLMode: "verify-full", DBSSLRootCert: "/etc/ssl/ca.pem"}, false},
+		{"verify-full with CA PEM", app.DBConfig{DBSSLMode: "verify-full", DBSSLRootCertPEM: fakePEM}, false},
+		{"CA file and PEM", app.DBConfig{DBSSLMode: "verify-ca", DBSSLRootCert: "/etc/ssl/ca.pem", DBSSLRootCertPEM: fakePEM}, true},
+		{"client cert without key", app.DBConfig{DBSSLMode: "require", DBSSLCertPEM: fakePEM}, true},
+		{"client cert and key", app.DBConfig{DBSSLMode: "require", DBSSLCertPEM: fakePEM, DBSSLKey: "/etc/ssl/client.key"}, false},
+		{"invalid PEM", app.DBConfig{DBSSLMode: "require", DBSSLRootCertPEM: "not a certificate"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Invalid configurations are rejected when the secret is loaded
+	source := func(ctx context.Context) (string, error) {
+		return `{"db_sslmode": "verify-full"}`, nil
+	}
+	if _, err := app.LoadDBConfig(context.Background(), source); err == nil {
+		t.Error("expected LoadDBConfig to reject verify-full without a CA")
+	}
+}
+
+// todoColumns are the columns of a todo row (see scanTodo).
+var todoColumns = []string{"id", "task", "completed", "list_id", "due_at", "priority", "notes",
+	"created_at", "updated_at", "completed_at", "deleted_at", "tags"}
+
+// todoCreatedAt is the creation and update time of the todos of todoRows.
+var todoCreatedAt = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// todoRows returns todo rows for sqlmock, with the normal priority and
+// todoCreatedAt timestamps unless set.
+func todoRows(todos ...app.Todo) *sqlmock.Rows {
+	rows := sqlmock.NewRows(todoColumns)
+	nullable := func(t *time.Time) driver.Value {
+		if t == nil {
+			return nil
+		}
+		return *t
+	}
+	for _, t := range todos {
+		if t.Priority == "" {
+			t.Priority = app.TodoPriorityNormal
+		}
+		if t.CreatedAt.IsZero() {
+			t.CreatedAt, t.UpdatedAt = todoCreatedAt, todoCreatedAt
+		}
+		tags, _ := pq.StringArray(t.Tags).Value()
+		rows.AddRow(t.ID, t.Task, t.Completed, t.ListID, nullable(t.DueAt), t.Priority, t.Notes,
+			t.CreatedAt, t.UpdatedAt, nullable(t.CompletedAt), nullable(t.DeletedAt), tags)
+	}
+	return rows
+}
+
+// todoJSON is the audit log JSON of a todo from todoRows, with extra fields inserted before the timestamps.
+func todoJSON(id int, task string, listID int64, extra string) string {
+	return fmt.Sprintf(`{"id":%d,"task":%q,"completed":false,"list_id":%d,"priority":"normal",%s"created_at":"2026-01-01T00:00:00Z","updated_at":"2026-01-01T00:00:00Z"`,
+		id, task, listID, extra)
+}
+
+// TestTodoListAccess tests that todos are scoped to the lists the user is a member of
+func TestTodoListAccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalDBRead := app.DB, app.DBRead
+	app.DB, app.DBRead = db, db
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	// Requests without a principal never reach the store
+	w := httptest.NewRecorder()
+	app.GetTodos(w, httptest.NewRequest(http.MethodGet, "/todos", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without a principal, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	alice := &app.Principal{UserID: 7, TenantID: 1, Subject: "test:alice", Method: "session"}
+	asAlice := func(r *http.Request) *http.Request {
+		return r.WithContext(app.WithPrincipal(r.Context(), alice))
+	}
+
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t\\s+JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 WHERE t.deleted_at IS NULL AND t.list_id = \\$2").
+		WithArgs(alice.UserID, 5).
+		WillReturnRows(todoRows(app.Todo{ID: 1, Task: "Shared task", ListID: 5}))
+	mock.ExpectCommit()
+	w = httptest.NewRecorder()
+	app.GetTodos(w, asAlice(httptest.NewRequest(http.MethodGet, "/todos?list=5", nil)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"list_id":5`) {
+		t.Errorf("expected status %d with the list's todos, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// A todo in a list Alice isn't a member of (or a missing one) isn't updated: 404, not 403
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(2, alice.UserID, false).WillReturnRows(sqlmock.NewRows(todoColumns))
+	mock.ExpectCommit()
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT m.role FROM todos t JOIN list_members m").
+		WithArgs(2, alice.UserID, false).WillReturnRows(sqlmock.NewRows([]string{"role"}))
+	mock.ExpectCommit()
+	w = httptest.NewRecorder()
+	app.UpdateTodo(w, asAlice(httptest.NewRequest(http.MethodPut, "/todos/2", strings.NewReader(`{"completed": true}`))), 2)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d updating another user's todo, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Viewers can see but not change todos: 403
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(3, alice.UserID, false).WillReturnRows(sqlmock.NewRows(todoColumns))
+	mock.ExpectCommit()
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT m.role FROM todos t JOIN list_members m").
+		WithArgs(3, alice.UserID, false).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(app.RoleViewer))
+	mock.ExpectCommit()
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, asAlice(httptest.NewRequest(http.MethodDelete, "/todos/3", nil)), 3)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d deleting as a viewer, got %d", http.StatusForbidden, w.Code)
+	}
+
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("INSERT INTO todos AS t \\(task, owner_id, list_id, due_at, priority, notes\\)").
+		WithArgs("New task", alice.UserID, 5, nil, app.TodoPriorityNormal, "").WillReturnRows(sqlmock.NewRows(todoColumns))
+	mock.ExpectCommit()
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT role FROM list_members WHERE list_id = \\$1 AND user_id = \\$2").
+		WithArgs(5, alice.UserID).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(app.RoleViewer))
+	mock.ExpectCommit()
+	w = httptest.NewRecorder()
+	app.AddTodo(w, asAlice(httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"task": "New task", "list_id": 5}`))))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d adding as a viewer, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// Deletes move the todo to the trash and are recorded in the audit log in the same transaction
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(1, alice.UserID, false).
+		WillReturnRows(todoRows(app.Todo{ID: 1, Task: "Shared task", ListID: 5}))
+	deletedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("UPDATE todos t SET deleted_at = now\\(\\) WHERE t.id = \\$1 RETURNING").WithArgs(1).
+		WillReturnRows(todoRows(app.Todo{ID: 1, Task: "Shared task", ListID: 5, DeletedAt: &deletedAt}))
+	mock.ExpectExec("INSERT INTO todo_events").
+		WithArgs(1, 5, app.TodoEventDelete, alice.UserID, "session",
+			todoJSON(1, "Shared task", 5, "")+"}",
+			todoJSON(1, "Shared task", 5, "")+`,"deleted_at":"2026-01-02T03:04:05Z"}`,
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, asAlice(httptest.NewRequest(http.MethodDelete, "/todos/1", nil)), 1)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d deleting as an editor, got %d", http.StatusNoContent, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestDeleteListRequiresTrashedTodos tests that a list is only deleted once its
+// todos are in the trash, so no todo skips it
+func TestDeleteListRequiresTrashedTodos(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB := app.DB
+	app.DB = db
+	defer func() { app.DB = originalDB }()
+
+	owner := &app.Principal{UserID: 7, TenantID: 1, Method: "session"}
+	deleteList := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/lists/5", nil)
+		w := httptest.NewRecorder()
+		app.HandleList(w, req.WithContext(app.WithPrincipal(req.Context(), owner)))
+		return w
+	}
+	expectDelete := func(todos ...app.Todo) {
+		expectTenantTx(mock, 1)
+		mock.ExpectQuery("SELECT personal FROM lists WHERE id = \\$1 FOR UPDATE").WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"personal"}).AddRow(false))
+		mock.ExpectQuery("SELECT role FROM list_members WHERE list_id = \\$1 AND user_id = \\$2").
+			WithArgs(5, 7).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(app.RoleOwner))
+		mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t WHERE t.list_id = \\$1 ORDER BY t.id FOR UPDATE").WithArgs(5).
+			WillReturnRows(todoRows(todos...))
+	}
+
+	// A todo outside the trash keeps the list
+	deletedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectDelete(app.Todo{ID: 1, Task: "Trashed", ListID: 5, DeletedAt: &deletedAt}, app.Todo{ID: 2, Task: "Live", ListID: 5})
+	mock.ExpectCommit()
+	if w := deleteList(); w.Code != http.StatusConflict {
+		t.Errorf("expected status %d deleting a list with live todos, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+
+	// Once every todo is in the trash, the list and its trashed todos are deleted
+	expectDelete(app.Todo{ID: 1, Task: "Trashed", ListID: 5, DeletedAt: &deletedAt})
+	mock.ExpectExec("INSERT INTO todo_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM lists WHERE id = \\$1").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if w := deleteList(); w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d deleting a list with only trashed todos, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestListMembershipChecksInTransaction tests that membership changes check the
+// role under the list lock, and that a list deleted in between is not found
+// instead of a database failure
+func TestListMembershipChecksInTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB := app.DB
+	app.DB = db
+	defer func() { app.DB = originalDB }()
+	ctx := app.WithTenant(context.Background(), 1)
+
+	// The list is gone: not found, without retries
+	for _, change := range []func() error{
+		func() error { return app.SetMember(ctx, 7, 5, 8, app.RoleEditor) },
+		func() error { _, err := app.InviteMember(ctx, 7, 5, "bob@example.com", app.RoleEditor); return err },
+		func() error { return app.RemoveMember(ctx, 7, 5, 8) },
+	} {
+		expectTenantTx(mock, 1)
+		mock.ExpectQuery("SELECT personal FROM lists WHERE id = \\$1 FOR UPDATE").WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"personal"}))
+		mock.ExpectCommit()
+		if err := change(); !errors.Is(err, app.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a deleted list, got %v", err)
+		}
+	}
+
+	// An editor can't manage members
+	expectTenantTx(mock, 1)
+	mock.ExpectQuery("SELECT personal FROM lists WHERE id = \\$1 FOR UPDATE").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"personal"}).AddRow(false))
+	mock.ExpectQuery("SELECT role FROM list_members WHERE list_id = \\$1 AND user_id = \\$2").
+		WithArgs(5, 7).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(app.RoleEditor))
+	mock.ExpectCommit()
+	if err := app.SetMember(ctx, 7, 5, 8, app.RoleViewer); !errors.Is(err, app.ErrForbidden) {
+		t.Errorf("expected ErrForbidden for an editor, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestTodoHistory tests the audit log endpoint
+func TestTodoHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB := app.DB
+	app.DB = db
+	defer func() { app.DB = originalDB }()
+
+	alice := &app.Principal{UserID: 7, TenantID: 1, Subject: "test:alice", Method: "session"}
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		app.HandleTodo(w, req.WithContext(app.WithPrincipal(req.Context(), alice)))
+		return w
+	}
+	columns := []string{"id", "todo_id", "action", "actor_id", "email", "actor_method", "before", "after", "request_id", "trace_id", "created_at"}
+
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT e.id, e.todo_id, e.action, (.+) FROM todo_events e").WithArgs(4, alice.UserID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 4, "create", 7, "alice@example.com", "session", nil, []byte(`{"id":4,"task":"x","completed":false,"list_id":5}`), "req-1", "", time.Now()).
+			AddRow(2, 4, "delete", 8, "bob@example.com", "token", []byte(`{"id":4,"task":"x","completed":false,"list_id":5}`), nil, "req-2", "", time.Now()))
+	mock.ExpectCommit()
+	w := serve(http.MethodGet, "/todos/4/history")
+	var events []app.TodoEvent
+	json.NewDecoder(w.Body).Decode(&events)
+	if w.Code != http.StatusOK || len(events) != 2 || events[1].Action != "delete" || events[1].ActorEmail != "bob@example.com" || events[1].After != nil {
+		t.Errorf("expected the todo's history, got %d: %+v", w.Code, events)
+	}
+
+	// Todos that don't exist or aren't in the user's lists have no visible history
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT e.id, e.todo_id, e.action, (.+) FROM todo_events e").WithArgs(5, alice.UserID).
+		WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectCommit()
+	if w := serve(http.MethodGet, "/todos/5/history"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := serve(http.MethodDelete, "/todos/4/history"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if w := serve(http.MethodGet, "/todos/4/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestTrash tests listing, restoring and purging trashed todos
+func TestTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalDBRead := app.DB, app.DBRead
+	app.DB, app.DBRead = db, db
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	alice := &app.Principal{UserID: 7, TenantID: 1, Subject: "test:alice", Method: "session"}
+	serve := func(h http.HandlerFunc, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		h(w, req.WithContext(app.WithPrincipal(req.Context(), alice)))
+		return w
+	}
+	deletedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t\\s+JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 WHERE t.deleted_at IS NOT NULL").
+		WithArgs(alice.UserID).
+		WillReturnRows(todoRows(app.Todo{ID: 4, Task: "Trashed task", ListID: 5, DeletedAt: &deletedAt}))
+	mock.ExpectCommit()
+	w := serve(app.GetTrash, http.MethodGet, "/trash")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deleted_at":"2026-01-02T03:04:05Z"`) {
+		t.Errorf("expected the trashed todos, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(app.GetTodos, http.MethodGet, "/todos?trash=all"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid trash filter, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Restores take the todo out of the trash and are audited
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(4, alice.UserID, true).
+		WillReturnRows(todoRows(app.Todo{ID: 4, Task: "Trashed task", ListID: 5, DeletedAt: &deletedAt}))
+	mock.ExpectQuery("UPDATE todos t SET deleted_at = NULL WHERE t.id = \\$1 RETURNING").WithArgs(4).
+		WillReturnRows(todoRows(app.Todo{ID: 4, Task: "Trashed task", ListID: 5}))
+	mock.ExpectExec("INSERT INTO todo_events").
+		WithArgs(4, 5, app.TodoEventRestore, alice.UserID, "session",
+			todoJSON(4, "Trashed task", 5, "")+`,"deleted_at":"2026-01-02T03:04:05Z"}`,
+			todoJSON(4, "Trashed task", 5, "")+"}", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w = serve(app.HandleTodo, http.MethodPost, "/todos/4/restore")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "deleted_at") {
+		t.Errorf("expected the restored todo, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Todos that aren't in the trash can't be restored
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(4, alice.UserID, true).WillReturnRows(sqlmock.NewRows(todoColumns))
+	mock.ExpectCommit()
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT m.role FROM todos t JOIN list_members m").
+		WithArgs(4, alice.UserID, true).WillReturnRows(sqlmock.NewRows([]string{"role"}))
+	mock.ExpectCommit()
+	if w := serve(app.HandleTodo, http.MethodPost, "/todos/4/restore"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := serve(app.HandleTodo, http.MethodGet, "/todos/4/restore"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	// The purge job takes the purge lock, then deletes expired todos of every tenant in
+	// bounded batches, recording the purge without an actor
+	mock.ExpectQuery("SELECT pg_try_advisory_lock\\(\\$1\\)").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT id FROM tenants ORDER BY id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	expectTenantTx(mock, 1)
+	mock.ExpectQuery("DELETE FROM todos t WHERE t.id IN \\(\\s*SELECT id FROM todos WHERE deleted_at < \\$1 ORDER BY id LIMIT \\$2 FOR UPDATE SKIP LOCKED\\s*\\) RETURNING").
+		WithArgs(sqlmock.AnyArg(), 500).
+		WillReturnRows(todoRows(app.Todo{ID: 4, Task: "Trashed task", ListID: 5, DeletedAt: &deletedAt}))
+	mock.ExpectExec("INSERT INTO todo_events").
+		WithArgs(4, 5, app.TodoEventPurge, 0, "purge", sqlmock.AnyArg(), nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectTenantTx(mock, 2)
+	mock.ExpectQuery("DELETE FROM todos t WHERE t.id IN").WithArgs(sqlmock.AnyArg(), 500).
+		WillReturnRows(sqlmock.NewRows(todoColumns))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock\\(\\$1\\)").WillReturnResult(sqlmock.NewResult(0, 0))
+	if n, err := app.PurgeTrash(context.Background(), app.DefaultTrashRetention); err != nil || n != 1 {
+		t.Errorf("expected 1 purged todo, got %d, %v", n, err)
+	}
+
+	// While another instance holds the purge lock, nothing is purged
+	mock.ExpectQuery("SELECT pg_try_advisory_lock\\(\\$1\\)").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	if n, err := app.PurgeTrash(context.Background(), app.DefaultTrashRetention); err != nil || n != 0 {
+		t.Errorf("expected nothing purged without the lock, got %d, %v", n, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestTodoPlanningFields tests adding, updating, filtering and sorting todos by their planning fields
+func TestTodoPlanningFields(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalDBRead := app.DB, app.DBRead
+	app.DB, app.DBRead = db, db
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	alice := &app.Principal{UserID: 7, TenantID: 1, Subject: "test:alice", Method: "session"}
+	serve := func(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h(w, req.WithContext(app.WithPrincipal(req.Context(), alice)))
+		return w
+	}
+	due := time.Date(2026, 3, 1, 17, 0, 0, 0, time.UTC)
+
+	for _, body := range []string{
+		`{"task": "  ", "list_id": 5}`,
+		`{"task": "Plan", "list_id": 5, "priority": "someday"}`,
+		`{"task": "Plan", "list_id": 5, "notes": "` + strings.Repeat("x", app.MaxNotesLength+1) + `"}`,
+		`{"task": "Plan", "list_id": 5, "due_at": "tomorrow"}`,
+	} {
+		if w := serve(app.AddTodo, http.MethodPost, "/todos", body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %.60s, got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+
+	planned := app.Todo{ID: 9, Task: "Plan", ListID: 5, DueAt: &due, Priority: app.TodoPriorityHigh, Notes: "See **runbook**"}
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("INSERT INTO todos AS t").
+		WithArgs("Plan", alice.UserID, 5, due, app.TodoPriorityHigh, "See **runbook**").WillReturnRows(todoRows(planned))
+	mock.ExpectExec("INSERT INTO todo_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w := serve(app.AddTodo, http.MethodPost, "/todos",
+		`{"task": " Plan ", "list_id": 5, "due_at": "2026-03-01T17:00:00Z", "priority": "high", "notes": "See **runbook**"}`)
+	var added app.Todo
+	json.NewDecoder(w.Body).Decode(&added)
+	if w.Code != http.StatusCreated || added.DueAt == nil || !added.DueAt.Equal(due) || added.Priority != app.TodoPriorityHigh ||
+		added.Notes != "See **runbook**" || !added.CreatedAt.Equal(todoCreatedAt) {
+		t.Errorf("expected the added todo with its planning fields, got %d: %+v", w.Code, added)
+	}
+
+	// Updates only change the fields in the body; null clears the due date
+	completedAt := time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)
+	updated := planned
+	updated.DueAt, updated.Priority, updated.Completed, updated.CompletedAt = nil, app.TodoPriorityUrgent, true, &completedAt
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(9, alice.UserID, false).WillReturnRows(todoRows(planned))
+	mock.ExpectQuery("UPDATE todos t SET task = \\$1, completed = \\$2, due_at = \\$3, priority = \\$4, notes = \\$5, updated_at = now\\(\\)").
+		WithArgs("Plan", true, nil, app.TodoPriorityUrgent, "See **runbook**", 9).WillReturnRows(todoRows(updated))
+	mock.ExpectExec("INSERT INTO todo_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w = serve(app.HandleTodo, http.MethodPut, "/todos/9", `{"completed": true, "priority": "urgent", "due_at": null, "created_at": "2020-01-01T00:00:00Z"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"completed_at":"2026-01-03T00:00:00Z"`) ||
+		strings.Contains(w.Body.String(), "due_at") {
+		t.Errorf("expected the updated todo, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Invalid changes are rejected after reading the todo
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+		WithArgs(9, alice.UserID, false).WillReturnRows(todoRows(planned))
+	mock.ExpectCommit()
+	if w := serve(app.HandleTodo, http.MethodPut, "/todos/9", `{"priority": "someday"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid priority, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t\\s+JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 " +
+		"WHERE t.deleted_at IS NULL AND t.priority = ANY\\(\\$2\\) AND t.completed = \\$3 AND t.due_at < \\$4 " +
+		"ORDER BY t.due_at DESC NULLS LAST, t.id").
+		WithArgs(alice.UserID, `{"high","urgent"}`, false, due).WillReturnRows(todoRows(planned))
+	mock.ExpectCommit()
+	w = serve(app.GetTodos, http.MethodGet, "/todos?priority=high,urgent&completed=false&due_before=2026-03-01T17:00:00Z&sort=-due_at", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"priority":"high"`) {
+		t.Errorf("expected the filtered todos, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, query := range []string{"priority=someday", "completed=maybe", "due_after=tomorrow", "sort=task"} {
+		if w := serve(app.GetTodos, http.MethodGet, "/todos?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, query, w.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestTodoTags tests tagging todos, filtering by tags and counting them
+func TestTodoTags(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalDBRead := app.DB, app.DBRead
+	app.DB, app.DBRead = db, db
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	alice := &app.Principal{UserID: 7, TenantID: 1, Subject: "test:alice", Method: "session"}
+	serve := func(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h(w, req.WithContext(app.WithPrincipal(req.Context(), alice)))
+		return w
+	}
+	expectTag := func(tag string, tagID int64, added bool) {
+		mock.ExpectQuery("INSERT INTO tags \\(name\\) VALUES \\(\\$1\\)").WithArgs(tag).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(tagID))
+		var n int64
+		if added {
+			n = 1
+		}
+		mock.ExpectExec("INSERT INTO todo_tags \\(todo_id, tag_id\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT DO NOTHING").
+			WithArgs(9, tagID).WillReturnResult(sqlmock.NewResult(0, n))
+	}
+	lock := func(tags ...string) {
+		mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m (.+) FOR UPDATE OF t").
+			WithArgs(9, alice.UserID, false).WillReturnRows(todoRows(app.Todo{ID: 9, Task: "Page", ListID: 5, Tags: tags}))
+	}
+	touch := func(tags ...string) {
+		mock.ExpectQuery("UPDATE todos t SET updated_at = now\\(\\) WHERE t.id = \\$1 RETURNING").WithArgs(9).
+			WillReturnRows(todoRows(app.Todo{ID: 9, Task: "Page", ListID: 5, Tags: tags}))
+	}
+
+	// New todos are tagged with their lowercased, deduplicated tags
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("INSERT INTO todos AS t").WillReturnRows(todoRows(app.Todo{ID: 9, Task: "Page", ListID: 5}))
+	expectTag("infra", 1, true)
+	expectTag("oncall", 2, true)
+	touch("infra", "oncall")
+	mock.ExpectExec("INSERT INTO todo_events").
+		WithArgs(9, 5, app.TodoEventCreate, alice.UserID, "session", nil,
+			todoJSON(9, "Page", 5, "")+`,"tags":["infra","oncall"]}`, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w := serve(app.AddTodo, http.MethodPost, "/todos", `{"task": "Page", "list_id": 5, "tags": ["OnCall", "infra", "oncall"]}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"tags":["infra","oncall"]`) {
+		t.Errorf("expected the tagged todo, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Tagging is recorded as an update
+	expectTenantTx(mock, alice.TenantID)
+	lock("infra", "oncall")
+	expectTag("release", 3, true)
+	touch("infra", "oncall", "release")
+	mock.ExpectExec("INSERT INTO todo_events").
+		WithArgs(9, 5, app.TodoEventUpdate, alice.UserID, "session",
+			todoJSON(9, "Page", 5, "")+`,"tags":["infra","oncall"]}`,
+			todoJSON(9, "Page", 5, "")+`,"tags":["infra","oncall","release"]}`, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w = serve(app.HandleTodo, http.MethodPost, "/todos/9/tags", `{"tag": "Release"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tags":["infra","oncall","release"]`) {
+		t.Errorf("expected the tagged todo, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Adding a tag the todo already has changes nothing
+	expectTenantTx(mock, alice.TenantID)
+	lock("infra", "oncall")
+	expectTag("oncall", 2, false)
+	mock.ExpectCommit()
+	if w := serve(app.HandleTodo, http.MethodPost, "/todos/9/tags", `{"tag": "oncall"}`); w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	expectTenantTx(mock, alice.TenantID)
+	lock("infra", "oncall")
+	mock.ExpectExec("DELETE FROM todo_tags tt USING tags g").WithArgs(9, "infra").WillReturnResult(sqlmock.NewResult(0, 1))
+	touch("oncall")
+	mock.ExpectExec("INSERT INTO todo_events").WithArgs(9, 5, app.TodoEventUpdate, alice.UserID, "session",
+		sqlmock.AnyArg(), todoJSON(9, "Page", 5, "")+`,"tags":["oncall"]}`, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	w = serve(app.HandleTodo, http.MethodDelete, "/todos/9/tags/Infra", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tags":["oncall"]`) {
+		t.Errorf("expected the untagged todo, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Todos have at most MaxTodoTags tags
+	full := make([]string, app.MaxTodoTags)
+	for i := range full {
+		full[i] = fmt.Sprintf("tag%02d", i)
+	}
+	expectTenantTx(mock, alice.TenantID)
+	lock(full...)
+	mock.ExpectCommit()
+	if w := serve(app.HandleTodo, http.MethodPost, "/todos/9/tags", `{"tag": "one-more"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	for _, req := range []struct{ method, path, body string }{
+		{http.MethodPost, "/todos/9/tags", `{"tag": "two words"}`},
+		{http.MethodPost, "/todos/9/tags", `{"tag": ""}`},
+		{http.MethodDelete, "/todos/9/tags/bad!", ""},
+	} {
+		if w := serve(app.HandleTodo, req.method, req.path, req.body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s %s, got %d", http.StatusBadRequest, req.method, req.path, w.Code)
+		}
+	}
+	if w := serve(app.AddTodo, http.MethodPost, "/todos", `{"task": "Page", "tags": ["-oncall"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid tag, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Repeated tag parameters are ANDed, comma-separated tags ORed
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t\\s+JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 " +
+		"WHERE t.deleted_at IS NULL AND EXISTS \\((.+) AND g.name = ANY\\(\\$2\\)\\) AND EXISTS \\((.+) AND g.name = ANY\\(\\$3\\)\\) " +
+		"ORDER BY t.id").
+		WithArgs(alice.UserID, `{"oncall","infra"}`, `{"release"}`).
+		WillReturnRows(todoRows(app.Todo{ID: 9, Task: "Page", ListID: 5, Tags: []string{"oncall", "release"}}))
+	mock.ExpectCommit()
+	w = serve(app.GetTodos, http.MethodGet, "/todos?tag=oncall,infra&tag=release", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tags":["oncall","release"]`) {
+		t.Errorf("expected the tagged todos, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(app.GetTodos, http.MethodGet, "/todos?tag=oncall,", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an empty tag, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	expectTenantTx(mock, alice.TenantID)
+	mock.ExpectQuery("SELECT g.name, count\\(\\*\\) FROM tags g (.+) WHERE t.list_id = \\$2 GROUP BY g.name ORDER BY g.name").
+		WithArgs(alice.UserID, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "count"}).AddRow("oncall", 2).AddRow("release", 1))
+	mock.ExpectCommit()
+	w = serve(app.HandleTags, http.MethodGet, "/tags?list=5", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `[{"name":"oncall","count":2},{"name":"release","count":1}]` {
+		t.Errorf("expected the tag counts, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// expectTenantTx expects the start of a transaction scoped to tenant.
+func expectTenantTx(mock sqlmock.Sqlmock, tenant int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT set_config\\('app.tenant_id', \\$1, true\\)").
+		WithArgs(strconv.FormatInt(tenant, 10)).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// TestTenantRequired tests that the store refuses to query without a tenant
+func TestTenantRequired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalDBRead := app.DB, app.DBRead
+	app.DB, app.DBRead = db, db
+	defer func() {
+		app.DB, app.DBRead = originalDB, originalDBRead
+	}()
+
+	// No expectations: any query fails the test
+	ctx := context.Background()
+	if _, err := app.UserLists(ctx, 7); !errors.Is(err, app.ErrNoTenant) {
+		t.Errorf("expected ErrNoTenant listing lists, got %v", err)
+	}
+	if _, err := app.PersonalListID(ctx, 7); !errors.Is(err, app.ErrNoTenant) {
+		t.Errorf("expected ErrNoTenant for the personal list, got %v", err)
+	}
+
+	// A principal without a tenant is refused, and not served from the stale cache
+	noTenant := &app.Principal{UserID: 7, Subject: "test:no-tenant"}
+	r := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	r = r.WithContext(app.WithPrincipal(r.Context(), noTenant))
+	w := httptest.NewRecorder()
+	app.GetTodos(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d without a tenant, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	app.DeleteTodo(w, httptest.NewRequest(http.MethodDelete, "/todos/1", nil).WithContext(r.Context()), 1)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d deleting without a tenant, got %d", http.StatusForbidden, w.Code)
+	}
+	if app.CB.State() != gobreaker.StateClosed {
+		t.Errorf("expected refused queries not to trip the circuit breaker, got %v", app.CB.State())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected database calls: %v", err)
+	}
+}
+
+// TestTenantForEmail tests the assignment of new users to tenants
+func TestTenantForEmail(t *testing.T) {
+	domains, err := app.ParseTenantDomains("team-a=A.example.com, team-b=b.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	original := app.TenantDomains
+	app.TenantDomains = domains
+	defer func() { app.TenantDomains = original }()
+
+	tests := map[string]string{
+		"alice@a.example.com": "team-a",
+		"bob@B.Example.com":   "team-b",
+		"carol@example.com":   app.DefaultTenant,
+		"":                    app.DefaultTenant,
+	}
+	for email, want := range tests {
+		if got := app.TenantForEmail(email); got != want {
+			t.Errorf("TenantForEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+
+	for _, invalid := range []string{"team-a", "=a.example.com", "a=x.com,b=x.com"} {
+		if _, err := app.ParseTenantDomains(invalid); err == nil {
+			t.Errorf("expected ParseTenantDomains(%q) to fail", invalid)
+		}
+	}
+}
+
+// TestAuthMiddleware tests principal resolution and RequireAuth
+func TestAuthMiddleware(t *testing.T) {
+	bob := &app.Principal{UserID: 9, Subject: "test:bob"}
+	byHeader := func(r *http.Request) (*app.Principal, error) {
+		switch r.Header.Get("X-Test-User") {
+		case "":
+			return nil, nil
+		case "bob":
+			return bob, nil
+		default:
+			return nil, app.ErrUnauthenticated
+		}
+	}
+	handler := app.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := app.PrincipalFromContext(r.Context())
+		w.Write([]byte(p.Subject))
+	}), app.AuthMiddleware(byHeader), app.RequireAuth)
+
+	tests := []struct {
+		user     string
+		wantCode int
+	}{
+		{"", http.StatusUnauthorized},
+		{"bob", http.StatusOK},
+		{"mallory", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		if tt.user != "" {
+			req.Header.Set("X-Test-User", tt.user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("user %q: expected status %d, got %d", tt.user, tt.wantCode, w.Code)
+		}
+		if tt.wantCode == http.StatusOK && w.Body.String() != bob.Subject {
+			t.Errorf("expected principal %q, got %q", bob.Subject, w.Body.String())
+		}
+	}
+}
+
+// TestOIDCLogin tests the authorization code + PKCE login against a mock identity provider
+func TestOIDCLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB := app.DB
+	app.DB = db
+	defer func() { app.DB = originalDB }()
+
+	// The mock provider issues an ID token for the nonce and PKCE challenge of the last authorization request
+	var issuer, challenge, nonce string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+			})
+		case "/token":
+			r.ParseForm()
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			claims, _ := json.Marshal(map[string]any{
+				"iss": issuer, "sub": "alice", "aud": "todo-app", "exp": time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce, "email": "alice@example.com", "email_verified": true,
+			})
+			idToken := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+	issuer = idp.URL
+
+	sessions := &app.Sessions{Store: app.NewMemorySessionStore(), Cookie: app.SessionCookieConfig{Insecure: true}}
+	provider, err := app.NewOIDCProvider(app.OIDCConfig{
+		Issuer:      issuer,
+		ClientID:    "todo-app",
+		RedirectURL: "http://todo.test/auth/callback",
+	}, sessions)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	// login starts a login and returns the login cookie and the authorization request
+	login := func(returnTo string) (*http.Cookie, url.Values) {
+		w := httptest.NewRecorder()
+		provider.LoginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/login?return_to="+url.QueryEscape(returnTo), nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected login redirect, got %d: %s", w.Code, w.Body.String())
+		}
+		location, _ := url.Parse(w.Header().Get("Location"))
+		query := location.Query()
+		if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "todo-app" {
+			t.Errorf("unexpected authorization request %s", location)
+		}
+		challenge, nonce = query.Get("code_challenge"), query.Get("nonce")
+		return w.Result().Cookies()[0], query
+	}
+	callback := func(cookie *http.Cookie, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/callback?"+query, nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		provider.CallbackHandler(w, req)
+		return w
+	}
+
+	// A state that doesn't match the login cookie is rejected before the code is used
+	cookie, _ := login("/")
+	if w := callback(cookie, "code=good-code&state=forged"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a state mismatch, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// An ID token for another login's nonce is rejected
+	cookie, query := login("/")
+	nonce = "replayed"
+	if w := callback(cookie, "code=good-code&state="+query.Get("state")); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a nonce mismatch, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// A successful login creates the user in the tenant of the email domain and a
+	// session, and returns to a local path only
+	originalDomains := app.TenantDomains
+	app.TenantDomains = map[string]string{"example.com": "oidc-test"}
+	defer func() { app.TenantDomains = originalDomains }()
+	mock.ExpectQuery("INSERT INTO tenants").WithArgs("oidc-test").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectQuery("INSERT INTO users").WithArgs(issuer+"#alice", "alice@example.com", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id"}).AddRow(42, 3))
+	expectTenantTx(mock, 3)
+	mock.ExpectExec("INSERT INTO list_members").WithArgs(42, "alice@example.com").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	cookie, query = login("//evil.example.com")
+	w := callback(cookie, "code=good-code&state="+query.Get("state"))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("expected redirect to /, got %d to %q: %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	var sessionCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "todo_session" {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil || !sessionCookie.HttpOnly || sessionCookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected an HttpOnly, SameSite=Lax session cookie, got %v", sessionCookie)
+	}
+
+	// The session cookie identifies the user until logout
+	me := app.Chain(http.HandlerFunc(app.MeHandler), app.AuthMiddleware(sessions.Authenticator()))
+	meRequest := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+		req.AddCookie(sessionCookie)
+		w := httptest.NewRecorder()
+		me.ServeHTTP(w, req)
+		return w
+	}
+	w = meRequest()
+	var principal app.Principal
+	json.NewDecoder(w.Body).Decode(&principal)
+	if w.Code != http.StatusOK || principal.UserID != 42 || principal.TenantID != 3 || principal.Email != "alice@example.com" || principal.Method != "session" {
+		t.Errorf("expected the signed-in user, got %d: %+v", w.Code, principal)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+	req.AddCookie(sessionCookie)
+	w = httptest.NewRecorder()
+	sessions.LogoutHandler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d from logout, got %d", http.StatusNoContent, w.Code)
+	}
+	if w = meRequest(); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d after logout, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestNewOIDCProviderRequiresHTTPS tests that only loopback issuers may use plain HTTP
+func TestNewOIDCProviderRequiresHTTPS(t *testing.T) {
+	sessions := &app.Sessions{Store: app.NewMemorySessionStore()}
+	for issuer, wantErr := range map[string]bool{
+		"https://accounts.example.com": false,
+		"http://127.0.0.1:8081":        false,
+		"http://localhost:8081":        false,
+		"http://accounts.example.com":  true,
+		"accounts.example.com":         true,
+	} {
+		_, err := app.NewOIDCProvider(app.OIDCConfig{Issuer: issuer, ClientID: "todo-app", RedirectURL: "https://todo.example.com/auth/callback"}, sessions)
+		if (err != nil) != wantErr {
+			t.Errorf("issuer %q: expected error %v, got %v", issuer, wantErr, err)
+		}
+	}
+}
+
+// unavailableSessionStore is a session store whose reads fail while err is set
+type unavailableSessionStore struct {
+	app.SessionStore
+	err   error
+	reads int
+}
+
+func (s *unavailableSessionStore) Get(ctx context.Context, id string) (*app.Session, error) {
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.SessionStore.Get(ctx, id)
+}
+
+// TestCachedSessionStore tests that validated sessions are served from memory,
+// also while the store is unavailable, and that logout evicts them
+func TestCachedSessionStore(t *testing.T) {
+	ctx := context.Background()
+	backing := &unavailableSessionStore{SessionStore: app.NewMemorySessionStore()}
+	store := app.NewCachedSessionStore(backing, app.AuthCacheConfig{TTL: time.Hour, MaxStale: time.Hour, MaxEntries: 10})
+	now := time.Now()
+	if err := store.Create(ctx, &app.Session{ID: "s1", UserID: 7, TenantID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	// Within the TTL the store isn't asked
+	if s, err := store.Get(ctx, "s1"); err != nil || s == nil || s.UserID != 7 || s.ID != "s1" {
+		t.Fatalf("expected the cached session, got %+v, %v", s, err)
+	}
+	if backing.reads != 0 {
+		t.Errorf("expected no store reads within the TTL, got %d", backing.reads)
+	}
+
+	// Past the TTL the store is asked, and its failure is covered by the cache
+	stale := app.NewCachedSessionStore(backing, app.AuthCacheConfig{TTL: 0, MaxStale: time.Hour, MaxEntries: 10})
+	if s, err := stale.Get(ctx, "s1"); err != nil || s == nil {
+		t.Fatalf("expected the session from the store, got %+v, %v", s, err)
+	}
+	backing.err = errors.New("database unavailable")
+	before := counterValue(t, "auth_cache_fallbacks_total")
+	if s, err := stale.Get(ctx, "s1"); err != nil || s == nil || s.UserID != 7 {
+		t.Errorf("expected the cached session while the store is down, got %+v, %v", s, err)
+	}
+	if got := counterValue(t, "auth_cache_fallbacks_total"); got != before+1 {
+		t.Errorf("expected one cache fallback, got %v", got-before)
+	}
+	if _, err := stale.Get(ctx, "unknown"); err == nil {
+		t.Error("expected the store error for a session that isn't cached")
+	}
+
+	// Logging out evicts the session, even while the store is down
+	backing.err = nil
+	if err := stale.Delete(ctx, "s1"); err != nil {
+		t.Fatalf("failed to delete session: %v", err)
+	}
+	backing.err = errors.New("database unavailable")
+	if s, err := stale.Get(ctx, "s1"); err == nil || s != nil {
+		t.Errorf("expected the store error after logout, got %+v, %v", s, err)
+	}
+
+	// An expired session isn't served from the cache
+	backing.err = nil
+	if err := store.Create(ctx, &app.Session{ID: "s2", UserID: 8, CreatedAt: now, ExpiresAt: now.Add(-time.Second)}); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if s, err := store.Get(ctx, "s2"); err != nil || s != nil {
+		t.Errorf("expected no session once expired, got %+v, %v", s, err)
+	}
+}
+
+// TestAPITokens tests bearer token authentication and token scopes
+func TestAPITokens(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB := app.DB
+	app.DB = db
+	defer func() { app.DB = originalDB }()
+
+	authenticate := app.TokenAuthenticator()
+	withAuthorization := func(method, value string) *http.Request {
+		req := httptest.NewRequest(method, "/todos", nil)
+		if value != "" {
+			req.Header.Set("Authorization", value)
+		}
+		return req
+	}
+
+	// Requests without a bearer token are left to the other authenticators
+	for _, value := range []string{"", "Basic dXNlcjpwYXNz"} {
+		if p, err := authenticate(withAuthorization(http.MethodGet, value)); p != nil || err != nil {
+			t.Errorf("%q: expected no principal and no error, got %v, %v", value, p, err)
+		}
+	}
+	if _, err := authenticate(withAuthorization(http.MethodGet, "Bearer not-a-token")); !errors.Is(err, app.ErrUnauthenticated) {
+		t.Errorf("expected ErrUnauthenticated for a malformed token, got %v", err)
+	}
+
+	app.SetTokenCacheConfig(app.DefaultAuthCacheConfig)
+	mock.ExpectQuery("SELECT t.id, t.user_id, u.tenant_id, u.subject, u.email, t.scope, t.expires_at FROM api_tokens").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "tenant_id", "subject", "email", "scope", "expires_at"}).
+			AddRow(3, 7, 1, "test:alice", nil, "read", time.Now().Add(time.Hour)))
+	p, err := authenticate(withAuthorization(http.MethodGet, "Bearer todo_valid"))
+	if err != nil || p == nil || p.UserID != 7 || p.TenantID != 1 || p.Method != "token" || p.CanWrite() {
+		t.Fatalf("expected a read-only token principal, got %+v, %v", p, err)
+	}
+
+	// The token is served from the cache, and its uses are written in one batch
+	if p, err := authenticate(withAuthorization(http.MethodGet, "Bearer todo_valid")); err != nil || p == nil || p.UserID != 7 {
+		t.Fatalf("expected the cached token principal, got %+v, %v", p, err)
+	}
+	mock.ExpectExec("UPDATE api_tokens t SET last_used_at = u.used_at FROM unnest").
+		WithArgs("{3}", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := app.FlushTokenUses(context.Background()); err != nil {
+		t.Errorf("failed to flush token uses: %v", err)
+	}
+	if err := app.FlushTokenUses(context.Background()); err != nil {
+		t.Errorf("expected nothing to flush, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// Read-only tokens can't modify todos or manage tokens
+	handler := app.RequireWriteScope(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		method   string
+		scope    string
+		wantCode int
+	}{
+		{http.MethodGet, app.TokenScopeRead, http.StatusOK},
+		{http.MethodPost, app.TokenScopeRead, http.StatusForbidden},
+		{http.MethodDelete, app.TokenScopeRead, http.StatusForbidden},
+		{http.MethodPost, app.TokenScopeWrite, http.StatusOK},
+		{http.MethodPost, "", http.StatusOK}, // Browser session
+	}
+	for _, tt := range tests {
+		principal := &app.Principal{UserID: 7, Scope: tt.scope}
+		req := httptest.NewRequest(tt.method, "/todos", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(app.WithPrincipal(req.Context(), principal)))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s with scope %q: expected status %d, got %d", tt.method, tt.scope, tt.wantCode, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"name": "x", "scope": "write"}`))
+	w := httptest.NewRecorder()
+	app.HandleTokens(w, req.WithContext(app.WithPrincipal(req.Context(), &app.Principal{UserID: 7, Method: "token", Scope: app.TokenScopeWrite})))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d creating a token with a token, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+// TestAPITokenCacheFallback tests that validated tokens keep working while the
+// database is down, and that revoking a token evicts it
+func TestAPITokenCacheFallback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	originalDB, originalBackoff := app.DB, app.BackoffStrategy
+	app.DB = db
+	app.BackoffStrategy = &backoff.StopBackOff{}
+	defer func() { app.DB, app.BackoffStrategy = originalDB, originalBackoff }()
+	app.SetTokenCacheConfig(app.AuthCacheConfig{MaxStale: time.Hour, MaxEntries: 10})
+	defer app.SetTokenCacheConfig(app.DefaultAuthCacheConfig)
+
+	authenticate := app.TokenAuthenticator()
+	bearer := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	tokenColumns := []string{"id", "user_id", "tenant_id", "subject", "email", "scope", "expires_at"}
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens").
+		WillReturnRows(sqlmock.NewRows(tokenColumns).AddRow(5, 7, 1, "test:alice", nil, "write", time.Now().Add(time.Hour)))
+	if p, err := authenticate(bearer("todo_cached")); err != nil || p == nil {
+		t.Fatalf("expected the token principal, got %+v, %v", p, err)
+	}
+
+	// The database is down: the cached token is still accepted, unknown tokens aren't
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens").WillReturnError(errors.New("database unavailable"))
+	before := counterValue(t, "auth_cache_fallbacks_total")
+	if p, err := authenticate(bearer("todo_cached")); err != nil || p == nil || p.UserID != 7 || !p.CanWrite() {
+		t.Errorf("expected the cached principal while the database is down, got %+v, %v", p, err)
+	}
+	if got := counterValue(t, "auth_cache_fallbacks_total"); got != before+1 {
+		t.Errorf("expected one cache fallback, got %v", got-before)
+	}
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens").WillReturnError(errors.New("database unavailable"))
+	if p, err := authenticate(bearer("todo_unknown")); err == nil || p != nil {
+		t.Errorf("expected the store error for an uncached token, got %+v, %v", p, err)
+	}
+
+	// A revoked token is evicted at once
+	mock.ExpectExec("UPDATE api_tokens SET revoked_at = now\\(\\)").WithArgs(5, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	if found, err := app.RevokeToken(context.Background(), 7, 5); err != nil || !found {
+		t.Fatalf("failed to revoke token: %v, %v", found, err)
+	}
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens").WillReturnError(errors.New("database unavailable"))
+	if p, err := authenticate(bearer("todo_cached")); err == nil || p != nil {
+		t.Errorf("expected a revoked token not to be served from the cache, got %+v, %v", p, err)
+	}
+
+	// Failed flushes keep the uses for the next one
+	mock.ExpectExec("UPDATE api_tokens t SET last_used_at").WillReturnError(errors.New("database unavailable"))
+	if err := app.FlushTokenUses(context.Background()); err == nil {
+		t.Error("expected the flush to fail")
+	}
+	mock.ExpectExec("UPDATE api_tokens t SET last_used_at").WithArgs("{5}", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := app.FlushTokenUses(context.Background()); err != nil {
+		t.Errorf("failed to flush token uses: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestCSRFProtection tests the origin and double-submit token checks
+func TestCSRFProtection(t *testing.T) {
+	csrf := &app.CSRF{Insecure: true}
+
+	// The page sets the CSRF cookie
+	w := httptest.NewRecorder()
+	csrf.Issue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "todo_csrf" || cookies[0].Value == "" || cookies[0].HttpOnly {
+		t.Fatalf("expected a readable CSRF cookie, got %v", cookies)
+	}
+	token := cookies[0].Value
+
+	handler := app.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), csrf.Protect)
+	tests := []struct {
+		name     string
+		method   string
+		cookie   string
+		header   string
+		origin   string
+		fetch    string
+		auth     string // Authentication method of the principal
+		wantCode int
+	}{
+		{"read", http.MethodGet, "", "", "", "", "session", http.StatusOK},
+		{"valid token", http.MethodPost, token, token, "http://example.com", "same-origin", "session", http.StatusOK},
+		{"missing header", http.MethodPost, token, "", "", "", "session", http.StatusForbidden},
+		{"missing cookie", http.MethodDelete, "", token, "", "", "session", http.StatusForbidden},
+		{"mismatch", http.MethodPut, token, "forged", "", "", "session", http.StatusForbidden},
+		{"cross-site", http.MethodPost, token, token, "", "cross-site", "session", http.StatusForbidden},
+		{"foreign origin", http.MethodPost, token, token, "https://evil.example.net", "", "session", http.StatusForbidden},
+		{"api token", http.MethodPost, "", "", "", "", "token", http.StatusOK},
+		{"dev user", http.MethodPost, "", "", "", "", "dev", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://example.com/todos", nil)
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "todo_csrf", Value: tt.cookie})
+		}
+		if tt.header != "" {
+			req.Header.Set(app.CSRFHeader, tt.header)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.fetch != "" {
+			req.Header.Set("Sec-Fetch-Site", tt.fetch)
+		}
+		req = req.WithContext(app.WithPrincipal(req.Context(), &app.Principal{UserID: 1, Method: tt.auth}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantCode, w.Code)
+		}
+	}
+}
@@ -6,9 +6,47 @@ document.addEventListener('DOMContentLoaded', () => {
     const form = document.getElementById('todo-form');
     const input = document.getElementById('todo-input');
     const list = document.getElementById('todo-list');
+    const notice = document.getElementById('notice');
+    const account = document.getElementById('account');
+    const accountName = document.getElementById('account-name');
+    const signIn = document.getElementById('sign-in');
+    const signOut = document.getElementById('sign-out');
+
+    // Shows degraded-mode messages (stale data, read-only writes) above the list
+    const showNotice = (message) => {
+        notice.textContent = message || '';
+        notice.hidden = !message;
+    };
+
+    // State-changing requests echo the CSRF cookie in a header (see internal/app/csrf.go)
+    const csrfToken = () => {
+        const cookie = document.cookie.split('; ')
+            .find(c => c.startsWith('__Host-todo_csrf=') || c.startsWith('todo_csrf='));
+        return cookie ? cookie.substring(cookie.indexOf('=') + 1) : '';
+    };
+
+    const problemDetail = async (response) => {
+        try {
+            const problem = await response.json();
+            return problem.detail || problem.title || response.statusText;
+        } catch (e) {
+            return response.statusText;
+        }
+    };
 
     const fetchTodos = async () => {
         const response = await fetch('/todos');
+        if (response.status === 401) {
+            showNotice('Sign in to see your todos.');
+            return;
+        }
+        if (!response.ok) {
+            showNotice('Could not load todos: ' + response.statusText);
+            return;
+        }
+        showNotice(response.headers.get('X-Stale') === 'true'
+            ? 'Showing cached todos; the database is currently unavailable.'
+            : '');
         const todos = await response.json();
         list.innerHTML = '';
         if (todos) {
@@ -42,9 +80,13 @@ document.addEventListener('DOMContentLoaded', () => {
     const addTodo = async (task) => {
         const response = await fetch('/todos', {
             method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
+            headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken() },
             body: JSON.stringify({ task }),
         });
+        if (!response.ok) {
+            showNotice(await problemDetail(response));
+            return;
+        }
         const newTodo = await response.json();
         renderTodo(newTodo);
     };
@@ -52,25 +94,50 @@ document.addEventListener('DOMContentLoaded', () => {
     const toggleComplete = async (todo) => {
         const response = await fetch(`/todos/${todo.id}`, {
             method: 'PUT',
-            headers: { 'Content-Type': 'application/json' },
+            headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken() },
             body: JSON.stringify({ ...todo, completed: !todo.completed }),
         });
         if (response.ok) {
             const li = document.querySelector(`[data-id='${todo.id}']`);
             li.classList.toggle('completed');
+        } else {
+            showNotice(await problemDetail(response));
         }
     };
 
     const deleteTodo = async (id) => {
         const response = await fetch(`/todos/${id}`, {
             method: 'DELETE',
+            headers: { 'X-CSRF-Token': csrfToken() },
         });
         if (response.ok) {
             const li = document.querySelector(`[data-id='${id}']`);
             li.remove();
+        } else {
+            showNotice(await problemDetail(response));
+        }
+    };
+
+    // Shows who is signed in, or a sign-in link when browser sign-in is configured
+    const fetchAccount = async () => {
+        const response = await fetch('/auth/me');
+        if (response.ok) {
+            const me = await response.json();
+            accountName.textContent = me.email || me.subject;
+            signOut.hidden = me.method !== 'session';
+            account.hidden = false;
+        } else if (response.status === 401) {
+            signIn.href = '/auth/login?return_to=' + encodeURIComponent(window.location.pathname);
+            signIn.hidden = false;
+            account.hidden = false;
         }
     };
 
+    signOut.addEventListener('click', async () => {
+        await fetch('/auth/logout', { method: 'POST', headers: { 'X-CSRF-Token': csrfToken() } });
+        window.location.reload();
+    });
+
     form.addEventListener('submit', (e) => {
         e.preventDefault();
         const task = input.value.trim();
@@ -80,5 +147,6 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    fetchAccount();
     fetchTodos();
 });
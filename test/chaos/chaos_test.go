@@ -10,6 +10,7 @@ package chaos_test
 import (
 	"bytes"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -29,6 +30,30 @@ var (
 	mockdb  *sql.DB
 )
 
+// testPrincipal is the user the chaos tests read todos as.
+var testPrincipal = &app.Principal{UserID: 1, TenantID: 1, Subject: "test:chaos", Method: "test"}
+
+// todoColumns are the columns of a todo row.
+var todoColumns = []string{"id", "task", "completed", "list_id", "due_at", "priority", "notes",
+	"created_at", "updated_at", "completed_at", "deleted_at", "tags"}
+
+// todoRow returns the values of a todo row with the default planning fields.
+func todoRow(id int, task string, completed bool, listID int64) []driver.Value {
+	now := time.Now()
+	return []driver.Value{id, task, completed, listID, nil, "normal", "", now, now, nil, nil, "{}"}
+}
+
+// authenticated returns r with testPrincipal as its user.
+func authenticated(r *http.Request) *http.Request {
+	return r.WithContext(app.WithPrincipal(r.Context(), testPrincipal))
+}
+
+// expectTenantTx expects the start of the tenant transaction every query runs in.
+func expectTenantTx(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT set_config\\('app.tenant_id'").WithArgs("1").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
 // TestMain sets up and tears down the test database using go-sqlmock.
 func TestMain(m *testing.M) {
 	var err error
@@ -72,7 +97,8 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-// TestChaosHealthzDBConnectionFailure tests /healthz when DB connection pings fail.
+// TestChaosHealthzDBConnectionFailure tests that /healthz stays up without pinging
+// the database, so a database outage doesn't restart pods and clear their caches.
 func TestChaosHealthzDBConnectionFailure(t *testing.T) {
 	t.Cleanup(func() { // Ensures expectations are met even if test fails mid-way
 		if err := mocksql.ExpectationsWereMet(); err != nil {
@@ -80,18 +106,13 @@ func TestChaosHealthzDBConnectionFailure(t *testing.T) {
 		}
 	})
 
-	// Simulate DB connection failure by making mockdb return an error on Ping
-	mocksql.ExpectPing().WillReturnError(fmt.Errorf("simulated db connection error"))
-
+	// No ping is expected: sqlmock fails a ping it doesn't expect, like a database that is down
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 	w := httptest.NewRecorder()
 	app.HealthzHandler(w, req)
 
-	if w.Code != http.StatusInternalServerError {
-		t.Errorf("expected status %d on /healthz with db down, got %d", http.StatusInternalServerError, w.Code)
-	}
-	if !bytes.Contains(w.Body.Bytes(), []byte("Database connection failed")) {
-		t.Errorf("expected body to contain 'Database connection failed', got %q", w.Body.String())
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d on /healthz with db down, got %d", http.StatusOK, w.Code)
 	}
 }
 
@@ -125,10 +146,12 @@ func TestChaosGetTodosDBConnectionFailure(t *testing.T) {
 	// Set enough expectations to cover both app.DBRead and app.DB attempts during a full retry cycle.
 	numExpectedFailures := 3
 	for i := 0; i < numExpectedFailures; i++ {
+		expectTenantTx(mocksql)
 		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db query error"))
+		mocksql.ExpectRollback()
 	}
 
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w := httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -185,10 +208,12 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	// We need 2 logical failures to trip the CB (ReadyToTrip = ConsecutiveFailures >= 2).
 	// So, we need to make 2 logical calls to app.GetTodos, each failing after retries.
 	for i := 0; i < 2 * numExpectedFailuresPerLogicalCall; i++ {
+		expectTenantTx(mocksql)
 		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db query error CB"))
+		mocksql.ExpectRollback()
 	}
 
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w := httptest.NewRecorder()
 	app.GetTodos(w, req) // First logical failure from CB perspective
 
@@ -208,7 +233,7 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 
 	// --- Phase 2: DB is still down, confirm requests are blocked ---
 	// Expect no query from mock as circuit is open. The CB will return ErrOpenState
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req = authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w = httptest.NewRecorder()
 	app.GetTodos(w, req) // This call should be blocked by CB
 
@@ -227,10 +252,12 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	// --- Phase 4: DB comes back up, test recovery ---
 	t.Log("Restoring database connection (mocksql to return success)...")
 	// Configure mocksql to return a successful query for the single request in half-open state
-	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(1, "Test Task", false))
+	expectTenantTx(mocksql)
+	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(1, "Test Task", false, 1)...))
+	mocksql.ExpectCommit()
 
 	// This request in half-open state should succeed and close the circuit
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req = authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w = httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -244,8 +271,10 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	}
 
 	// Subsequent requests should also succeed
-	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(2, "Another Task", true))
-	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
+	expectTenantTx(mocksql)
+	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(2, "Another Task", true, 1)...))
+	mocksql.ExpectCommit()
+	req = authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w = httptest.NewRecorder()
 	app.GetTodos(w, req)
 	if w.Code != http.StatusOK {
@@ -294,15 +323,19 @@ func TestChaosReadReplicaFailover(t *testing.T) {
 	// `RetryOperation` attempts 8 times
 	numReadReplicaFailures := 1
 	for i := 0; i < numReadReplicaFailures; i++ {
-		mocksqlReplica.ExpectQuery("SELECT id, task, completed FROM todos ORDER BY id").WillReturnError(fmt.Errorf("simulated read replica failure"))
+		expectTenantTx(mocksqlReplica)
+		mocksqlReplica.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 WHERE t.deleted_at IS NULL ORDER BY t.id").WillReturnError(fmt.Errorf("simulated read replica failure"))
+		mocksqlReplica.ExpectRollback()
 	}
 
 	// Expect the subsequent query to mockdbPrimary to succeed (after replica failures and fallback)
-	mocksqlPrimary.ExpectQuery("SELECT id, task, completed FROM todos ORDER BY id").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(2, "Fallback Task", true))
+	expectTenantTx(mocksqlPrimary)
+	mocksqlPrimary.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 WHERE t.deleted_at IS NULL ORDER BY t.id").WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(2, "Fallback Task", true, 1)...))
+	mocksqlPrimary.ExpectCommit()
 
 
 	// Make a GET request, which should use the read replica first, fail, and fall back to the primary
-	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
 	w := httptest.NewRecorder()
 	app.GetTodos(w, req)
 
@@ -310,4 +343,172 @@ func TestChaosReadReplicaFailover(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d when read replica is down but primary is up, got %d. Body: %q", http.StatusOK, w.Code, w.Body.String())
 	}
-}
\ No newline at end of file
+}
+// TestChaosStaleReadsWhenDatabaseDown tests that the last good list is served when reads fail.
+func TestChaosStaleReadsWhenDatabaseDown(t *testing.T) {
+	t.Cleanup(func() {
+		if err := mocksql.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations at the end of TestChaosStaleReadsWhenDatabaseDown: %s", err)
+		}
+	})
+
+	originalAppCB := app.CB
+	defer func() {
+		app.CB = originalAppCB
+		app.TodoCache.Clear()
+	}()
+	app.CB = gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "TempStaleCB"})
+	app.TodoCache.Clear()
+
+	// A successful read fills the cache
+	expectTenantTx(mocksql)
+	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(1, "Cached Task", false, 1)...))
+	mocksql.ExpectCommit()
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
+	w := httptest.NewRecorder()
+	app.GetTodos(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Stale") != "" {
+		t.Fatalf("expected fresh response, got %d (X-Stale=%q)", w.Code, w.Header().Get("X-Stale"))
+	}
+
+	// The database goes away: every retry fails
+	for i := 0; i < 3; i++ {
+		expectTenantTx(mocksql)
+		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db outage"))
+		mocksql.ExpectRollback()
+	}
+	w = httptest.NewRecorder()
+	app.GetTodos(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected stale response with status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("X-Stale") != "true" || w.Header().Get("Warning") == "" {
+		t.Errorf("expected stale headers, got %v", w.Header())
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("Cached Task")) {
+		t.Errorf("expected cached todos in body, got %q", w.Body.String())
+	}
+}
+
+// TestChaosStaleReadsWithSessionCookie tests that a signed-in browser keeps getting
+// stale reads when the database is down, through the real session cookie path.
+func TestChaosStaleReadsWithSessionCookie(t *testing.T) {
+	t.Cleanup(func() {
+		if err := mocksql.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations at the end of TestChaosStaleReadsWithSessionCookie: %s", err)
+		}
+	})
+
+	originalAppCB := app.CB
+	defer func() {
+		app.CB = originalAppCB
+		app.TodoCache.Clear()
+	}()
+	app.CB = gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "TempSessionCB"})
+	app.TodoCache.Clear()
+
+	// Sessions are checked against the database on every request (TTL 0), so the
+	// outage below is covered by the cache fallback only
+	sessions := &app.Sessions{
+		Store:  app.NewCachedSessionStore(app.DBSessionStore{}, app.AuthCacheConfig{MaxStale: time.Minute, MaxEntries: 10}),
+		Cookie: app.SessionCookieConfig{Insecure: true},
+	}
+	handler := app.Chain(http.HandlerFunc(app.GetTodos), app.AuthMiddleware(sessions.Authenticator()), app.RequireAuth)
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+		req.AddCookie(&http.Cookie{Name: "todo_session", Value: "chaos-session"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// A successful read validates the session and fills both caches
+	now := time.Now()
+	mocksql.ExpectQuery("SELECT (.+) FROM sessions s JOIN users u").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "tenant_id", "subject", "email", "created_at", "expires_at"}).
+			AddRow(1, 1, "test:chaos", "chaos@example.com", now, now.Add(time.Hour)))
+	expectTenantTx(mocksql)
+	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(1, "Cached Task", false, 1)...))
+	mocksql.ExpectCommit()
+	if w := get(); w.Code != http.StatusOK || w.Header().Get("X-Stale") != "" {
+		t.Fatalf("expected fresh response, got %d (X-Stale=%q): %s", w.Code, w.Header().Get("X-Stale"), w.Body.String())
+	}
+
+	// The database goes away: the session and the todos can't be read
+	for i := 0; i < 3; i++ {
+		mocksql.ExpectQuery("SELECT (.+) FROM sessions s JOIN users u").WillReturnError(fmt.Errorf("simulated db outage"))
+	}
+	for i := 0; i < 3; i++ {
+		expectTenantTx(mocksql)
+		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db outage"))
+		mocksql.ExpectRollback()
+	}
+	w := get()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected stale response with status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Stale") != "true" || !bytes.Contains(w.Body.Bytes(), []byte("Cached Task")) {
+		t.Errorf("expected the cached todos marked stale, got %v: %q", w.Header(), w.Body.String())
+	}
+}
+
+// TestChaosHedgedReadSlowReplica tests that a slow replica read is hedged to the primary.
+func TestChaosHedgedReadSlowReplica(t *testing.T) {
+	mockdbPrimary, mocksqlPrimary, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create primary sqlmock: %v", err)
+	}
+	defer mockdbPrimary.Close()
+
+	mockdbReplica, mocksqlReplica, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create replica sqlmock: %v", err)
+	}
+	defer mockdbReplica.Close()
+
+	originalAppDB := app.DB
+	originalAppDBRead := app.DBRead
+	originalHedging := app.Hedging
+	defer func() {
+		app.DB = originalAppDB
+		app.DBRead = originalAppDBRead
+		app.Hedging = originalHedging
+		app.TodoCache.Clear()
+	}()
+	app.DB = mockdbPrimary
+	app.DBRead = mockdbReplica
+
+	cfg := app.DefaultHedgeConfig
+	cfg.Enabled = true
+	cfg.MaxDelay = 20 * time.Millisecond
+	app.Hedging = app.NewHedger(cfg)
+
+	// The replica is alive but very slow; the primary answers immediately
+	expectTenantTx(mocksqlReplica)
+	mocksqlReplica.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 WHERE t.deleted_at IS NULL ORDER BY t.id").
+		WillDelayFor(2 * time.Second).
+		WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(1, "Replica Task", false, 1)...))
+	expectTenantTx(mocksqlPrimary)
+	mocksqlPrimary.ExpectQuery("SELECT t.id, t.task, (.+) FROM todos t JOIN list_members m ON m.list_id = t.list_id AND m.user_id = \\$1 WHERE t.deleted_at IS NULL ORDER BY t.id").
+		WillReturnRows(sqlmock.NewRows(todoColumns).AddRow(todoRow(1, "Primary Task", false, 1)...))
+	mocksqlPrimary.ExpectCommit()
+
+	start := time.Now()
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/todos", nil))
+	w := httptest.NewRecorder()
+	app.GetTodos(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d. Body: %q", http.StatusOK, w.Code, w.Body.String())
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("Primary Task")) {
+		t.Errorf("expected the primary's result to win, got %q", w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected hedged read to avoid the replica's latency, took %v", elapsed)
+	}
+	if err := mocksqlPrimary.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the read to be hedged to the primary: %s", err)
+	}
+}